@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/labstack/gommon/log"
+	"uk.co.dudmesh.propolis/internal/boot"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+)
+
+type Directory interface {
+	Sync(entry *model.DirectoryEntry) error
+	UpdateLocation(userID model.UserID, location string) error
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(config *boot.Config, args []string) error
+}
+
+var commands = []command{
+	{"migrate", "migrate every user store to the latest schema", migrate},
+	{"directory-sync", "rebuild directory entries from the user stores", directorySync},
+	{"relocate", "move unsharded user stores into shards; stop the server first", relocate},
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s <command> [args]\n\ncommands:\n", os.Args[0])
+		for _, cmd := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-12s %s\n", cmd.name, cmd.usage)
+		}
+	}
+	flag.Parse()
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	bootConfig, err := boot.Load()
+	if err != nil {
+		log.Fatalf("boot: %+v", err)
+	}
+
+	if err := cmd.run(bootConfig, flag.Args()[1:]); err != nil {
+		log.Fatalf("%s: %+v", flag.Arg(0), err)
+	}
+}
+
+func migrate(config *boot.Config, args []string) error {
+	userIDs, err := store.UserIDs(config)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, userID := range userIDs {
+		// opening a store applies any outstanding migrations
+		userStore, err := store.ForUser(userID, config)
+		if err != nil {
+			log.Errorf("migrating %s: %+v", userID, err)
+			failed++
+			continue
+		}
+		userStore.Close()
+	}
+
+	log.Infof("migrated %d of %d user stores to schema version %d",
+		len(userIDs)-failed, len(userIDs), store.LatestSchemaVersion())
+	if failed > 0 {
+		return fmt.Errorf("%d user stores failed to migrate", failed)
+	}
+	return nil
+}
+
+// directorySync writes a directory entry for every user store, covering users
+// created before the directory existed and any status updates it missed.
+func directorySync(config *boot.Config, args []string) error {
+	directory, err := store.NewDirectory(config)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	userIDs, err := store.UserIDs(config)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, userID := range userIDs {
+		err := syncUser(config, directory, userID)
+		if err != nil {
+			log.Errorf("syncing %s: %+v", userID, err)
+			failed++
+		}
+	}
+
+	log.Infof("synced %d of %d users to the directory", len(userIDs)-failed, len(userIDs))
+	if failed > 0 {
+		return fmt.Errorf("%d users failed to sync", failed)
+	}
+	return nil
+}
+
+func syncUser(config *boot.Config, directory Directory, userID model.UserID) error {
+	userStore, err := store.ForUser(userID, config)
+	if err != nil {
+		return err
+	}
+	defer userStore.Close()
+
+	user, err := userStore.Fetch()
+	if err != nil {
+		return err
+	}
+
+	return directory.Sync(&model.DirectoryEntry{
+		UserID:    user.ID,
+		Handle:    user.Handle,
+		Email:     user.Email,
+		Status:    user.Status,
+		Location:  store.Location(user.ID),
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	})
+}
+
+// relocate moves stores left at the top of the data directory, from before
+// stores were sharded, to where they are looked for now. It must not run
+// while the server has the stores open.
+func relocate(config *boot.Config, args []string) error {
+	directory, err := store.NewDirectory(config)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	userIDs, err := store.UnshardedUserIDs(config)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, userID := range userIDs {
+		err := relocateUser(config, directory, userID)
+		if err != nil {
+			log.Errorf("relocating %s: %+v", userID, err)
+			failed++
+		}
+	}
+
+	log.Infof("relocated %d of %d user stores", len(userIDs)-failed, len(userIDs))
+	if failed > 0 {
+		return fmt.Errorf("%d user stores failed to relocate", failed)
+	}
+	return nil
+}
+
+func relocateUser(config *boot.Config, directory Directory, userID model.UserID) error {
+	if err := store.Relocate(config, userID); err != nil {
+		return err
+	}
+
+	err := directory.UpdateLocation(userID, store.Location(userID))
+	if errors.Is(err, model.ErrorUserNotFound) {
+		// users that predate the directory are added by directory-sync
+		log.Warnf("%s is not in the directory, run directory-sync", userID)
+		return nil
+	}
+	return err
+}
@@ -15,29 +15,139 @@ import (
 	"github.com/nrednav/cuid2"
 	"uk.co.dudmesh.propolis/internal/boot"
 	"uk.co.dudmesh.propolis/internal/handlers"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/service/delivery"
+	"uk.co.dudmesh.propolis/internal/service/direct"
+	"uk.co.dudmesh.propolis/internal/service/fanout"
+	"uk.co.dudmesh.propolis/internal/service/follow"
+	"uk.co.dudmesh.propolis/internal/service/instance"
+	"uk.co.dudmesh.propolis/internal/service/mailer"
+	"uk.co.dudmesh.propolis/internal/service/post"
+	"uk.co.dudmesh.propolis/internal/service/session"
 	"uk.co.dudmesh.propolis/internal/service/user"
+	"uk.co.dudmesh.propolis/internal/store"
 )
 
 type UserService interface {
 	handlers.UserService
+	Close() error
+}
+
+type PostService interface {
+	handlers.PostService
+}
+
+type FollowService interface {
+	handlers.FollowService
+}
+
+type DirectService interface {
+	handlers.DirectService
+}
+
+type SessionService interface {
+	handlers.SessionService
+	Close() error
+}
+
+type InstanceService interface {
+	handlers.InstanceService
+	Sign(req *http.Request, body []byte) error
+}
+
+type SeenMessages interface {
+	handlers.SeenMessages
+	Close() error
+}
+
+type DeliveryService interface {
+	Start() error
+	Close() error
 }
 
 type config struct {
 	boot.Config
-	userService UserService
+	userService     UserService
+	postService     PostService
+	followService   FollowService
+	directService   DirectService
+	sessionService  SessionService
+	instanceService InstanceService
+	deliveryService DeliveryService
+	seenMessages    SeenMessages
+	purger          *store.Purger
+	stores          *store.Manager
 }
 
 func (c *config) UserService() UserService {
 	return c.userService
 }
 
+func (c *config) PostService() PostService {
+	return c.postService
+}
+
 func newConfig(bootConfig *boot.Config) *config {
-	userService, err := user.New(bootConfig)
+	stores := store.NewManager(bootConfig)
+
+	mailerService, err := mailer.New()
+	if err != nil {
+		log.Fatalf("creating mailer: %+v", err)
+	}
+
+	userService, err := user.New(bootConfig, stores, mailerService)
 	if err != nil {
 		log.Fatalf("creating user service: %+v", err)
 	}
 
-	return &config{*bootConfig, userService}
+	sessionService, err := session.New(bootConfig)
+	if err != nil {
+		log.Fatalf("creating session service: %+v", err)
+	}
+
+	instanceService, err := instance.New(bootConfig)
+	if err != nil {
+		log.Fatalf("creating instance service: %+v", err)
+	}
+
+	resolver, err := delivery.NewResolver(bootConfig)
+	if err != nil {
+		log.Fatalf("creating delivery resolver: %+v", err)
+	}
+
+	deliveryService, err := delivery.New(bootConfig, resolver, stores, instanceService)
+	if err != nil {
+		log.Fatalf("creating delivery service: %+v", err)
+	}
+
+	fanoutService, err := fanout.New(bootConfig, stores, deliveryService)
+	if err != nil {
+		log.Fatalf("creating fanout service: %+v", err)
+	}
+
+	postService, err := post.New(bootConfig, stores, fanoutService)
+	if err != nil {
+		log.Fatalf("creating post service: %+v", err)
+	}
+
+	followService, err := follow.New(bootConfig, stores, deliveryService, instanceService)
+	if err != nil {
+		log.Fatalf("creating follow service: %+v", err)
+	}
+
+	directService, err := direct.New(bootConfig, stores, userService, deliveryService)
+	if err != nil {
+		log.Fatalf("creating direct message service: %+v", err)
+	}
+
+	seenMessages, err := store.NewSeenMessages(bootConfig)
+	if err != nil {
+		log.Fatalf("creating seen messages store: %+v", err)
+	}
+
+	purger := store.NewPurger(bootConfig, stores)
+
+	return &config{*bootConfig, userService, postService, followService, directService, sessionService, instanceService, deliveryService, seenMessages, purger, stores}
 }
 
 func main() {
@@ -47,6 +157,9 @@ func main() {
 	}
 
 	config := newConfig(bootConfig)
+	if err := config.deliveryService.Start(); err != nil {
+		log.Fatalf("starting delivery service: %+v", err)
+	}
 
 	server := echo.New()
 	server.Use(middleware.BodyLimit("100M"))
@@ -67,9 +180,36 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	server.POST("/ingest", handlers.Ingest(config.userService))
-	server.GET("/user/:userAddress/publickey", handlers.CreateUser(config.userService))
+	server.GET("/.well-known/webfinger", handlers.WebFinger(config.userService, config.ServerBaseURL()))
+	server.GET("/.well-known/nodeinfo", handlers.NodeInfoLinks(config.ServerBaseURL()))
+	server.GET("/nodeinfo/2.1", handlers.NodeInfo())
+	server.GET(model.InstanceKeyPath, handlers.GetInstanceKey(config.instanceService))
+	server.POST("/ingest", handlers.Ingest(config.userService, config.postService, config.followService, config.directService, config.instanceService, config.seenMessages, config.MessageWindow()))
+	server.GET("/user/:userAddress/publickey", handlers.GetPublicKey(config.userService))
+	server.GET("/user/:userAddress/post/:postID", handlers.GetPost(config.postService), handlers.OptionalSession(config.sessionService))
 	server.POST("/local/user", handlers.CreateUser(config.userService))
+	server.POST("/local/user/verify", handlers.VerifyUser(config.userService))
+	server.POST("/local/user/reset", handlers.ResetPassword(config.userService, config.sessionService))
+	server.POST("/local/session", handlers.Login(config.userService, config.sessionService))
+
+	authenticated := server.Group("", handlers.RequireSession(config.sessionService))
+	authenticated.DELETE("/local/session", handlers.Logout(config.sessionService))
+	authenticated.DELETE("/local/user/:userAddress", handlers.DeleteUser(config.userService, config.sessionService))
+	authenticated.PUT("/local/user/:userAddress/password", handlers.ChangePassword(config.userService, config.sessionService))
+	authenticated.PUT("/local/user/:userAddress/approve-followers", handlers.SetApproveFollowers(config.followService))
+	authenticated.GET("/user/:userAddress/timeline", handlers.GetTimeline(config.postService))
+	authenticated.GET("/user/:userAddress/direct", handlers.ListDirect(config.directService))
+	authenticated.POST("/user/:userAddress/direct", handlers.SendDirect(config.directService))
+	authenticated.GET("/user/:userAddress/followers", handlers.ListFollowers(config.followService))
+	authenticated.POST("/user/:userAddress/followers/:address/approve", handlers.ApproveFollower(config.followService))
+	authenticated.DELETE("/user/:userAddress/followers/:address", handlers.RejectFollower(config.followService))
+	authenticated.GET("/user/:userAddress/following", handlers.ListFollowing(config.followService))
+	authenticated.POST("/user/:userAddress/following", handlers.FollowUser(config.followService))
+	authenticated.DELETE("/user/:userAddress/following/:address", handlers.UnfollowUser(config.followService))
+
+	admin := server.Group("/admin", handlers.RequireAdmin(config.AdminAccessToken()))
+	admin.GET("/user", handlers.ListUsers(config.userService))
+	admin.POST("/user/:userAddress/unlock", handlers.UnlockUser(config.userService))
 
 	go func() {
 		metrics := echo.New()
@@ -93,4 +233,22 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		server.Logger.Fatal(err)
 	}
+	if err := config.deliveryService.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
+	if err := config.sessionService.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
+	if err := config.userService.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
+	if err := config.seenMessages.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
+	if err := config.purger.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
+	if err := config.stores.Close(); err != nil {
+		server.Logger.Fatal(err)
+	}
 }
@@ -3,21 +3,68 @@ package boot
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/sethvargo/go-envconfig"
+	"uk.co.dudmesh.propolis/pkg/message"
 )
 
 type Config struct {
 	Env     string `env:"ENV,default=dev"`
 	BaseURL string `env:"BASE_URL,required"`
-	DataDir string `env:"DATA_DIR"`
-	Server  struct {
+	DataDir string `env:"DATA_DIR,required"`
+	Admin   struct {
+		Token string `env:"ADMIN_TOKEN"`
+	}
+	Server struct {
 		Port    string `env:"PORT,default=8080"`
 		Origins string `env:"ALLOWED_ORIGINS,required"`
+		// SignatureMaxAge is how far from now the signature on a request
+		// from another server may have been made.
+		SignatureMaxAge time.Duration `env:"SERVER_SIGNATURE_MAX_AGE,default=5m"`
 	}
 	Postgres struct {
 		DatabaseURL string `env:"DATABASE_URL,required"`
 	}
+	Login struct {
+		MaxAttempts     int           `env:"LOGIN_MAX_ATTEMPTS,default=5"`
+		LockoutDuration time.Duration `env:"LOGIN_LOCKOUT_DURATION,default=15m"`
+	}
+	Store struct {
+		MaxOpen       int           `env:"STORE_MAX_OPEN,default=256"`
+		IdleTimeout   time.Duration `env:"STORE_IDLE_TIMEOUT,default=5m"`
+		SweepInterval time.Duration `env:"STORE_SWEEP_INTERVAL,default=1m"`
+		// PurgeInterval is how often expired messages are deleted from
+		// every user store.
+		PurgeInterval time.Duration `env:"STORE_PURGE_INTERVAL,default=15m"`
+	}
+	PublicKeyCache struct {
+		TTL           time.Duration `env:"PUBLIC_KEY_CACHE_TTL,default=1h"`
+		MaxEntries    int           `env:"PUBLIC_KEY_CACHE_MAX_ENTRIES,default=10000"`
+		SweepInterval time.Duration `env:"PUBLIC_KEY_CACHE_SWEEP_INTERVAL,default=1m"`
+	}
+	Session struct {
+		IdleTimeout   time.Duration `env:"SESSION_IDLE_TIMEOUT,default=30m"`
+		SweepInterval time.Duration `env:"SESSION_SWEEP_INTERVAL,default=1m"`
+	}
+	Ingest struct {
+		// MessageMaxAge is how old a delivered message may be. Deliveries
+		// are retried for up to DELIVERY_DEADLINE, so this should be at
+		// least as long, or late retries will be turned away as stale.
+		MessageMaxAge time.Duration `env:"INGEST_MESSAGE_MAX_AGE,default=72h"`
+		// MessageMaxSkew is how far ahead of this server's clock a
+		// message's timestamp may be.
+		MessageMaxSkew    time.Duration `env:"INGEST_MESSAGE_MAX_SKEW,default=5m"`
+		SeenSweepInterval time.Duration `env:"INGEST_SEEN_SWEEP_INTERVAL,default=10m"`
+	}
+	Delivery struct {
+		Workers      int           `env:"DELIVERY_WORKERS,default=4"`
+		PollInterval time.Duration `env:"DELIVERY_POLL_INTERVAL,default=5s"`
+		MinBackoff   time.Duration `env:"DELIVERY_MIN_BACKOFF,default=10s"`
+		MaxBackoff   time.Duration `env:"DELIVERY_MAX_BACKOFF,default=1h"`
+		Deadline     time.Duration `env:"DELIVERY_DEADLINE,default=72h"`
+	}
 }
 
 func Load() (*Config, error) {
@@ -25,6 +72,14 @@ func Load() (*Config, error) {
 	if err := envconfig.Process(context.Background(), config); err != nil {
 		return nil, fmt.Errorf("parsing env vars: %w", err)
 	}
+	if !filepath.IsAbs(config.DataDir) {
+		return nil, fmt.Errorf("DATA_DIR must be an absolute path")
+	}
+	// a message that becomes valid later is only delivered then, so it has to
+	// still be within both limits
+	if config.Delivery.Deadline <= message.MaxNotBefore || config.Ingest.MessageMaxAge <= message.MaxNotBefore {
+		return nil, fmt.Errorf("DELIVERY_DEADLINE and INGEST_MESSAGE_MAX_AGE must be longer than %s", message.MaxNotBefore)
+	}
 	return config, nil
 }
 
@@ -39,3 +94,89 @@ func (c *Config) IsDevelopment() bool {
 func (c *Config) DataDirectory() string {
 	return c.DataDir
 }
+
+func (c *Config) ServerBaseURL() string {
+	return c.BaseURL
+}
+
+func (c *Config) ServerSignatureMaxAge() time.Duration {
+	return c.Server.SignatureMaxAge
+}
+
+func (c *Config) DatabaseURL() string {
+	return c.Postgres.DatabaseURL
+}
+
+func (c *Config) AdminAccessToken() string {
+	return c.Admin.Token
+}
+
+func (c *Config) LoginMaxAttempts() int {
+	return c.Login.MaxAttempts
+}
+
+func (c *Config) LoginLockoutDuration() time.Duration {
+	return c.Login.LockoutDuration
+}
+
+func (c *Config) StoreMaxOpen() int {
+	return c.Store.MaxOpen
+}
+
+func (c *Config) StoreIdleTimeout() time.Duration {
+	return c.Store.IdleTimeout
+}
+
+func (c *Config) StoreSweepInterval() time.Duration {
+	return c.Store.SweepInterval
+}
+
+func (c *Config) StorePurgeInterval() time.Duration {
+	return c.Store.PurgeInterval
+}
+
+func (c *Config) PublicKeyCacheTTL() time.Duration {
+	return c.PublicKeyCache.TTL
+}
+
+func (c *Config) PublicKeyCacheMaxEntries() int {
+	return c.PublicKeyCache.MaxEntries
+}
+
+func (c *Config) PublicKeyCacheSweepInterval() time.Duration {
+	return c.PublicKeyCache.SweepInterval
+}
+
+func (c *Config) SessionIdleTimeout() time.Duration {
+	return c.Session.IdleTimeout
+}
+
+func (c *Config) SessionSweepInterval() time.Duration {
+	return c.Session.SweepInterval
+}
+
+// MessageWindow is how far from now the timestamp of an ingested message may
+// be.
+func (c *Config) MessageWindow() message.Window {
+	return message.Window{MaxAge: c.Ingest.MessageMaxAge, MaxSkew: c.Ingest.MessageMaxSkew}
+}
+
+func (c *Config) SeenMessagesSweepInterval() time.Duration {
+	return c.Ingest.SeenSweepInterval
+}
+
+func (c *Config) DeliveryWorkers() int {
+	return c.Delivery.Workers
+}
+
+func (c *Config) DeliveryPollInterval() time.Duration {
+	return c.Delivery.PollInterval
+}
+
+func (c *Config) DeliveryBackoff() (time.Duration, time.Duration) {
+	return c.Delivery.MinBackoff, c.Delivery.MaxBackoff
+}
+
+func (c *Config) DeliveryDeadline() time.Duration {
+	return c.Delivery.Deadline
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func SendDirect(directService DirectService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		params := &model.SendDirectParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+
+		sent, err := directService.Send(owner, signingKey(c), params.To, &params.DirectMessage, params.ExpiresAt)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusAccepted, sent)
+	}
+}
+
+// ListDirect opens the user's direct messages with the key unlocked by their
+// session.
+func ListDirect(directService DirectService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		cursor, limit, err := pageParams(c)
+		if err != nil {
+			return err
+		}
+
+		page, err := directService.Inbox(owner, signingKey(c), cursor, limit)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/crypt"
+	"uk.co.dudmesh.propolis/pkg/message"
+)
+
+const softwareName = "propolis"
+
+// WebFinger resolves acct:handle@domain and acct:id@domain resources to the
+// user's public key and the endpoint that ingests messages for them.
+func WebFinger(userService UserService, baseURL string) echo.HandlerFunc {
+	baseURL = strings.TrimRight(baseURL, "/")
+	return func(c echo.Context) error {
+		account, ok := strings.CutPrefix(c.QueryParam("resource"), "acct:")
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "resource must be an acct: URI")
+		}
+		address := model.UserAddress(account)
+		_, domain, err := address.Parse()
+		if err != nil || domain == "" {
+			return httpError(model.ErrorInvalidAddress)
+		}
+
+		entry, err := userService.Lookup(address)
+		if err != nil {
+			return httpError(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, string(model.ContentTypeJRD))
+		return c.JSON(http.StatusOK, &model.WebFinger{
+			Subject: "acct:" + entry.Handle + "@" + domain,
+			Aliases: []string{"acct:" + string(entry.UserID) + "@" + domain},
+			Links: []model.WebFingerLink{
+				{
+					Rel:  model.RelPublicKey,
+					Type: string(model.ContentTypeJSON),
+					Href: baseURL + "/user/" + url.PathEscape(string(entry.UserID)) + "/publickey",
+				},
+				{
+					Rel:  model.RelIngest,
+					Href: baseURL + "/ingest",
+				},
+			},
+		})
+	}
+}
+
+// NodeInfoLinks is the well known document pointing at NodeInfo.
+func NodeInfoLinks(baseURL string) echo.HandlerFunc {
+	baseURL = strings.TrimRight(baseURL, "/")
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, &model.NodeInfoLinks{
+			Links: []model.WebFingerLink{{Rel: model.RelNodeInfo, Href: baseURL + "/nodeinfo/2.1"}},
+		})
+	}
+}
+
+// NodeInfo describes the server software and the messages it accepts.
+func NodeInfo() echo.HandlerFunc {
+	contentTypes := make([]model.ContentType, 0, len(messageStrategies))
+	for contentType := range messageStrategies {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Slice(contentTypes, func(i, j int) bool { return contentTypes[i] < contentTypes[j] })
+
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, string(model.ContentTypeNodeInfo))
+		return c.JSON(http.StatusOK, &model.NodeInfo{
+			Version:           "2.1",
+			Software:          model.NodeInfoSoftware{Name: softwareName, Version: softwareVersion()},
+			Protocols:         []string{softwareName},
+			Services:          model.NodeInfoServices{Inbound: []string{}, Outbound: []string{}},
+			OpenRegistrations: true,
+			Metadata: model.NodeInfoMetadata{
+				ProtocolVersion: message.Version,
+				ContentTypes:    contentTypes,
+			},
+		})
+	}
+}
+
+func softwareVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return info.Main.Version
+}
+
+// GetInstanceKey publishes the key this server signs its requests with, in
+// the same form as user public keys.
+func GetInstanceKey(instanceService InstanceService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		keyEncoded, err := crypt.EncodePublicKey(instanceService.PublicKey(), instanceService.KeyID())
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, keyEncoded)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/message"
+)
+
+func TestWebFinger(t *testing.T) {
+	assert := assert.New(t)
+
+	userService := &fakeUserService{entries: []*model.DirectoryEntry{{UserID: "3GFQNuSg3dPqDD1emxv5bqX42oxq", Handle: "alice"}}}
+	server := echo.New()
+	handler := WebFinger(userService, "https://propolis.example.com/")
+
+	webfinger := func(resource string) (int, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/webfinger?resource="+url.QueryEscape(resource), nil)
+		rec := httptest.NewRecorder()
+		err := handler(server.NewContext(req, rec))
+		if err != nil {
+			server.HTTPErrorHandler(err, server.NewContext(req, rec))
+		}
+		return rec.Code, rec
+	}
+
+	for _, resource := range []string{"acct:alice@propolis.example.com", "acct:3GFQNuSg3dPqDD1emxv5bqX42oxq@propolis.example.com"} {
+		t.Run(resource, func(t *testing.T) {
+			code, rec := webfinger(resource)
+			assert.Equal(http.StatusOK, code)
+			assert.Equal(string(model.ContentTypeJRD), rec.Header().Get(echo.HeaderContentType))
+
+			res := &model.WebFinger{}
+			assert.Nil(json.Unmarshal(rec.Body.Bytes(), res))
+			assert.Equal("acct:alice@propolis.example.com", res.Subject)
+			assert.Equal([]string{"acct:3GFQNuSg3dPqDD1emxv5bqX42oxq@propolis.example.com"}, res.Aliases)
+			assert.Equal([]model.WebFingerLink{
+				{Rel: model.RelPublicKey, Type: "application/json", Href: "https://propolis.example.com/user/3GFQNuSg3dPqDD1emxv5bqX42oxq/publickey"},
+				{Rel: model.RelIngest, Href: "https://propolis.example.com/ingest"},
+			}, res.Links)
+		})
+	}
+
+	t.Run("Unknown User", func(t *testing.T) {
+		code, _ := webfinger("acct:bob@propolis.example.com")
+		assert.Equal(http.StatusNotFound, code)
+	})
+
+	t.Run("Invalid Resource", func(t *testing.T) {
+		for _, resource := range []string{"", "https://propolis.example.com/alice", "acct:alice", "acct:@propolis.example.com"} {
+			code, _ := webfinger(resource)
+			assert.Equal(http.StatusBadRequest, code, resource)
+		}
+	})
+}
+
+func TestNodeInfo(t *testing.T) {
+	assert := assert.New(t)
+	server := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/nodeinfo", nil)
+	rec := httptest.NewRecorder()
+	assert.Nil(NodeInfoLinks("https://propolis.example.com")(server.NewContext(req, rec)))
+
+	links := &model.NodeInfoLinks{}
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), links))
+	assert.Equal([]model.WebFingerLink{{Rel: model.RelNodeInfo, Href: "https://propolis.example.com/nodeinfo/2.1"}}, links.Links)
+
+	req = httptest.NewRequest(http.MethodGet, "/nodeinfo/2.1", nil)
+	rec = httptest.NewRecorder()
+	assert.Nil(NodeInfo()(server.NewContext(req, rec)))
+	assert.Equal(string(model.ContentTypeNodeInfo), rec.Header().Get(echo.HeaderContentType))
+
+	info := &model.NodeInfo{}
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), info))
+	assert.Equal("2.1", info.Version)
+	assert.Equal("propolis", info.Software.Name)
+	assert.Equal(message.Version, info.Metadata.ProtocolVersion)
+	assert.Equal([]model.ContentType{
+		model.ContentTypeAccept,
+		model.ContentTypeEncrypted,
+		model.ContentTypeFollow,
+		model.ContentTypePost,
+		model.ContentTypeReject,
+		model.ContentTypeUnfollow,
+	}, info.Metadata.ContentTypes)
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/httpsig"
+	"uk.co.dudmesh.propolis/pkg/message"
+)
+
+func httpError(err error) error {
+	var unsupportedContentType *model.UnsupportedContentTypeError
+	var fieldError *model.FieldError
+	switch {
+	case errors.As(err, &unsupportedContentType):
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, err.Error()).SetInternal(err)
+	case errors.As(err, &fieldError):
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, model.ErrorAlreadyTaken) {
+			status = http.StatusConflict
+		}
+		return echo.NewHTTPError(status, echo.Map{"field": fieldError.Field, "message": fieldError.Error()}).SetInternal(err)
+	case errors.Is(err, model.ErrorUserNotFound),
+		errors.Is(err, model.ErrorPostNotFound),
+		errors.Is(err, model.ErrorFollowNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorInvalidUsernameOrPassword),
+		errors.Is(err, model.ErrorSessionNotFound):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorUserNotActive):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorInvalidStatusTransition):
+		return echo.NewHTTPError(http.StatusConflict, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorInvalidRecoveryKey):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorCredentialsChanged):
+		return echo.NewHTTPError(http.StatusConflict, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorReplayedMessage):
+		// the code tells the sender this conflict means it can stop retrying
+		return echo.NewHTTPError(http.StatusConflict, &model.IngestErrorResponse{Code: model.IngestErrorCodeReplayed, Message: err.Error()}).SetInternal(err)
+	case errors.Is(err, model.ErrorInvalidVerificationToken):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorSenderMismatch),
+		errors.Is(err, model.ErrorNotInAudience):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorEncryptionUnsupported),
+		errors.Is(err, model.ErrorPublicKeyMismatch):
+		// the other user's key is unusable, which is no fault of this server
+		// or of whoever asked
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorPostDeleted):
+		return echo.NewHTTPError(http.StatusGone, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorPostSuperseded):
+		return echo.NewHTTPError(http.StatusConflict, err.Error()).SetInternal(err)
+	case errors.Is(err, httpsig.ErrorMissingSignature),
+		errors.Is(err, httpsig.ErrorInvalidSignature),
+		errors.Is(err, httpsig.ErrorExpiredSignature),
+		errors.Is(err, httpsig.ErrorUnknownKey):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorKeyUnavailable):
+		// the sender retries once the key can be fetched again
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error()).SetInternal(err)
+	case errors.Is(err, message.ErrorInvalidSignature),
+		errors.Is(err, message.ErrorUnsupportedKey):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error()).SetInternal(err)
+	case errors.Is(err, message.ErrorNotYetValid):
+		// the sender retries until the message becomes valid
+		return echo.NewHTTPError(http.StatusTooEarly, err.Error()).SetInternal(err)
+	case errors.Is(err, model.ErrorInvalidPayload),
+		errors.Is(err, model.ErrorMissingRecipient),
+		errors.Is(err, model.ErrorInvalidCursor),
+		errors.Is(err, model.ErrorInvalidAddress),
+		errors.Is(err, httpsig.ErrorDigestMismatch),
+		errors.Is(err, message.ErrorInvalidMessage),
+		errors.Is(err, message.ErrorStaleMessage),
+		errors.Is(err, message.ErrorExpiredMessage),
+		errors.Is(err, message.ErrorMissingPayload):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func FollowUser(followService FollowService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		params := &model.FollowParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+
+		follow, err := followService.Follow(owner, signingKey(c), params.Address)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusAccepted, follow)
+	}
+}
+
+func UnfollowUser(followService FollowService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		err = followService.Unfollow(owner, signingKey(c), model.UserAddress(c.Param("address")))
+		if err != nil {
+			return httpError(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func ApproveFollower(followService FollowService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		follow, err := followService.Approve(owner, signingKey(c), model.UserAddress(c.Param("address")))
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, follow)
+	}
+}
+
+func RejectFollower(followService FollowService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		err = followService.Reject(owner, signingKey(c), model.UserAddress(c.Param("address")))
+		if err != nil {
+			return httpError(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func SetApproveFollowers(followService FollowService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		params := &model.ApproveFollowersParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+
+		user, err := followService.SetApproveFollowers(owner, params.ApproveFollowers)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+func ListFollowers(followService FollowService) echo.HandlerFunc {
+	return listFollows(followService.Followers)
+}
+
+func ListFollowing(followService FollowService) echo.HandlerFunc {
+	return listFollows(followService.Following)
+}
+
+func listFollows(list func(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error)) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+
+		limit := 0
+		if param := c.QueryParam("limit"); param != "" {
+			var err error
+			limit, err = strconv.Atoi(param)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+			}
+		}
+
+		page, err := list(owner, model.UserAddress(c.QueryParam("after")), limit)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+}
@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"uk.co.dudmesh.propolis/internal/model"
@@ -13,55 +17,321 @@ import (
 )
 
 type UserService interface {
-	Create(params *model.CreateUserParams) (*model.User, error)
-	PublicKeyFor(address model.UserAddress) (*ecdsa.PublicKey, error)
+	Create(params *model.CreateUserParams) (*model.CreateUserResult, error)
+	Verify(params *model.VerifyUserParams) (*model.User, error)
+	Unlock(address model.UserAddress) (*model.User, error)
+	Delete(address model.UserAddress) (*model.User, error)
+	ChangePassword(params *model.ChangePasswordParams) (*model.User, error)
+	ResetPassword(params *model.ResetPasswordParams) (*model.ResetPasswordResult, error)
+	Authenticate(params *model.LoginParams) (*model.User, crypto.Signer, error)
+	PublicKeyFor(address model.UserAddress) (crypto.PublicKey, error)
+	LocalPublicKey(address model.UserAddress) (crypto.PublicKey, error)
+	Lookup(address model.UserAddress) (*model.DirectoryEntry, error)
+	List(after model.UserID, limit int) (*model.DirectoryPage, error)
+}
+
+type PostService interface {
+	Receive(recipient model.UserAddress, message *message.Message, post *model.Post) error
+	Timeline(owner model.UserID, cursor *model.TimelineCursor, limit int) (*model.TimelinePage, error)
+	View(author model.UserID, id model.PostID, viewer model.UserID) (*model.PostRecord, error)
+}
+
+type FollowService interface {
+	Follow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) (*model.Follow, error)
+	Unfollow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) error
+	Approve(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) (*model.Follow, error)
+	Reject(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) error
+	SetApproveFollowers(owner model.UserID, approve bool) (*model.User, error)
+	Followers(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error)
+	Following(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error)
+	ReceiveRequest(recipient model.UserAddress, message *message.Message, contentType model.ContentType, request *model.FollowRequest) error
+	ReceiveResponse(recipient model.UserAddress, message *message.Message, contentType model.ContentType, response *model.FollowResponse) error
+}
+
+type DirectService interface {
+	Send(sender model.UserID, privateKey crypto.Signer, to []model.UserAddress, direct *model.DirectMessage, expiresAt *time.Time) (*model.DirectMessageRecord, error)
+	Receive(recipient model.UserAddress, message *message.Message, envelope *message.Envelope) error
+	Inbox(owner model.UserID, privateKey crypto.Signer, cursor *model.TimelineCursor, limit int) (*model.DirectMessagePage, error)
+}
+
+type InstanceService interface {
+	KeyID() string
+	PublicKey() *ecdsa.PublicKey
+	PublicKeyFor(domain string) (*ecdsa.PublicKey, error)
+	Verify(req *http.Request, body []byte) (string, error)
+}
+
+// SeenMessages remembers which recipients each ingested message has been
+// accepted for.
+type SeenMessages interface {
+	Claim(messageID string, recipients []model.UserAddress, expiresAt time.Time) ([]model.UserAddress, error)
+	Release(messageID string, recipients []model.UserAddress) error
 }
 
 type MessageStrategy interface {
 	Do() error
 }
 
-type unmarshallerFunc func(*message.Message) (interface{}, error)
+type ingestRequest struct {
+	message       *message.Message
+	recipients    []model.UserAddress
+	postService   PostService
+	followService FollowService
+	directService DirectService
+}
 
-func unmarshallPost(message *message.Message) (interface{}, error) {
+type strategyFunc func(request *ingestRequest) (MessageStrategy, error)
+
+type postStrategy struct {
+	request *ingestRequest
+	post    *model.Post
+}
+
+func newPostStrategy(request *ingestRequest) (MessageStrategy, error) {
 	var post model.Post
-	err := json.Unmarshal(message.Payload, &post)
+	err := json.Unmarshal(request.message.Payload, &post)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling post: %s", model.ErrorInvalidPayload, err)
+	}
+	if err := post.Validate(); err != nil {
+		return nil, err
+	}
+	return &postStrategy{request, &post}, nil
+}
+
+func (s *postStrategy) Do() error {
+	return eachRecipient(s.request.recipients, func(recipient model.UserAddress) error {
+		return s.request.postService.Receive(recipient, s.request.message, s.post)
+	})
+}
+
+// followStrategy handles follow and unfollow messages, which share a payload.
+type followStrategy struct {
+	request       *ingestRequest
+	contentType   model.ContentType
+	followRequest *model.FollowRequest
+}
+
+func newFollowStrategy(request *ingestRequest) (MessageStrategy, error) {
+	var followRequest model.FollowRequest
+	err := json.Unmarshal(request.message.Payload, &followRequest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling follow request: %s", model.ErrorInvalidPayload, err)
+	}
+	if err := followRequest.Validate(); err != nil {
+		return nil, err
+	}
+	return &followStrategy{request, baseContentType(request.message), &followRequest}, nil
+}
+
+func (s *followStrategy) Do() error {
+	return eachRecipient(s.request.recipients, func(recipient model.UserAddress) error {
+		return s.request.followService.ReceiveRequest(recipient, s.request.message, s.contentType, s.followRequest)
+	})
+}
+
+// followResponseStrategy handles accept and reject messages, which share a
+// payload.
+type followResponseStrategy struct {
+	request     *ingestRequest
+	contentType model.ContentType
+	response    *model.FollowResponse
+}
+
+func newFollowResponseStrategy(request *ingestRequest) (MessageStrategy, error) {
+	var response model.FollowResponse
+	err := json.Unmarshal(request.message.Payload, &response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling follow response: %s", model.ErrorInvalidPayload, err)
+	}
+	if err := response.Validate(); err != nil {
+		return nil, err
+	}
+	return &followResponseStrategy{request, baseContentType(request.message), &response}, nil
+}
+
+func (s *followResponseStrategy) Do() error {
+	return eachRecipient(s.request.recipients, func(recipient model.UserAddress) error {
+		return s.request.followService.ReceiveResponse(recipient, s.request.message, s.contentType, s.response)
+	})
+}
+
+// encryptedStrategy handles encrypted messages, which are kept for their
+// recipients to open since this server can't read them.
+type encryptedStrategy struct {
+	request  *ingestRequest
+	envelope *message.Envelope
+}
+
+func newEncryptedStrategy(request *ingestRequest) (MessageStrategy, error) {
+	var envelope message.Envelope
+	err := json.Unmarshal(request.message.Payload, &envelope)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshalling post: %w", err)
+		return nil, fmt.Errorf("%w: unmarshalling envelope: %s", model.ErrorInvalidPayload, err)
 	}
-	return &post, nil
+	if len(envelope.To()) == 0 || envelope.Ciphertext == "" {
+		return nil, fmt.Errorf("%w: incomplete envelope", model.ErrorInvalidPayload)
+	}
+	return &encryptedStrategy{request, &envelope}, nil
 }
 
-var messageStrategies = map[model.ContentType]unmarshallerFunc{
-	model.ContentTypePost: unmarshallPost,
+func (s *encryptedStrategy) Do() error {
+	return eachRecipient(s.request.recipients, func(recipient model.UserAddress) error {
+		return s.request.directService.Receive(recipient, s.request.message, s.envelope)
+	})
 }
 
-func UnmarshalMessagePayload(message *message.Message) (MessageStrategy, error) {
-	contentType := strings.SplitN(message.ContentType, ";", 2)
-	unmarshaller, ok := messageStrategies[model.ContentType(contentType[0])]
+// eachRecipient delivers a message to every recipient. A message reaches all
+// of a server's recipients in one request, so recipients who don't exist,
+// can't receive messages or aren't in the message's audience are skipped
+// rather than failing delivery to the rest. It only fails for them if nobody
+// could receive the message.
+func eachRecipient(recipients []model.UserAddress, deliver func(recipient model.UserAddress) error) error {
+	var skipped error
+	delivered := 0
+	for _, recipient := range recipients {
+		err := deliver(recipient)
+		if errors.Is(err, model.ErrorUserNotFound) || errors.Is(err, model.ErrorUserNotActive) || errors.Is(err, model.ErrorNotInAudience) {
+			skipped = fmt.Errorf("delivering to %s: %w", recipient, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("delivering to %s: %w", recipient, err)
+		}
+		delivered++
+	}
+	if delivered == 0 && skipped != nil {
+		return skipped
+	}
+	return nil
+}
+
+var messageStrategies = map[model.ContentType]strategyFunc{
+	model.ContentTypePost:      newPostStrategy,
+	model.ContentTypeFollow:    newFollowStrategy,
+	model.ContentTypeUnfollow:  newFollowStrategy,
+	model.ContentTypeAccept:    newFollowResponseStrategy,
+	model.ContentTypeReject:    newFollowResponseStrategy,
+	model.ContentTypeEncrypted: newEncryptedStrategy,
+}
+
+// baseContentType is the message's content type without any parameters.
+func baseContentType(msg *message.Message) model.ContentType {
+	contentType, _, _ := strings.Cut(msg.ContentType, ";")
+	return model.ContentType(contentType)
+}
+
+func UnmarshalMessagePayload(request *ingestRequest) (MessageStrategy, error) {
+	newStrategy, ok := messageStrategies[baseContentType(request.message)]
 	if !ok {
-		return nil, fmt.Errorf("unknown content type: %s", message.ContentType)
+		return nil, &model.UnsupportedContentTypeError{ContentType: request.message.ContentType}
+	}
+	return newStrategy(request)
+}
+
+func recipientsFromRequest(r *http.Request) []model.UserAddress {
+	recipients := []model.UserAddress{}
+	for _, value := range r.Header.Values(model.HeaderRecipient) {
+		for _, address := range strings.Split(value, ",") {
+			address = strings.TrimSpace(address)
+			if address != "" {
+				recipients = append(recipients, model.UserAddress(address))
+			}
+		}
 	}
-	return unmarshaller(message)
+	return recipients
 }
 
-func Ingest(userService UserService) echo.HandlerFunc {
+// senderKey finds the key to check a message from keyID with, once the
+// sender is known to belong to the server that delivered it, so that no
+// server can have keys fetched from anywhere else. A sender without a domain
+// is a local user, so only this server may deliver for one.
+func senderKey(userService UserService, instanceService InstanceService, server string, keyID string) (crypto.PublicKey, error) {
+	if strings.EqualFold(keyID, server) {
+		return instanceService.PublicKeyFor(server)
+	}
+	_, domain, err := model.UserAddress(keyID).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if domain == "" {
+		domain = strings.ToLower(instanceService.KeyID())
+	}
+	if domain != server {
+		return nil, model.ErrorSenderMismatch
+	}
+	return userService.PublicKeyFor(model.UserAddress(keyID))
+}
+
+// Ingest accepts messages delivered by servers, including this one. The
+// request must be signed by the server delivering it, and a sender with a
+// domain must belong to that server. The only messages the server may sign
+// itself are accepts. Messages are only accepted within the window of their
+// timestamp, and only once for each recipient; a delivery that only repeats
+// recipients who already have the message is a replay.
+func Ingest(userService UserService, postService PostService, followService FollowService, directService DirectService, instanceService InstanceService, seenMessages SeenMessages, window message.Window) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		body := c.Request().Body
 		defer body.Close()
 
+		recipients := recipientsFromRequest(c.Request())
+		if len(recipients) == 0 {
+			return httpError(model.ErrorMissingRecipient)
+		}
+
 		rawRequest, err := io.ReadAll(body)
 		if err != nil {
 			return fmt.Errorf("reading request body: %w", err)
 		}
 
-		message, err := message.Parse(rawRequest, func(header *message.Header) (*ecdsa.PublicKey, error) {
-			return userService.PublicKeyFor(model.UserAddress(header.KeyID))
+		server, err := instanceService.Verify(c.Request(), rawRequest)
+		if err != nil {
+			return httpError(fmt.Errorf("verifying server signature: %w", err))
+		}
+
+		msg, err := message.Parse(rawRequest, func(header *message.Header) (crypto.PublicKey, error) {
+			return senderKey(userService, instanceService, server, header.KeyID)
 		})
 		if err != nil {
-			return fmt.Errorf("parsing message: %w", err)
+			return httpError(fmt.Errorf("parsing message: %w", err))
+		}
+		// servers only sign the accepts they give for their users
+		if strings.EqualFold(msg.Header.KeyID, server) && baseContentType(msg) != model.ContentTypeAccept {
+			return httpError(model.ErrorSenderMismatch)
+		}
+		if err := window.Check(&msg.Header, time.Now()); err != nil {
+			return httpError(err)
+		}
+
+		request := &ingestRequest{
+			message:       msg,
+			recipients:    recipients,
+			postService:   postService,
+			followService: followService,
+			directService: directService,
+		}
+		strategy, err := UnmarshalMessagePayload(request)
+		if err != nil {
+			return httpError(err)
+		}
+
+		request.recipients, err = seenMessages.Claim(msg.ID, recipients, window.Until(&msg.Header))
+		if err != nil {
+			return fmt.Errorf("claiming message: %w", err)
+		}
+		if len(request.recipients) == 0 {
+			return httpError(model.ErrorReplayedMessage)
+		}
+
+		err = strategy.Do()
+		if err != nil {
+			// let the sender's retry through
+			if releaseErr := seenMessages.Release(msg.ID, request.recipients); releaseErr != nil {
+				c.Logger().Errorf("releasing message %s: %+v", msg.ID, releaseErr)
+			}
+			return httpError(err)
 		}
 
-		return c.JSON(200, message)
+		return c.JSON(http.StatusAccepted, &model.IngestResponse{ID: msg.ID})
 	}
 }
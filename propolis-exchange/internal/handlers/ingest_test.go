@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/httpsig"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type fakeUserService struct {
+	keys    map[model.UserAddress]*ecdsa.PublicKey
+	handles map[string]bool
+	entries []*model.DirectoryEntry
+	lookups []model.UserAddress
+	keyErr  error
+}
+
+func (s *fakeUserService) Create(params *model.CreateUserParams) (*model.CreateUserResult, error) {
+	params.Normalise()
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if s.handles[params.Handle] {
+		return nil, model.ErrorHandleTaken
+	}
+	return &model.CreateUserResult{User: &model.User{Handle: params.Handle, Email: params.Email}}, nil
+}
+
+func (s *fakeUserService) Verify(params *model.VerifyUserParams) (*model.User, error) {
+	return nil, nil
+}
+
+func (s *fakeUserService) Unlock(address model.UserAddress) (*model.User, error) {
+	return nil, nil
+}
+
+func (s *fakeUserService) Delete(address model.UserAddress) (*model.User, error) {
+	return nil, nil
+}
+
+func (s *fakeUserService) ChangePassword(params *model.ChangePasswordParams) (*model.User, error) {
+	return nil, nil
+}
+
+func (s *fakeUserService) ResetPassword(params *model.ResetPasswordParams) (*model.ResetPasswordResult, error) {
+	return nil, nil
+}
+
+func (s *fakeUserService) Authenticate(params *model.LoginParams) (*model.User, crypto.Signer, error) {
+	return nil, nil, model.ErrorInvalidUsernameOrPassword
+}
+
+func (s *fakeUserService) PublicKeyFor(address model.UserAddress) (crypto.PublicKey, error) {
+	s.lookups = append(s.lookups, address)
+	if s.keyErr != nil {
+		return nil, s.keyErr
+	}
+	key, ok := s.keys[address]
+	if !ok {
+		return nil, model.ErrorUserNotFound
+	}
+	return key, nil
+}
+
+func (s *fakeUserService) LocalPublicKey(address model.UserAddress) (crypto.PublicKey, error) {
+	if !address.IsLocal("") {
+		return nil, model.ErrorUserNotFound
+	}
+	return s.PublicKeyFor(address)
+}
+
+func (s *fakeUserService) Lookup(address model.UserAddress) (*model.DirectoryEntry, error) {
+	name, _, err := address.Parse()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range s.entries {
+		if entry.Handle == string(name) || entry.UserID == name {
+			return entry, nil
+		}
+	}
+	return nil, model.ErrorUserNotFound
+}
+
+func (s *fakeUserService) List(after model.UserID, limit int) (*model.DirectoryPage, error) {
+	return nil, nil
+}
+
+type fakeInstanceService struct {
+	server string
+	key    *ecdsa.PrivateKey
+	err    error
+}
+
+func (s *fakeInstanceService) KeyID() string {
+	return "local.example.com"
+}
+
+func (s *fakeInstanceService) PublicKey() *ecdsa.PublicKey {
+	return nil
+}
+
+func (s *fakeInstanceService) PublicKeyFor(domain string) (*ecdsa.PublicKey, error) {
+	return &s.key.PublicKey, nil
+}
+
+func (s *fakeInstanceService) Verify(req *http.Request, body []byte) (string, error) {
+	return s.server, s.err
+}
+
+type fakePostService struct {
+	received map[model.UserAddress][]*model.Post
+}
+
+func (s *fakePostService) Receive(recipient model.UserAddress, msg *message.Message, post *model.Post) error {
+	if recipient == "nobody" {
+		return model.ErrorUserNotFound
+	}
+	s.received[recipient] = append(s.received[recipient], post)
+	return nil
+}
+
+func (s *fakePostService) View(author model.UserID, id model.PostID, viewer model.UserID) (*model.PostRecord, error) {
+	return nil, model.ErrorPostNotFound
+}
+
+func (s *fakePostService) Timeline(owner model.UserID, cursor *model.TimelineCursor, limit int) (*model.TimelinePage, error) {
+	return &model.TimelinePage{}, nil
+}
+
+type fakeFollowService struct {
+	requests  map[model.ContentType][]*model.FollowRequest
+	responses map[model.ContentType][]*model.FollowResponse
+}
+
+func (s *fakeFollowService) Follow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) (*model.Follow, error) {
+	return nil, nil
+}
+
+func (s *fakeFollowService) Unfollow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) error {
+	return nil
+}
+
+func (s *fakeFollowService) Approve(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) (*model.Follow, error) {
+	return nil, nil
+}
+
+func (s *fakeFollowService) Reject(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) error {
+	return nil
+}
+
+func (s *fakeFollowService) SetApproveFollowers(owner model.UserID, approve bool) (*model.User, error) {
+	return nil, nil
+}
+
+func (s *fakeFollowService) Followers(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error) {
+	return &model.FollowPage{}, nil
+}
+
+func (s *fakeFollowService) Following(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error) {
+	return &model.FollowPage{}, nil
+}
+
+func (s *fakeFollowService) ReceiveRequest(recipient model.UserAddress, msg *message.Message, contentType model.ContentType, request *model.FollowRequest) error {
+	s.requests[contentType] = append(s.requests[contentType], request)
+	return nil
+}
+
+func (s *fakeFollowService) ReceiveResponse(recipient model.UserAddress, msg *message.Message, contentType model.ContentType, response *model.FollowResponse) error {
+	s.responses[contentType] = append(s.responses[contentType], response)
+	return nil
+}
+
+type fakeDirectService struct {
+	received map[model.UserAddress][]*message.Envelope
+}
+
+func (s *fakeDirectService) Send(sender model.UserID, privateKey crypto.Signer, to []model.UserAddress, direct *model.DirectMessage, expiresAt *time.Time) (*model.DirectMessageRecord, error) {
+	return nil, nil
+}
+
+func (s *fakeDirectService) Receive(recipient model.UserAddress, msg *message.Message, envelope *message.Envelope) error {
+	if !envelope.Addressed(message.Address(recipient)) {
+		return model.ErrorNotInAudience
+	}
+	s.received[recipient] = append(s.received[recipient], envelope)
+	return nil
+}
+
+func (s *fakeDirectService) Inbox(owner model.UserID, privateKey crypto.Signer, cursor *model.TimelineCursor, limit int) (*model.DirectMessagePage, error) {
+	return &model.DirectMessagePage{}, nil
+}
+
+type fakeSeenMessages map[string]map[model.UserAddress]bool
+
+func (s fakeSeenMessages) Claim(messageID string, recipients []model.UserAddress, expiresAt time.Time) ([]model.UserAddress, error) {
+	if s[messageID] == nil {
+		s[messageID] = map[model.UserAddress]bool{}
+	}
+	claimed := []model.UserAddress{}
+	for _, recipient := range recipients {
+		if !s[messageID][recipient] {
+			s[messageID][recipient] = true
+			claimed = append(claimed, recipient)
+		}
+	}
+	return claimed, nil
+}
+
+func (s fakeSeenMessages) Release(messageID string, recipients []model.UserAddress) error {
+	for _, recipient := range recipients {
+		delete(s[messageID], recipient)
+	}
+	return nil
+}
+
+func TestIngest(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	senderID := model.UserAddress(user.IDFromPublicKey(&privateKey.PublicKey))
+	sender := senderID + "@other.example.com"
+	remoteSender := senderID + "@remote.example.com"
+
+	userService := &fakeUserService{keys: map[model.UserAddress]*ecdsa.PublicKey{
+		senderID:     &privateKey.PublicKey,
+		sender:       &privateKey.PublicKey,
+		remoteSender: &privateKey.PublicKey,
+	}}
+	postService := &fakePostService{received: map[model.UserAddress][]*model.Post{}}
+	followService := &fakeFollowService{
+		requests:  map[model.ContentType][]*model.FollowRequest{},
+		responses: map[model.ContentType][]*model.FollowResponse{},
+	}
+	directService := &fakeDirectService{received: map[model.UserAddress][]*message.Envelope{}}
+	instanceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	instanceService := &fakeInstanceService{server: "other.example.com", key: instanceKey}
+
+	seenMessages := fakeSeenMessages{}
+	window := message.Window{MaxAge: time.Hour, MaxSkew: time.Minute}
+
+	// posts are numbered, as the same post signed twice in a millisecond is
+	// the same message
+	posts := 0
+	newPost := func() *model.Post {
+		posts++
+		return &model.Post{Content: fmt.Sprintf("hello %d", posts)}
+	}
+
+	server := echo.New()
+	handler := Ingest(userService, postService, followService, directService, instanceService, seenMessages, window)
+
+	ingest := func(body string, recipient string) (int, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+		if recipient != "" {
+			req.Header.Set(model.HeaderRecipient, recipient)
+		}
+		rec := httptest.NewRecorder()
+		err := handler(server.NewContext(req, rec))
+		if err != nil {
+			server.HTTPErrorHandler(err, server.NewContext(req, rec))
+		}
+		return rec.Code, rec
+	}
+
+	t.Run("Post", func(t *testing.T) {
+		m, id, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, rec := ingest(m, "recipient1, recipient2")
+		assert.Equal(http.StatusAccepted, code)
+
+		res := &model.IngestResponse{}
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), res))
+		assert.Equal(id, res.ID)
+		assert.Len(postService.received["recipient1"], 1)
+		assert.Len(postService.received["recipient2"], 1)
+	})
+
+	t.Run("Unknown Recipient", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient3,nobody")
+		assert.Equal(http.StatusAccepted, code)
+		assert.Len(postService.received["recipient3"], 1)
+
+		m, _, err = message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+		code, _ = ingest(m, "nobody")
+		assert.Equal(http.StatusNotFound, code)
+	})
+
+	t.Run("Empty Post", func(t *testing.T) {
+		m, _, err := message.New(&model.Post{}, message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+	})
+
+	t.Run("Follow", func(t *testing.T) {
+		for _, contentType := range []model.ContentType{model.ContentTypeFollow, model.ContentTypeUnfollow} {
+			m, _, err := message.New(&model.FollowRequest{Target: "recipient1"}, message.Address(sender), string(contentType), privateKey)
+			assert.Nil(err)
+
+			code, _ := ingest(m, "recipient1")
+			assert.Equal(http.StatusAccepted, code)
+			assert.Len(followService.requests[contentType], 1)
+		}
+
+		m, _, err := message.New(&model.FollowRequest{}, message.Address(sender), string(model.ContentTypeFollow), privateKey)
+		assert.Nil(err)
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+	})
+
+	t.Run("Follow Response", func(t *testing.T) {
+		for _, contentType := range []model.ContentType{model.ContentTypeAccept, model.ContentTypeReject} {
+			response := &model.FollowResponse{Follower: "recipient1", Request: "request"}
+			m, _, err := message.New(response, message.Address(sender), string(contentType), privateKey)
+			assert.Nil(err)
+
+			code, _ := ingest(m, "recipient1")
+			assert.Equal(http.StatusAccepted, code)
+			assert.Equal([]*model.FollowResponse{response}, followService.responses[contentType])
+		}
+
+		m, _, err := message.New(&model.FollowResponse{Follower: "recipient1"}, message.Address(sender), string(model.ContentTypeAccept), privateKey)
+		assert.Nil(err)
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+	})
+
+	t.Run("Accept From Server", func(t *testing.T) {
+		response := &model.FollowResponse{Follower: "recipient2", Followee: "someone@other.example.com", Request: "request"}
+		m, _, err := message.New(response, "other.example.com", string(model.ContentTypeAccept), instanceKey)
+		assert.Nil(err)
+		code, _ := ingest(m, "recipient2")
+		assert.Equal(http.StatusAccepted, code)
+		assert.Contains(followService.responses[model.ContentTypeAccept], response)
+
+		m, _, err = message.New(newPost(), "other.example.com", string(model.ContentTypePost), instanceKey)
+		assert.Nil(err)
+		code, _ = ingest(m, "recipient2")
+		assert.Equal(http.StatusForbidden, code)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		recipientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(err)
+		m, _, err := message.NewEncrypted(&model.DirectMessage{Content: "hello"}, message.Address(sender), string(model.ContentTypeDirect), privateKey, "recipient1", &recipientKey.PublicKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient1,recipient2")
+		assert.Equal(http.StatusAccepted, code)
+		assert.Len(directService.received["recipient1"], 1)
+		assert.Empty(directService.received["recipient2"])
+
+		m, _, err = message.NewEncrypted(&model.DirectMessage{Content: "hello"}, message.Address(sender), string(model.ContentTypeDirect), privateKey, "recipient1", &recipientKey.PublicKey)
+		assert.Nil(err)
+		code, _ = ingest(m, "recipient2")
+		assert.Equal(http.StatusForbidden, code)
+
+		m, _, err = message.New(&message.Envelope{Recipient: "recipient1"}, message.Address(sender), string(model.ContentTypeEncrypted), privateKey)
+		assert.Nil(err)
+		code, _ = ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+	})
+
+	t.Run("Unknown Content Type", func(t *testing.T) {
+		m, _, err := message.New(map[string]string{"data": "hello"}, message.Address(sender), "x-propolis-unknown", privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusUnsupportedMediaType, code)
+	})
+
+	t.Run("Unsigned Request", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		instanceService.err = httpsig.ErrorMissingSignature
+		defer func() { instanceService.err = nil }()
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusUnauthorized, code)
+	})
+
+	t.Run("Sender Key Mismatch", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		// the sender's server served a key that isn't theirs
+		userService.keyErr = model.ErrorPublicKeyMismatch
+		defer func() { userService.keyErr = nil }()
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusUnprocessableEntity, code)
+	})
+
+	t.Run("Server Key Unavailable", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		instanceService.err = fmt.Errorf("%w: server responded 502", model.ErrorKeyUnavailable)
+		defer func() { instanceService.err = nil }()
+
+		// so that the sender tries again rather than giving up
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusServiceUnavailable, code)
+	})
+
+	t.Run("Sender From Another Server", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(remoteSender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		// the sender's key isn't looked up for a server it doesn't belong to
+		userService.lookups = nil
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusForbidden, code)
+		assert.Empty(userService.lookups)
+
+		instanceService.server = "remote.example.com"
+		defer func() { instanceService.server = "other.example.com" }()
+
+		code, _ = ingest(m, "recipient1")
+		assert.Equal(http.StatusAccepted, code)
+	})
+
+	t.Run("Sender Without Domain", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(senderID), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		userService.lookups = nil
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusForbidden, code)
+		assert.Empty(userService.lookups)
+
+		// only this server delivers for its own users
+		instanceService.server = "local.example.com"
+		defer func() { instanceService.server = "other.example.com" }()
+
+		code, _ = ingest(m, "recipient1")
+		assert.Equal(http.StatusAccepted, code)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient4")
+		assert.Equal(http.StatusAccepted, code)
+		code, rec := ingest(m, "recipient4")
+		assert.Equal(http.StatusConflict, code)
+		res := &model.IngestErrorResponse{}
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), res))
+		assert.Equal(model.IngestErrorCodeReplayed, res.Code)
+		assert.Len(postService.received["recipient4"], 1)
+
+		// a delivery split across requests, or repeating only some of its
+		// recipients, still reaches the rest
+		code, _ = ingest(m, "recipient4,recipient5")
+		assert.Equal(http.StatusAccepted, code)
+		assert.Len(postService.received["recipient4"], 1)
+		assert.Len(postService.received["recipient5"], 1)
+	})
+
+	t.Run("Retry After Failure", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "nobody")
+		assert.Equal(http.StatusNotFound, code)
+		code, _ = ingest(m, "nobody")
+		assert.Equal(http.StatusNotFound, code)
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		m, id, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		handler = Ingest(userService, postService, followService, directService, instanceService, seenMessages, message.Window{MaxAge: time.Millisecond, MaxSkew: time.Minute})
+		defer func() {
+			handler = Ingest(userService, postService, followService, directService, instanceService, seenMessages, window)
+		}()
+		time.Sleep(5 * time.Millisecond)
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+		assert.Empty(seenMessages[id])
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		m, id, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey, message.WithExpiry(time.Now().Add(-time.Second)))
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusBadRequest, code)
+		assert.Empty(seenMessages[id])
+	})
+
+	t.Run("Not Yet Valid", func(t *testing.T) {
+		m, id, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey, message.WithNotBefore(time.Now().Add(time.Hour)))
+		assert.Nil(err)
+
+		code, _ := ingest(m, "recipient1")
+		assert.Equal(http.StatusTooEarly, code)
+		assert.Empty(seenMessages[id])
+	})
+
+	t.Run("Missing Recipient", func(t *testing.T) {
+		m, _, err := message.New(newPost(), message.Address(sender), string(model.ContentTypePost), privateKey)
+		assert.Nil(err)
+
+		code, _ := ingest(m, "")
+		assert.Equal(http.StatusBadRequest, code)
+	})
+}
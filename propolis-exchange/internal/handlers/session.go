@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"crypto"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+const (
+	contextKeySession    = "session"
+	contextKeySigningKey = "signingKey"
+)
+
+type SessionService interface {
+	Open(userID model.UserID, privateKey crypto.Signer) (*model.Session, error)
+	Lookup(token string) (*model.Session, crypto.Signer, error)
+	End(token string) error
+	EndForUser(userID model.UserID) error
+}
+
+type loginResponse struct {
+	Session *model.Session `json:"session"`
+	User    *model.User    `json:"user"`
+}
+
+func Login(userService UserService, sessionService SessionService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := &model.LoginParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+
+		user, privateKey, err := userService.Authenticate(params)
+		if err != nil {
+			return httpError(err)
+		}
+
+		session, err := sessionService.Open(user.ID, privateKey)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, &loginResponse{session, user})
+	}
+}
+
+func Logout(sessionService SessionService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get(contextKeySession).(*model.Session)
+		if err := sessionService.End(session.Token); err != nil {
+			return httpError(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RequireSession rejects requests without a live session token and makes the
+// session and the user's signing key available to the handler.
+func RequireSession(sessionService SessionService) echo.MiddlewareFunc {
+	return session(sessionService, true)
+}
+
+// OptionalSession is RequireSession for endpoints that can also be used
+// without logging in. A token that is given must still be live.
+func OptionalSession(sessionService SessionService) echo.MiddlewareFunc {
+	return session(sessionService, false)
+}
+
+func session(sessionService SessionService, required bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if header == "" && !required {
+				return next(c)
+			}
+			token, found := strings.CutPrefix(header, "Bearer ")
+			if !found || token == "" {
+				return httpError(model.ErrorSessionNotFound)
+			}
+
+			session, privateKey, err := sessionService.Lookup(token)
+			if err != nil {
+				return httpError(err)
+			}
+
+			c.Set(contextKeySession, session)
+			c.Set(contextKeySigningKey, privateKey)
+			return next(c)
+		}
+	}
+}
+
+// requireOwner checks that the user in the path is the one who is logged in.
+func requireOwner(c echo.Context) (model.UserID, error) {
+	session := c.Get(contextKeySession).(*model.Session)
+	owner := model.UserID(c.Param("userAddress"))
+	if session.UserID != owner {
+		return "", echo.NewHTTPError(http.StatusForbidden, "not your account")
+	}
+	return owner, nil
+}
+
+func signingKey(c echo.Context) crypto.Signer {
+	return c.Get(contextKeySigningKey).(crypto.Signer)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func GetTimeline(postService PostService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+
+		cursor, limit, err := pageParams(c)
+		if err != nil {
+			return err
+		}
+
+		page, err := postService.Timeline(owner, cursor, limit)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+}
+
+// GetPost returns a post by a local user to anyone in its audience. Without a
+// session only public and unlisted posts can be seen.
+func GetPost(postService PostService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var viewer model.UserID
+		if session, ok := c.Get(contextKeySession).(*model.Session); ok {
+			viewer = session.UserID
+		}
+
+		post, err := postService.View(model.UserID(c.Param("userAddress")), model.PostID(c.Param("postID")), viewer)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, post)
+	}
+}
+
+// pageParams reads the cursor and limit for listings paged like timelines.
+func pageParams(c echo.Context) (*model.TimelineCursor, int, error) {
+	var cursor *model.TimelineCursor
+	if param := c.QueryParam("cursor"); param != "" {
+		var err error
+		cursor, err = model.ParseTimelineCursor(param)
+		if err != nil {
+			return nil, 0, httpError(err)
+		}
+	}
+
+	limit := 0
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil {
+			return nil, 0, echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+	return cursor, limit, nil
+}
@@ -1,6 +1,11 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
 	"github.com/labstack/echo/v4"
 	"uk.co.dudmesh.propolis/internal/model"
 	"uk.co.dudmesh.propolis/pkg/crypt"
@@ -12,20 +17,138 @@ func CreateUser(userService UserService) echo.HandlerFunc {
 		if err := c.Bind(params); err != nil {
 			return err
 		}
-		user, err := userService.Create(params)
+		result, err := userService.Create(params)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusCreated, result)
+	}
+}
+
+func VerifyUser(userService UserService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := &model.VerifyUserParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+		user, err := userService.Verify(params)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+func DeleteUser(userService UserService, sessionService SessionService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		user, err := userService.Delete(model.UserAddress(owner))
+		if err != nil {
+			return httpError(err)
+		}
+		if err := sessionService.EndForUser(owner); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// ChangePassword ends every session for the user, including the one used to
+// make the change.
+func ChangePassword(userService UserService, sessionService SessionService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owner, err := requireOwner(c)
+		if err != nil {
+			return err
+		}
+		params := &model.ChangePasswordParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+		params.Address = model.UserAddress(owner)
+
+		user, err := userService.ChangePassword(params)
 		if err != nil {
+			return httpError(err)
+		}
+		if err := sessionService.EndForUser(owner); err != nil {
 			return err
 		}
-		return c.JSON(200, user)
+		return c.JSON(http.StatusOK, user)
 	}
 }
 
+func ResetPassword(userService UserService, sessionService SessionService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params := &model.ResetPasswordParams{}
+		if err := c.Bind(params); err != nil {
+			return err
+		}
+
+		result, err := userService.ResetPassword(params)
+		if err != nil {
+			return httpError(err)
+		}
+		if err := sessionService.EndForUser(result.User.ID); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+func UnlockUser(userService UserService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := userService.Unlock(model.UserAddress(c.Param("userAddress")))
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+func ListUsers(userService UserService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit := 0
+		if param := c.QueryParam("limit"); param != "" {
+			var err error
+			limit, err = strconv.Atoi(param)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+			}
+		}
+
+		page, err := userService.List(model.UserID(c.QueryParam("after")), limit)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+}
+
+// RequireAdmin guards admin endpoints with the configured admin token. They
+// are disabled altogether when no token is configured.
+func RequireAdmin(adminToken string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, found := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if adminToken == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+			return next(c)
+		}
+	}
+}
+
+// GetPublicKey serves the keys of local users only.
 func GetPublicKey(userService UserService) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		address := model.UserAddress(c.Param("userAddress"))
-		publicKey, err := userService.PublicKeyFor(address)
+		publicKey, err := userService.LocalPublicKey(address)
 		if err != nil {
-			return err
+			return httpError(err)
 		}
 		keyEncoded, err := crypt.EncodePublicKey(publicKey, string(address))
 		if err != nil {
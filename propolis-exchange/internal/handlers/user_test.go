@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func TestCreateUser(t *testing.T) {
+	assert := assert.New(t)
+
+	userService := &fakeUserService{handles: map[string]bool{"taken": true}}
+	server := echo.New()
+	handler := CreateUser(userService)
+
+	create := func(body string) (int, map[string]any) {
+		req := httptest.NewRequest(http.MethodPost, "/local/user", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		err := handler(server.NewContext(req, rec))
+		if err != nil {
+			server.HTTPErrorHandler(err, server.NewContext(req, rec))
+		}
+		res := map[string]any{}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+
+	t.Run("Created", func(t *testing.T) {
+		code, res := create(`{"handle": " New_User ", "email": "New@Example.com", "password": "password"}`)
+		assert.Equal(http.StatusCreated, code)
+		assert.Equal("new_user", res["user"].(map[string]any)["handle"])
+		assert.Equal("new@example.com", res["user"].(map[string]any)["email"])
+		assert.NotContains(res, "verificationToken")
+	})
+
+	t.Run("Taken", func(t *testing.T) {
+		code, res := create(`{"handle": "Taken", "email": "taken@example.com", "password": "password"}`)
+		assert.Equal(http.StatusConflict, code)
+		assert.Equal("handle", res["field"])
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		long := `{"handle": "` + strings.Repeat("a", model.MaxHandleLength+1) + `", "email": "long@example.com"}`
+		for body, field := range map[string]string{
+			long: "handle",
+			`{"handle": "ab", "email": "ab@example.com"}`:          "handle",
+			`{"handle": "1abc", "email": "abc@example.com"}`:       "handle",
+			`{"handle": "a-b-c", "email": "abc@example.com"}`:      "handle",
+			`{"handle": "admin", "email": "admin@example.com"}`:    "handle",
+			`{"handle": "abç", "email": "abc@example.com"}`:        "handle",
+			`{"handle": "valid", "email": "not an email"}`:         "email",
+			`{"handle": "valid", "email": "Name <a@example.com>"}`: "email",
+			`{"handle": "valid", "email": "a@localhost"}`:          "email",
+		} {
+			code, res := create(body)
+			assert.Equal(http.StatusUnprocessableEntity, code, body)
+			assert.Equal(field, res["field"], body)
+			assert.NotEmpty(res["message"], body)
+		}
+	})
+}
+
+func TestGetPublicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	userService := &fakeUserService{keys: map[model.UserAddress]*ecdsa.PublicKey{
+		"alice":              &privateKey.PublicKey,
+		"bob@remote.example": &privateKey.PublicKey,
+	}}
+	server := echo.New()
+	handler := GetPublicKey(userService)
+
+	get := func(address string) int {
+		req := httptest.NewRequest(http.MethodGet, "/user/"+address+"/publickey", nil)
+		rec := httptest.NewRecorder()
+		c := server.NewContext(req, rec)
+		c.SetParamNames("userAddress")
+		c.SetParamValues(address)
+		if err := handler(c); err != nil {
+			server.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+
+	t.Run("Local", func(t *testing.T) {
+		assert.Equal(http.StatusOK, get("alice"))
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		// never fetched or proxied, even when the key is known
+		assert.Equal(http.StatusNotFound, get("bob@remote.example"))
+	})
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ContentTypeEncrypted is the content type encrypted messages travel as.
+	// What they hold is only known once the recipient has opened them.
+	ContentTypeEncrypted ContentType = "x-propolis-encrypted"
+	ContentTypeDirect    ContentType = "x-propolis-direct"
+)
+
+// DirectMessage is the payload of a direct message, which is encrypted to its
+// recipient so that only they can read it.
+type DirectMessage struct {
+	Content string `json:"content"`
+}
+
+// DirectMessageRecord is a direct message as opened for its recipient. To is
+// everyone the message was sent to, the recipient included.
+type DirectMessageRecord struct {
+	ID            string        `json:"id"`
+	SentAt        time.Time     `json:"sentAt"`
+	SenderAddress UserAddress   `json:"sender"`
+	To            []UserAddress `json:"to"`
+	ExpiresAt     *time.Time    `json:"expiresAt,omitempty"`
+	DirectMessage
+}
+
+type DirectMessagePage struct {
+	Messages []*DirectMessageRecord `json:"messages"`
+	Next     string                 `json:"next,omitempty"`
+}
+
+// SendDirectParams is a direct message to send. A message with ExpiresAt
+// can't be read after that time and is deleted by the recipient's server.
+type SendDirectParams struct {
+	To        []UserAddress `json:"to"`
+	ExpiresAt *time.Time    `json:"expiresAt,omitempty"`
+	DirectMessage
+}
+
+func (m *DirectMessage) Validate() error {
+	if m.Content == "" {
+		return fmt.Errorf("%w: direct message has no content", ErrorInvalidPayload)
+	}
+	return nil
+}
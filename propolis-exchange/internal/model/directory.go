@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// DirectoryEntry is the global record of a local user, kept alongside their
+// own store so they can be found by handle or email without opening it.
+// Location is the path of the user's store relative to the data directory.
+type DirectoryEntry struct {
+	UserID    UserID     `db:"user_id" json:"userId"`
+	Handle    string     `db:"handle" json:"handle"`
+	Email     string     `db:"email" json:"email"`
+	Status    UserStatus `db:"status" json:"status"`
+	Location  string     `db:"location" json:"location"`
+	CreatedAt time.Time  `db:"created_at" json:"createdAt"`
+	UpdatedAt *time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+type DirectoryPage struct {
+	Users []*DirectoryEntry `json:"users"`
+	Next  UserID            `json:"next,omitempty"`
+}
@@ -0,0 +1,67 @@
+package model
+
+const (
+	// RelPublicKey links to where a user's public key is served.
+	RelPublicKey = "https://dudmesh.co.uk/propolis/rel/publickey"
+	// RelIngest links to where messages for a user are delivered.
+	RelIngest = "https://dudmesh.co.uk/propolis/rel/ingest"
+	// InstanceKeyPath is where a server publishes the key it signs requests
+	// to other servers with.
+	InstanceKeyPath = "/.well-known/propolis-instance-key"
+
+	// RelNodeInfo links to a NodeInfo 2.1 document.
+	RelNodeInfo = "http://nodeinfo.diaspora.software/ns/schema/2.1"
+
+	ContentTypeJRD      ContentType = "application/jrd+json"
+	ContentTypeNodeInfo ContentType = `application/json; profile="http://nodeinfo.diaspora.software/ns/schema/2.1#"`
+)
+
+// WebFinger is the JSON Resource Descriptor for a user, as defined by RFC
+// 7033. The subject is their handle address and their ID address is an alias.
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type NodeInfoLinks struct {
+	Links []WebFingerLink `json:"links"`
+}
+
+// NodeInfo describes the server to others. Propolis specifics, the message
+// format version and the content types that can be ingested, are given in
+// the metadata.
+type NodeInfo struct {
+	Version           string           `json:"version"`
+	Software          NodeInfoSoftware `json:"software"`
+	Protocols         []string         `json:"protocols"`
+	Services          NodeInfoServices `json:"services"`
+	OpenRegistrations bool             `json:"openRegistrations"`
+	Usage             NodeInfoUsage    `json:"usage"`
+	Metadata          NodeInfoMetadata `json:"metadata"`
+}
+
+type NodeInfoSoftware struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type NodeInfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type NodeInfoUsage struct {
+	Users struct{} `json:"users"`
+}
+
+type NodeInfoMetadata struct {
+	ProtocolVersion string        `json:"protocolVersion"`
+	ContentTypes    []ContentType `json:"contentTypes"`
+}
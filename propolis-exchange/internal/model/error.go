@@ -1,7 +1,61 @@
 package model
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrorInvalidUsernameOrPassword = errors.New("invalid username or password")
+var ErrorSessionNotFound = errors.New("session not found or expired")
 var ErrorUserNotFound = errors.New("user not found")
+var ErrorUserNotActive = errors.New("user is not active")
+var ErrorUserPending = fmt.Errorf("%w: account has not been verified", ErrorUserNotActive)
+var ErrorUserLocked = fmt.Errorf("%w: account is locked", ErrorUserNotActive)
+var ErrorUserDeleted = fmt.Errorf("%w: account has been deleted", ErrorUserNotActive)
+var ErrorInvalidStatusTransition = errors.New("invalid user status transition")
+var ErrorInvalidRecoveryKey = errors.New("invalid recovery key")
+var ErrorCredentialsChanged = errors.New("credentials changed concurrently")
+var ErrorInvalidVerificationToken = errors.New("invalid verification token")
+var ErrorInvalidAddress = errors.New("invalid address")
+var ErrorPublicKeyMismatch = errors.New("public key does not match address")
+var ErrorKeyUnavailable = errors.New("key could not be fetched")
 var ErrorSenderMismatch = errors.New("sender mismatch")
+var ErrorPostNotFound = errors.New("post not found")
+var ErrorPostDeleted = errors.New("post deleted")
+var ErrorPostSuperseded = errors.New("post has already been replaced")
+var ErrorNotInAudience = errors.New("recipient is not in the post's audience")
+var ErrorEncryptionUnsupported = errors.New("recipient's key cannot be encrypted to")
+var ErrorFollowNotFound = errors.New("follow not found")
+var ErrorOutboxEntryNotFound = errors.New("outbox entry not found")
+var ErrorInvalidCursor = errors.New("invalid cursor")
+var ErrorInvalidPayload = errors.New("invalid payload")
+var ErrorReplayedMessage = errors.New("message has already been received")
+var ErrorMissingRecipient = errors.New("missing recipient")
+var ErrorInvalidField = errors.New("invalid field")
+var ErrorAlreadyTaken = errors.New("already taken")
+var ErrorHandleTaken = &FieldError{"handle", "is already taken", ErrorAlreadyTaken}
+var ErrorEmailTaken = &FieldError{"email", "is already registered", ErrorAlreadyTaken}
+
+type UnsupportedContentTypeError struct {
+	ContentType string
+}
+
+func (e *UnsupportedContentTypeError) Error() string {
+	return fmt.Sprintf("unsupported content type: %s", e.ContentType)
+}
+
+// FieldError reports a problem with one field of a request. Err classifies
+// it, as ErrorInvalidField or ErrorAlreadyTaken.
+type FieldError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ContentTypeFollow   ContentType = "x-propolis-follow"
+	ContentTypeUnfollow ContentType = "x-propolis-unfollow"
+	ContentTypeAccept   ContentType = "x-propolis-accept"
+	ContentTypeReject   ContentType = "x-propolis-reject"
+)
+
+type FollowStatus int
+
+const (
+	FollowStatusPending FollowStatus = iota
+	FollowStatusAccepted
+)
+
+// FollowRequest is the payload of follow and unfollow messages. Target is the
+// user being followed, so the message can't be replayed to anyone else.
+type FollowRequest struct {
+	Target UserAddress `json:"target"`
+}
+
+// FollowResponse is the payload of accept and reject messages. Request is the
+// ID of the follow message being answered. Followee is only set on accepts
+// that a server signs for one of its users, when it accepts followers for
+// them automatically.
+type FollowResponse struct {
+	Follower UserAddress `json:"follower"`
+	Followee UserAddress `json:"followee,omitempty"`
+	Request  string      `json:"request"`
+}
+
+// Follow is one edge of the social graph as held in a user store, either a
+// follower of the user or someone they follow. Address is the other user.
+type Follow struct {
+	Address   UserAddress  `db:"Address" json:"address"`
+	Status    FollowStatus `db:"Status" json:"status"`
+	RequestID string       `db:"RequestID" json:"requestId"`
+	Responded bool         `db:"Responded" json:"-"`
+	CreatedAt time.Time    `db:"CreatedAt" json:"createdAt"`
+	UpdatedAt *time.Time   `db:"UpdatedAt" json:"updatedAt"`
+}
+
+type FollowPage struct {
+	Follows []*Follow   `json:"follows"`
+	Next    UserAddress `json:"next,omitempty"`
+}
+
+type FollowParams struct {
+	Address UserAddress `json:"address"`
+}
+
+type ApproveFollowersParams struct {
+	ApproveFollowers bool `json:"approveFollowers"`
+}
+
+func (r *FollowRequest) Validate() error {
+	if _, _, err := r.Target.Parse(); err != nil {
+		return fmt.Errorf("%w: invalid target", ErrorInvalidPayload)
+	}
+	return nil
+}
+
+func (r *FollowResponse) Validate() error {
+	if _, _, err := r.Follower.Parse(); err != nil {
+		return fmt.Errorf("%w: invalid follower", ErrorInvalidPayload)
+	}
+	if r.Request == "" {
+		return fmt.Errorf("%w: response has no request", ErrorInvalidPayload)
+	}
+	if r.Followee != "" {
+		if _, domain, err := r.Followee.Parse(); err != nil || domain == "" {
+			return fmt.Errorf("%w: invalid followee", ErrorInvalidPayload)
+		}
+	}
+	return nil
+}
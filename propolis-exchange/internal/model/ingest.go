@@ -0,0 +1,21 @@
+package model
+
+// HeaderRecipient carries the comma separated addresses of the local users an
+// ingested message is being delivered to.
+const HeaderRecipient = "X-Propolis-Recipient"
+
+type IngestResponse struct {
+	ID string `json:"id"`
+}
+
+// IngestErrorCodeReplayed marks a rejected delivery as a replay, meaning its
+// recipients already have the message.
+const IngestErrorCodeReplayed = "replayed"
+
+// IngestErrorResponse is the body of a rejected delivery. Code is set when the
+// sending server needs to tell the rejection apart from others with the same
+// status.
+type IngestErrorResponse struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
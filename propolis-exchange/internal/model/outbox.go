@@ -0,0 +1,71 @@
+package model
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OutboxEntry is a signed message waiting to be delivered to the recipients
+// on one server, who are sent it in a single request. Payload holds the
+// signed header and payload segments and Signature the signature segment, so
+// the message on the wire is Payload + "." + Signature.
+type OutboxEntry struct {
+	ID            string      `db:"ID" json:"id"`
+	CreatedAt     time.Time   `db:"CreatedAt" json:"createdAt"`
+	Status        PostStatus  `db:"Status" json:"status"`
+	SenderAddress UserAddress `db:"SenderAddress" json:"sender"`
+	Recipients    Recipients  `db:"Recipients" json:"recipients"`
+	Hash          string      `db:"Hash" json:"hash"`
+	ContentType   string      `db:"ContentType" json:"contentType"`
+	Payload       string      `db:"Payload" json:"-"`
+	Signature     string      `db:"Signature" json:"-"`
+	Attempts      int         `db:"Attempts" json:"attempts"`
+	NextAttemptAt time.Time   `db:"NextAttemptAt" json:"nextAttemptAt"`
+	LastError     string      `db:"LastError" json:"lastError"`
+}
+
+func (e *OutboxEntry) Message() string {
+	return e.Payload + "." + e.Signature
+}
+
+// Recipients is a list of addresses held comma separated, the same way they
+// are sent in the recipient header.
+type Recipients []UserAddress
+
+func (r Recipients) String() string {
+	addresses := make([]string, 0, len(r))
+	for _, address := range r {
+		addresses = append(addresses, string(address))
+	}
+	return strings.Join(addresses, ",")
+}
+
+func (r Recipients) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+func (r *Recipients) Scan(src interface{}) error {
+	var data string
+	switch v := src.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	case nil:
+		*r = nil
+		return nil
+	default:
+		return fmt.Errorf("unexpected type for recipients: %T", src)
+	}
+
+	*r = nil
+	for _, address := range strings.Split(data, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			*r = append(*r, UserAddress(address))
+		}
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package model
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"uk.co.dudmesh.propolis/pkg/message"
 )
 
@@ -20,6 +25,20 @@ const (
 	PostStatusFailed
 	PostStatusFailedPermanent
 	PostStatusDeleted
+	PostStatusReceived
+)
+
+// Visibility is who a post is for. Public and unlisted posts can be read by
+// anyone, but unlisted ones are left out of public listings. Followers posts
+// are only for the author's accepted followers and direct posts only for the
+// recipients listed in the post.
+type Visibility string
+
+const (
+	VisibilityPublic    Visibility = "public"
+	VisibilityUnlisted  Visibility = "unlisted"
+	VisibilityFollowers Visibility = "followers"
+	VisibilityDirect    Visibility = "direct"
 )
 
 type ActionVerb string
@@ -38,12 +57,28 @@ type Action struct {
 }
 
 type Post struct {
-	Content     string       `json:"content"`
-	Attachments []Attachment `json:"attachments"`
-	InReplyTo   PostID       `json:"inReplyTo,omitempty"`
-	Replaces    PostID       `json:"replaces,omitempty"`
-	ReplacedBy  PostID       `json:"replacedBy,omitempty"`
-	RepostOf    PostID       `json:"repostOf,omitempty"`
+	Action      ActionVerb  `db:"-" json:"action,omitempty"`
+	Content     string      `db:"Content" json:"content"`
+	Attachments Attachments `db:"Attachments" json:"attachments"`
+	InReplyTo   PostID      `db:"InReplyTo" json:"inReplyTo,omitempty"`
+	Replaces    PostID      `db:"Replaces" json:"replaces,omitempty"`
+	ReplacedBy  PostID      `db:"ReplacedBy" json:"replacedBy,omitempty"`
+	RepostOf    PostID      `db:"RepostOf" json:"repostOf,omitempty"`
+	Visibility  Visibility  `db:"Visibility" json:"visibility"`
+	To          Recipients  `db:"Recipients" json:"to,omitempty"`
+}
+
+// PostRecord is a post as held in a user store, either authored locally or
+// received via ingest. Message is the signed message the post arrived in, and
+// ExpiresAt is taken from its header.
+type PostRecord struct {
+	ID            PostID      `db:"ID" json:"id"`
+	CreatedAt     time.Time   `db:"CreatedAt" json:"createdAt"`
+	Status        PostStatus  `db:"Status" json:"status"`
+	AuthorAddress UserAddress `db:"AuthorAddress" json:"author"`
+	ExpiresAt     *time.Time  `db:"ExpiresAt" json:"expiresAt,omitempty"`
+	Message       string      `db:"Message" json:"-"`
+	Post
 }
 
 type Attachment struct {
@@ -51,3 +86,91 @@ type Attachment struct {
 	Signature   string
 	ContentType string
 }
+
+type Attachments []Attachment
+
+func (a Attachments) Value() (driver.Value, error) {
+	if a == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling attachments: %w", err)
+	}
+	return string(data), nil
+}
+
+func (a *Attachments) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+		*a = nil
+		return nil
+	default:
+		return fmt.Errorf("unexpected type for attachments: %T", src)
+	}
+	return json.Unmarshal(data, a)
+}
+
+func (p *Post) Verb() ActionVerb {
+	if p.Replaces == "" {
+		return ActionVerbCreate
+	}
+	if p.Action == ActionVerbDelete {
+		return ActionVerbDelete
+	}
+	return ActionVerbUpdate
+}
+
+// Normalise makes posts from before visibility existed public.
+func (p *Post) Normalise() {
+	if p.Visibility == "" {
+		p.Visibility = VisibilityPublic
+	}
+}
+
+func (p *Post) Validate() error {
+	switch p.Visibility {
+	case "", VisibilityPublic, VisibilityUnlisted, VisibilityFollowers:
+		if len(p.To) > 0 {
+			return fmt.Errorf("%w: only direct posts have recipients", ErrorInvalidPayload)
+		}
+	case VisibilityDirect:
+		if len(p.To) == 0 {
+			return fmt.Errorf("%w: direct post has no recipients", ErrorInvalidPayload)
+		}
+		for _, recipient := range p.To {
+			if _, _, err := recipient.Parse(); err != nil {
+				return fmt.Errorf("%w: invalid recipient %q", ErrorInvalidPayload, recipient)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown visibility %q", ErrorInvalidPayload, p.Visibility)
+	}
+
+	if p.Action == ActionVerbDelete {
+		if p.Replaces == "" {
+			return fmt.Errorf("%w: delete has no target post", ErrorInvalidPayload)
+		}
+		if p.Content != "" || len(p.Attachments) > 0 {
+			return fmt.Errorf("%w: delete has content", ErrorInvalidPayload)
+		}
+		return nil
+	}
+	if p.Action == ActionVerbUpdate && p.Replaces == "" {
+		return fmt.Errorf("%w: update has no target post", ErrorInvalidPayload)
+	}
+	if p.Content == "" && len(p.Attachments) == 0 && p.RepostOf == "" {
+		return fmt.Errorf("%w: post has no content", ErrorInvalidPayload)
+	}
+	for _, attachment := range p.Attachments {
+		if attachment.URL == "" {
+			return fmt.Errorf("%w: attachment has no url", ErrorInvalidPayload)
+		}
+	}
+	return nil
+}
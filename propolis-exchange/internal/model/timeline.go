@@ -0,0 +1,53 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InboxEntry struct {
+	ID            string      `db:"ID" json:"id"`
+	ReceivedAt    time.Time   `db:"ReceivedAt" json:"receivedAt"`
+	Timestamp     int64       `db:"Timestamp" json:"timestamp"`
+	SenderAddress UserAddress `db:"SenderAddress" json:"sender"`
+	ContentType   string      `db:"ContentType" json:"contentType"`
+	ExpiresAt     *time.Time  `db:"ExpiresAt" json:"expiresAt,omitempty"`
+	Message       string      `db:"Message" json:"-"`
+}
+
+// TimelineCursor marks a position in a timeline. Entries are ordered by
+// timestamp and then post ID so the position is stable when several posts
+// share a timestamp.
+type TimelineCursor struct {
+	Timestamp int64
+	PostID    PostID
+}
+
+type TimelinePage struct {
+	Posts []*PostRecord `json:"posts"`
+	Next  string        `json:"next,omitempty"`
+}
+
+func (c *TimelineCursor) String() string {
+	raw := strconv.FormatInt(c.Timestamp, 10) + ":" + string(c.PostID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseTimelineCursor(cursor string) (*TimelineCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidCursor, err)
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, ErrorInvalidCursor
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidCursor, err)
+	}
+	return &TimelineCursor{timestamp, PostID(parts[1])}, nil
+}
@@ -1,6 +1,11 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
 
 type UserID string      // local user id e.g. 3GFQNuSg3dPqDD1emxv5bqX42oxq
 type UserAddress string // possibly remote user id e.g. 3GFQNuSg3dPqDD1emxv5bqX42oxq@somewhere.com
@@ -14,10 +19,169 @@ const (
 	UserStatusDeleted
 )
 
+var userStatusTransitions = map[UserStatus][]UserStatus{
+	UserStatusPending: {UserStatusActive, UserStatusDeleted},
+	UserStatusActive:  {UserStatusLocked, UserStatusDeleted},
+	UserStatusLocked:  {UserStatusActive, UserStatusDeleted},
+	UserStatusDeleted: {},
+}
+
+func (s UserStatus) CanTransitionTo(next UserStatus) bool {
+	for _, allowed := range userStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyAlgorithm is the algorithm a user's messages are signed with, fixed
+// when the account is created since the user ID is derived from the key.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmES256 KeyAlgorithm = "ES256"
+	KeyAlgorithmEdDSA KeyAlgorithm = "EdDSA"
+)
+
 type CreateUserParams struct {
-	Handle   string `json:"handle"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Handle    string       `json:"handle"`
+	Email     string       `json:"email"`
+	Password  string       `json:"password"`
+	Algorithm KeyAlgorithm `json:"algorithm,omitempty"`
+}
+
+const (
+	MinHandleLength = 3
+	MaxHandleLength = 30
+	MaxEmailLength  = 254
+)
+
+// reservedHandles can't be registered, since they would be mistaken for the
+// server or its staff.
+var reservedHandles = map[string]bool{
+	"admin": true, "administrator": true, "api": true, "help": true, "local": true,
+	"moderator": true, "postmaster": true, "propolis": true, "root": true,
+	"security": true, "staff": true, "support": true, "system": true, "webmaster": true,
+}
+
+// NormaliseHandle returns the form a handle is stored and compared in.
+// Handles are case-insensitive.
+func NormaliseHandle(handle string) string {
+	return strings.ToLower(strings.TrimSpace(handle))
+}
+
+// NormaliseEmail returns the form an email address is stored and compared in.
+// The local part is case-sensitive by the letter of RFC 5321, but no mail
+// provider treats it that way, and two accounts differing only in case would
+// be a trap.
+func NormaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Normalise puts the handle and email into their stored form. Accounts get
+// an ES256 key unless another algorithm is asked for.
+func (p *CreateUserParams) Normalise() {
+	p.Handle = NormaliseHandle(p.Handle)
+	p.Email = NormaliseEmail(p.Email)
+	if p.Algorithm == "" {
+		p.Algorithm = KeyAlgorithmES256
+	}
+}
+
+// Validate checks a normalised handle, email and key algorithm.
+func (p *CreateUserParams) Validate() error {
+	if err := ValidateHandle(p.Handle); err != nil {
+		return err
+	}
+	if err := ValidateEmail(p.Email); err != nil {
+		return err
+	}
+	if p.Algorithm != KeyAlgorithmES256 && p.Algorithm != KeyAlgorithmEdDSA {
+		return &FieldError{"algorithm", fmt.Sprintf("must be %s or %s", KeyAlgorithmES256, KeyAlgorithmEdDSA), ErrorInvalidField}
+	}
+	return nil
+}
+
+// ValidateHandle checks a normalised handle: 3 to 30 lowercase letters, digits
+// or underscores, starting with a letter, and not reserved.
+func ValidateHandle(handle string) error {
+	if len(handle) < MinHandleLength || len(handle) > MaxHandleLength {
+		return &FieldError{"handle", fmt.Sprintf("must be %d to %d characters", MinHandleLength, MaxHandleLength), ErrorInvalidField}
+	}
+	if handle[0] < 'a' || handle[0] > 'z' {
+		return &FieldError{"handle", "must start with a letter", ErrorInvalidField}
+	}
+	for _, r := range handle {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return &FieldError{"handle", "may only contain letters, digits and underscores", ErrorInvalidField}
+		}
+	}
+	if reservedHandles[handle] {
+		return &FieldError{"handle", "is reserved", ErrorInvalidField}
+	}
+	return nil
+}
+
+// ValidateEmail checks that a normalised email is a bare address with a
+// domain that could be delivered to.
+func ValidateEmail(email string) error {
+	invalid := &FieldError{"email", "must be a valid email address", ErrorInvalidField}
+	if email == "" || len(email) > MaxEmailLength {
+		return invalid
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return invalid
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return invalid
+	}
+	return nil
+}
+
+// CreateUserResult carries secrets that are only ever shown once. The
+// recovery key is the only way back in if the password is forgotten, since
+// the server can't decrypt the private key without one or the other. The
+// verification token isn't here, as it is delivered out of band.
+type CreateUserResult struct {
+	User        *User  `json:"user"`
+	RecoveryKey string `json:"recoveryKey"`
+}
+
+type ChangePasswordParams struct {
+	Address     UserAddress `json:"address"`
+	OldPassword string      `json:"oldPassword"`
+	NewPassword string      `json:"newPassword"`
+}
+
+type ResetPasswordParams struct {
+	Address     UserAddress `json:"address"`
+	RecoveryKey string      `json:"recoveryKey"`
+	NewPassword string      `json:"newPassword"`
+}
+
+type ResetPasswordResult struct {
+	User        *User  `json:"user"`
+	RecoveryKey string `json:"recoveryKey"`
+}
+
+type VerifyUserParams struct {
+	Address UserAddress `json:"address"`
+	Token   string      `json:"token"`
+}
+
+type LoginParams struct {
+	Address  UserAddress `json:"address"`
+	Password string      `json:"password"`
+}
+
+type Session struct {
+	Token     string    `json:"token"`
+	UserID    UserID    `json:"userId"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 type User struct {
@@ -27,10 +191,67 @@ type User struct {
 	LastLoggedInAt *time.Time `db:"LastLoggedInAt" json:"-"`
 	LoginAttempts  int        `db:"LoginAttempts" json:"-"`
 	Status         UserStatus `db:"Status" json:"status"`
+	LockedUntil    *time.Time `db:"LockedUntil" json:"-"`
 	Handle         string     `db:"Handle" json:"handle"`
 	Email          string     `db:"Email" json:"email"`
 	Profile        string     `db:"Profile" json:"profile"`
 	Password       string     `db:"Password" json:"-"`
 	PrivateKey     string     `db:"PrivateKey" json:"-"`
 	PublicKey      string     `db:"PublicKey" json:"publicKey"`
+
+	VerificationToken string `db:"VerificationToken" json:"-"`
+	RecoveryKey       string `db:"RecoveryKey" json:"-"`
+
+	ApproveFollowers bool `db:"ApproveFollowers" json:"approveFollowers"`
+}
+
+// CheckActive returns an error saying why the user can't sign or receive
+// messages, or nil if they can. A lock that has run out no longer counts.
+func (u *User) CheckActive(now time.Time) error {
+	switch u.Status {
+	case UserStatusActive:
+		return nil
+	case UserStatusPending:
+		return ErrorUserPending
+	case UserStatusLocked:
+		if u.LockedUntil != nil && !now.Before(*u.LockedUntil) {
+			return nil
+		}
+		return ErrorUserLocked
+	case UserStatusDeleted:
+		return ErrorUserDeleted
+	}
+	return ErrorUserNotActive
+}
+
+// Parse splits an address into the user ID and the domain of the server the
+// user belongs to. The domain is empty for bare user IDs.
+func (a UserAddress) Parse() (UserID, string, error) {
+	id, domain, found := strings.Cut(string(a), "@")
+	if id == "" || strings.ContainsAny(id, "/?#@ ") {
+		return "", "", ErrorInvalidAddress
+	}
+	if found && (domain == "" || strings.ContainsAny(domain, "/?#@ ")) {
+		return "", "", ErrorInvalidAddress
+	}
+	return UserID(id), strings.ToLower(domain), nil
+}
+
+// Qualified gives an address without a domain the local one, so that the
+// same user has the same address wherever it came from.
+func (a UserAddress) Qualified(localDomain string) (UserAddress, error) {
+	userID, domain, err := a.Parse()
+	if err != nil {
+		return "", err
+	}
+	if domain == "" {
+		domain = strings.ToLower(localDomain)
+	}
+	return UserAddress(string(userID) + "@" + domain), nil
+}
+
+// IsLocal reports whether the address belongs to the server at localDomain.
+func (a UserAddress) IsLocal(localDomain string) bool {
+	_, domain, err := a.Parse()
+	return err == nil && (domain == "" || domain == strings.ToLower(localDomain))
 }
@@ -0,0 +1,483 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/nrednav/cuid2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+)
+
+const (
+	batchSize      int           = 100
+	requestTimeout time.Duration = 30 * time.Second
+	// maxRecipients keeps the recipient header of a delivery to a sensible
+	// size. Servers with more recipients than this get several deliveries.
+	maxRecipients int = 100
+	// maxErrorBody is as much of a rejection's body as is read for its code.
+	maxErrorBody int64 = 4096
+)
+
+var deliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "propolis",
+	Subsystem: "delivery",
+	Name:      "latency_seconds",
+	Help:      "Time from a message being queued to it being accepted by the recipient server.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+})
+
+type Config interface {
+	store.Config
+	ServerBaseURL() string
+	DeliveryWorkers() int
+	DeliveryPollInterval() time.Duration
+	DeliveryBackoff() (time.Duration, time.Duration)
+	DeliveryDeadline() time.Duration
+}
+
+type Resolver interface {
+	IngestURL(address model.UserAddress) (string, error)
+}
+
+// Signer identifies this server to the servers it delivers to.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+type job struct {
+	userID  model.UserID
+	entryID string
+}
+
+type service struct {
+	config   Config
+	resolver Resolver
+	stores   *store.Manager
+	signer   Signer
+	client   *http.Client
+	jobs     chan job
+	wake     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	senders  map[model.UserID]struct{}
+	inFlight map[string]struct{}
+}
+
+func New(config Config, resolver Resolver, stores *store.Manager, signer Signer) (*service, error) {
+	return &service{
+		config:   config,
+		resolver: resolver,
+		stores:   stores,
+		signer:   signer,
+		client:   &http.Client{Timeout: requestTimeout},
+		jobs:     make(chan job),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		senders:  map[model.UserID]struct{}{},
+		inFlight: map[string]struct{}{},
+	}, nil
+}
+
+// Start resumes delivery of anything left in the outboxes by a previous run
+// and starts the scheduler and worker pool.
+func (s *service) Start() error {
+	userIDs, err := store.UserIDs(s.config)
+	if err != nil {
+		return fmt.Errorf("listing users: %w", err)
+	}
+
+	for _, userID := range userIDs {
+		userStore, err := s.stores.ForUser(userID)
+		if err != nil {
+			return fmt.Errorf("loading userstore: %w", err)
+		}
+		count, err := userStore.CountPendingOutbox()
+		userStore.Close()
+		if err != nil {
+			return fmt.Errorf("counting outbox for %s: %w", userID, err)
+		}
+		if count > 0 {
+			s.addSender(userID)
+		}
+	}
+
+	s.wg.Add(1)
+	go s.schedule()
+
+	for i := 0; i < s.config.DeliveryWorkers(); i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+
+	return nil
+}
+
+func (s *service) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return nil
+}
+
+// Enqueue writes outbox entries for a signed message and wakes the
+// scheduler. Recipients are grouped by the server they're delivered to, so
+// that each server is sent the message once with the list of its recipients.
+// A message that isn't valid yet is first attempted once it is.
+func (s *service) Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error) {
+	split := strings.LastIndex(signed, ".")
+	if split < 0 {
+		return nil, fmt.Errorf("invalid signed message")
+	}
+
+	groups, err := s.group(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := message.ReadHeader([]byte(signed))
+	if err != nil {
+		return nil, fmt.Errorf("reading message header: %w", err)
+	}
+
+	now := time.Now().UTC()
+	// recipients turn away a message until it's valid, so don't try before
+	firstAttemptAt := now
+	if validFrom := header.ValidFrom(); validFrom != nil && validFrom.After(now) {
+		firstAttemptAt = *validFrom
+	}
+	entries := make([]*model.OutboxEntry, 0, len(groups))
+	for _, group := range groups {
+		entries = append(entries, &model.OutboxEntry{
+			ID:            cuid2.Generate(),
+			CreatedAt:     now,
+			Status:        model.PostStatusPending,
+			SenderAddress: model.UserAddress(sender),
+			Recipients:    group,
+			Hash:          id,
+			ContentType:   string(contentType),
+			Payload:       signed[:split],
+			Signature:     signed[split+1:],
+			NextAttemptAt: firstAttemptAt,
+		})
+	}
+
+	userStore, err := s.stores.ForUser(sender)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	user, err := userStore.Fetch()
+	if err != nil {
+		return nil, fmt.Errorf("fetching user: %w", err)
+	}
+	if err := user.CheckActive(now); err != nil {
+		return nil, err
+	}
+
+	err = userStore.PutOutbox(entries)
+	if err != nil {
+		return nil, fmt.Errorf("writing outbox: %w", err)
+	}
+
+	s.addSender(sender)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return entries, nil
+}
+
+// group splits recipients by the ingest URL of their server, in the order
+// each server is first seen, with no more than maxRecipients in a group.
+func (s *service) group(recipients []model.UserAddress) ([]model.Recipients, error) {
+	groups := []model.Recipients{}
+	open := map[string]int{}
+	for _, recipient := range recipients {
+		url, err := s.resolver.IngestURL(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("resolving server for %s: %w", recipient, err)
+		}
+		i, ok := open[url]
+		if !ok || len(groups[i]) >= maxRecipients {
+			i = len(groups)
+			open[url] = i
+			groups = append(groups, model.Recipients{})
+		}
+		groups[i] = append(groups[i], recipient)
+	}
+	return groups, nil
+}
+
+func (s *service) addSender(userID model.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.senders[userID] = struct{}{}
+}
+
+func (s *service) schedule() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.DeliveryPollInterval())
+	defer ticker.Stop()
+
+	for {
+		s.dispatchDue()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *service) dispatchDue() {
+	s.mu.Lock()
+	senders := make([]model.UserID, 0, len(s.senders))
+	for userID := range s.senders {
+		senders = append(senders, userID)
+	}
+	s.mu.Unlock()
+
+	for _, userID := range senders {
+		err := s.dispatchDueFor(userID)
+		if err != nil {
+			log.Errorf("dispatching outbox for %s: %+v", userID, err)
+		}
+	}
+}
+
+func (s *service) dispatchDueFor(userID model.UserID) error {
+	userStore, err := s.stores.ForUser(userID)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	entries, err := userStore.DueOutbox(time.Now().UTC(), batchSize)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		// forget senders with nothing left to deliver, holding the lock so
+		// that a concurrent Enqueue re-adds the sender after we remove it
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		count, err := userStore.CountPendingOutbox()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			delete(s.senders, userID)
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		s.mu.Lock()
+		_, busy := s.inFlight[entry.ID]
+		if !busy {
+			s.inFlight[entry.ID] = struct{}{}
+		}
+		s.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		select {
+		case s.jobs <- job{userID, entry.ID}:
+		case <-s.done:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *service) work() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case j := <-s.jobs:
+			err := s.deliver(j)
+			if err != nil {
+				log.Errorf("delivering outbox entry %s: %+v", j.entryID, err)
+			}
+			s.mu.Lock()
+			delete(s.inFlight, j.entryID)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *service) deliver(j job) error {
+	userStore, err := s.stores.ForUser(j.userID)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	entry, err := userStore.FetchOutbox(j.entryID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if entry.Status != model.PostStatusPending && entry.Status != model.PostStatusFailed || entry.NextAttemptAt.After(now) {
+		// already dealt with by another worker since it was scheduled
+		return nil
+	}
+	if entry.Payload == "" {
+		// purged along with its post since it was scheduled
+		return nil
+	}
+	entry.Attempts++
+
+	status, code, err := s.post(entry)
+	switch {
+	case err == nil && (status >= 200 && status < 300 || code == model.IngestErrorCodeReplayed):
+		// a replay means the recipients already have the message, from an
+		// earlier attempt that succeeded without us hearing back
+		entry.Status = model.PostStatusSent
+		entry.LastError = ""
+		deliveryLatency.Observe(now.Sub(entry.CreatedAt).Seconds())
+	case err == nil && isPermanent(status):
+		entry.Status = model.PostStatusFailedPermanent
+		entry.LastError = fmt.Sprintf("recipient server responded %d", status)
+	default:
+		if err != nil {
+			entry.LastError = err.Error()
+		} else {
+			entry.LastError = fmt.Sprintf("recipient server responded %d", status)
+		}
+		if now.Sub(entry.CreatedAt) >= s.config.DeliveryDeadline() {
+			entry.Status = model.PostStatusFailedPermanent
+		} else {
+			entry.Status = model.PostStatusFailed
+			entry.NextAttemptAt = now.Add(s.backoff(entry.Attempts))
+		}
+	}
+
+	return userStore.UpdateOutbox(entry)
+}
+
+// post sends an entry to its recipients' server. Along with the status it
+// returns the error code from the body of a rejection, if there is one.
+func (s *service) post(entry *model.OutboxEntry) (int, string, error) {
+	if len(entry.Recipients) == 0 {
+		return 0, "", fmt.Errorf("no recipients")
+	}
+	// every recipient of an entry is on the same server
+	url, err := s.resolver.IngestURL(entry.Recipients[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("resolving recipient server: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	body := []byte(entry.Message())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(model.HeaderRecipient, entry.Recipients.String())
+	if err := s.signer.Sign(req, body); err != nil {
+		return 0, "", fmt.Errorf("signing request: %w", err)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("posting message: %w", err)
+	}
+	defer res.Body.Close()
+
+	var code string
+	if res.StatusCode >= 400 {
+		rejection := &model.IngestErrorResponse{}
+		if err := json.NewDecoder(io.LimitReader(res.Body, maxErrorBody)).Decode(rejection); err == nil {
+			code = rejection.Code
+		}
+	}
+	io.Copy(io.Discard, res.Body)
+
+	return res.StatusCode, code, nil
+}
+
+// backoff doubles the wait after each attempt up to the configured maximum
+// and then picks a random point in the upper half to spread out retries.
+func (s *service) backoff(attempts int) time.Duration {
+	min, max := s.config.DeliveryBackoff()
+	wait := min
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// isPermanent reports whether a response means retrying is pointless. Too
+// early is for messages that aren't valid yet, which will be accepted later.
+func isPermanent(status int) bool {
+	if status == http.StatusRequestTimeout || status == http.StatusTooEarly || status == http.StatusTooManyRequests {
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+type addressResolver struct {
+	baseURL     string
+	localDomain string
+}
+
+// NewResolver returns a resolver that sends local addresses to this server
+// and id@domain addresses to https://domain.
+func NewResolver(config Config) (*addressResolver, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	return &addressResolver{strings.TrimRight(config.ServerBaseURL(), "/"), baseURL.Host}, nil
+}
+
+func (r *addressResolver) IngestURL(address model.UserAddress) (string, error) {
+	_, domain, err := address.Parse()
+	if err != nil {
+		return "", err
+	}
+	if address.IsLocal(r.localDomain) {
+		return r.baseURL + "/ingest", nil
+	}
+	return "https://" + domain + "/ingest", nil
+}
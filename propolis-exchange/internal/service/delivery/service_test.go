@@ -0,0 +1,409 @@
+package delivery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/httpsig"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type testConfig struct {
+	dataDir  string
+	deadline time.Duration
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) StoreMaxOpen() int {
+	return 16
+}
+
+func (c *testConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+func newTestStores(t *testing.T, config store.ManagerConfig) *store.Manager {
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+	return stores
+}
+
+func (c *testConfig) ServerBaseURL() string {
+	return "http://localhost:8080"
+}
+
+func (c *testConfig) DeliveryWorkers() int {
+	return 2
+}
+
+func (c *testConfig) DeliveryPollInterval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (c *testConfig) DeliveryBackoff() (time.Duration, time.Duration) {
+	return 5 * time.Millisecond, 20 * time.Millisecond
+}
+
+func (c *testConfig) DeliveryDeadline() time.Duration {
+	return c.deadline
+}
+
+type testResolver struct {
+	url string
+}
+
+// IngestURL gives each domain its own path on the test server.
+func (r *testResolver) IngestURL(address model.UserAddress) (string, error) {
+	_, domain, err := address.Parse()
+	if err != nil {
+		return "", err
+	}
+	return r.url + "/" + domain + "/ingest", nil
+}
+
+var testServerKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+type testSigner struct{}
+
+func (s *testSigner) Sign(req *http.Request, body []byte) error {
+	return httpsig.Sign(req, body, "localhost:8080", testServerKey, model.HeaderRecipient)
+}
+
+type recipientServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	code     string
+	received map[string][]string
+}
+
+func newRecipientServer(status int) *recipientServer {
+	r := &recipientServer{status: status, received: map[string][]string{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		_, err := httpsig.Verify(req, body, func(keyID string) (*ecdsa.PublicKey, error) {
+			return &testServerKey.PublicKey, nil
+		}, time.Minute, model.HeaderRecipient)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.mu.Lock()
+		recipient := req.Header.Get(model.HeaderRecipient)
+		r.received[recipient] = append(r.received[recipient], string(body))
+		status, code := r.status, r.code
+		r.mu.Unlock()
+		if code != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(&model.IngestErrorResponse{Code: code, Message: "rejected"})
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	return r
+}
+
+func (r *recipientServer) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, messages := range r.received {
+		n += len(messages)
+	}
+	return n
+}
+
+func newTestConfig(t *testing.T, deadline time.Duration) *testConfig {
+	return &testConfig{t.TempDir(), deadline}
+}
+
+func newTestMessage(t *testing.T, config store.Config, opts ...message.Option) (model.UserID, string, string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := model.UserID(user.IDFromPublicKey(&privateKey.PublicKey))
+	userStore, err := store.NewUserStore(&model.User{
+		ID:        userID,
+		CreatedAt: time.Now().UTC(),
+		Status:    model.UserStatusActive,
+		Handle:    string(userID),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Close()
+
+	signed, id, err := message.New(&model.Post{Content: "hello"}, message.Address(userID), string(model.ContentTypePost), privateKey, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, signed, id
+}
+
+func outboxEntry(t *testing.T, config store.Config, userID model.UserID, id string) *model.OutboxEntry {
+	userStore, err := store.ForUser(userID, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer userStore.Close()
+	entry, err := userStore.FetchOutbox(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestDelivery(t *testing.T) {
+	recipients := []model.UserAddress{"recipient1@example.com", "recipient2@other.example.com", "recipient3@example.com"}
+
+	t.Run("Delivered", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusAccepted)
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients)
+		assert.Nil(err)
+		assert.Len(entries, 2)
+
+		// one delivery per server, with every recipient on it
+		assert.Eventually(func() bool { return server.count() == 2 }, time.Second, 5*time.Millisecond)
+		assert.Equal([]string{signed}, server.received["recipient1@example.com,recipient3@example.com"])
+		assert.Equal([]string{signed}, server.received["recipient2@other.example.com"])
+		for _, entry := range entries {
+			assert.Eventually(func() bool {
+				return outboxEntry(t, config, userID, entry.ID).Status == model.PostStatusSent
+			}, time.Second, 5*time.Millisecond)
+		}
+	})
+
+	t.Run("Resumed After Restart", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusAccepted)
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		userID, signed, id := newTestMessage(t, config)
+
+		stopped, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		_, err = stopped.Enqueue(userID, id, model.ContentTypePost, signed, recipients)
+		assert.Nil(err)
+		stopped.Close()
+		assert.Equal(0, server.count())
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		assert.Eventually(func() bool { return server.count() == 2 }, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("Retried Until Deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusServiceUnavailable)
+		defer server.Close()
+
+		config := newTestConfig(t, 100*time.Millisecond)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusFailedPermanent
+		}, 2*time.Second, 10*time.Millisecond)
+		entry := outboxEntry(t, config, userID, entries[0].ID)
+		assert.Greater(entry.Attempts, 1)
+		assert.Equal(entry.Attempts, server.count())
+	})
+
+	t.Run("Too Early", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusTooEarly)
+		defer server.Close()
+
+		config := newTestConfig(t, 100*time.Millisecond)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+
+		// not valid yet, so retried rather than given up on
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusFailedPermanent
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Greater(outboxEntry(t, config, userID, entries[0].ID).Attempts, 1)
+	})
+
+	t.Run("Deferred Until Valid", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusAccepted)
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		validFrom := time.Now().Add(200 * time.Millisecond)
+		userID, signed, id := newTestMessage(t, config, message.WithNotBefore(validFrom))
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+		assert.Equal(validFrom.UnixMilli(), entries[0].NextAttemptAt.UnixMilli())
+
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusSent
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.False(time.Now().Before(validFrom))
+		assert.Equal(1, outboxEntry(t, config, userID, entries[0].ID).Attempts)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusBadRequest)
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusFailedPermanent
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(1, outboxEntry(t, config, userID, entries[0].ID).Attempts)
+	})
+
+	t.Run("Already Received", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusConflict)
+		server.mu.Lock()
+		server.code = model.IngestErrorCodeReplayed
+		server.mu.Unlock()
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusSent
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(1, server.count())
+	})
+
+	t.Run("Other Conflict", func(t *testing.T) {
+		assert := assert.New(t)
+		server := newRecipientServer(http.StatusConflict)
+		defer server.Close()
+
+		config := newTestConfig(t, time.Minute)
+		userID, signed, id := newTestMessage(t, config)
+
+		service, err := New(config, &testResolver{server.URL}, newTestStores(t, config), &testSigner{})
+		assert.Nil(err)
+		assert.Nil(service.Start())
+		defer service.Close()
+
+		entries, err := service.Enqueue(userID, id, model.ContentTypePost, signed, recipients[:1])
+		assert.Nil(err)
+
+		// only a replay counts as delivered
+		assert.Eventually(func() bool {
+			return outboxEntry(t, config, userID, entries[0].ID).Status == model.PostStatusFailedPermanent
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(1, server.count())
+	})
+}
+
+func TestGroup(t *testing.T) {
+	assert := assert.New(t)
+	service := &service{resolver: &testResolver{"http://test"}}
+
+	recipients := []model.UserAddress{}
+	for i := 0; i < 2*maxRecipients+1; i++ {
+		recipients = append(recipients, model.UserAddress(fmt.Sprintf("recipient%d@example.com", i)))
+		if i == 0 {
+			recipients = append(recipients, "recipient@other.example.com")
+		}
+	}
+
+	groups, err := service.group(recipients)
+	assert.Nil(err)
+	sizes := []int{}
+	for _, group := range groups {
+		sizes = append(sizes, len(group))
+	}
+	assert.Equal([]int{maxRecipients, 1, maxRecipients, 1}, sizes)
+	assert.Equal(model.Recipients{"recipient@other.example.com"}, groups[1])
+
+	_, err = service.group([]model.UserAddress{"@example.com"})
+	assert.ErrorIs(err, model.ErrorInvalidAddress)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	service := &service{config: &testConfig{}}
+
+	for attempts := 1; attempts < 10; attempts++ {
+		wait := service.backoff(attempts)
+		assert.GreaterOrEqual(wait, 2500*time.Microsecond)
+		assert.LessOrEqual(wait, 20*time.Millisecond)
+	}
+}
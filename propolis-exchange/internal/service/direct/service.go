@@ -0,0 +1,311 @@
+package direct
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type Config interface {
+	store.Config
+	ServerBaseURL() string
+}
+
+const (
+	DefaultInboxLimit int = 20
+	MaxInboxLimit     int = 100
+
+	// MaxRecipients is the largest group a direct message can be sent to.
+	MaxRecipients int = 32
+)
+
+type Delivery interface {
+	Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error)
+}
+
+// Keys finds the public key of any user, local or remote, to encrypt to.
+type Keys interface {
+	PublicKeyFor(address model.UserAddress) (crypto.PublicKey, error)
+}
+
+// service sends and receives direct messages. They are encrypted to the
+// recipients' keys by the sender, so the servers in between, including the
+// recipients' own, only ever hold the envelope. A message is opened when the
+// recipient reads their inbox with the key unlocked by their session.
+// Encryption needs ES256 keys, so users with Ed25519 keys can send direct
+// messages but not receive them.
+type service struct {
+	config      Config
+	stores      *store.Manager
+	keys        Keys
+	delivery    Delivery
+	localDomain string
+}
+
+func New(config Config, stores *store.Manager, keys Keys, delivery Delivery) (*service, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	return &service{
+		config:      config,
+		stores:      stores,
+		keys:        keys,
+		delivery:    delivery,
+		localDomain: strings.ToLower(baseURL.Host),
+	}, nil
+}
+
+// Send encrypts a direct message to the recipients' keys and queues it for
+// delivery. A message for several recipients is sealed once with the key
+// wrapped for each of them, so it's delivered as a single message. If
+// expiresAt is given the message stops being valid then.
+func (s *service) Send(sender model.UserID, privateKey crypto.Signer, to []model.UserAddress, direct *model.DirectMessage, expiresAt *time.Time) (*model.DirectMessageRecord, error) {
+	if err := direct.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var opts []message.Option
+	if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return nil, fmt.Errorf("%w: direct message expires in the past", model.ErrorInvalidPayload)
+		}
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+		opts = append(opts, message.WithExpiry(utc))
+	}
+	to, err := s.recipients(to)
+	if err != nil {
+		return nil, err
+	}
+	if user.IDFromPublicKey(privateKey.Public()) != string(sender) {
+		return nil, model.ErrorSenderMismatch
+	}
+
+	userStore, err := s.stores.ForUser(sender)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if err := checkActive(userStore); err != nil {
+		return nil, err
+	}
+
+	recipientKeys := make(map[message.Address]*ecdsa.PublicKey, len(to))
+	for _, recipient := range to {
+		key, err := s.keys.PublicKeyFor(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("fetching key for %s: %w", recipient, err)
+		}
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s has a %T", model.ErrorEncryptionUnsupported, recipient, key)
+		}
+		recipientKeys[message.Address(recipient)] = ecdsaKey
+	}
+
+	address := s.self(sender)
+	var signed, id string
+	if len(to) == 1 {
+		signed, id, err = message.NewEncrypted(direct, message.Address(address), string(model.ContentTypeDirect), privateKey, message.Address(to[0]), recipientKeys[message.Address(to[0])], opts...)
+	} else {
+		signed, id, err = message.NewGroupEncrypted(direct, message.Address(address), string(model.ContentTypeDirect), privateKey, recipientKeys, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating message: %w", err)
+	}
+
+	_, err = s.delivery.Enqueue(sender, id, model.ContentTypeEncrypted, signed, to)
+	if err != nil {
+		return nil, fmt.Errorf("queueing direct message: %w", err)
+	}
+
+	return &model.DirectMessageRecord{
+		ID:            id,
+		SentAt:        now,
+		SenderAddress: address,
+		To:            to,
+		ExpiresAt:     expiresAt,
+		DirectMessage: *direct,
+	}, nil
+}
+
+// Receive keeps an encrypted message for a local recipient to open later. The
+// envelope must be addressed to them, alone or as one of a group.
+func (s *service) Receive(recipient model.UserAddress, msg *message.Message, envelope *message.Envelope) error {
+	userID, _, err := recipient.Parse()
+	if err != nil {
+		return err
+	}
+	if !recipient.IsLocal(s.localDomain) {
+		return fmt.Errorf("%w: %s is not local", model.ErrorUserNotFound, recipient)
+	}
+	if !envelope.Addressed(message.Address(s.self(userID))) {
+		return fmt.Errorf("%w: message is not for %s", model.ErrorNotInAudience, recipient)
+	}
+
+	userStore, err := s.stores.ForUser(userID)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if err := checkActive(userStore); err != nil {
+		return err
+	}
+
+	err = userStore.PutInbox(&model.InboxEntry{
+		ID:            msg.ID,
+		ReceivedAt:    time.Now().UTC(),
+		Timestamp:     msg.Header.Timestamp,
+		SenderAddress: model.UserAddress(msg.Header.KeyID),
+		ContentType:   msg.ContentType,
+		ExpiresAt:     msg.Header.Expires(),
+		Message:       msg.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("storing inbox entry: %w", err)
+	}
+	return nil
+}
+
+// Inbox opens a page of the user's direct messages, newest first. Anyone can
+// send an envelope addressed to the user, so ones that don't open, or don't
+// hold a direct message, are left out rather than spoiling the page. Any other
+// failure fails the page, so that nothing is skipped over by the cursor.
+func (s *service) Inbox(owner model.UserID, privateKey crypto.Signer, cursor *model.TimelineCursor, limit int) (*model.DirectMessagePage, error) {
+	if limit <= 0 {
+		limit = DefaultInboxLimit
+	}
+	if limit > MaxInboxLimit {
+		limit = MaxInboxLimit
+	}
+	ecdsaKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		// nothing can have been encrypted to a user without an ES256 key
+		return &model.DirectMessagePage{Messages: []*model.DirectMessageRecord{}}, nil
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	entries, next, err := userStore.Inbox(string(model.ContentTypeEncrypted), cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.DirectMessagePage{Messages: make([]*model.DirectMessageRecord, 0, len(entries))}
+	for _, entry := range entries {
+		record, err := s.open(owner, ecdsaKey, entry)
+		if unreadable(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("opening direct message %s: %w", entry.ID, err)
+		}
+		page.Messages = append(page.Messages, record)
+	}
+	if next != nil {
+		page.Next = next.String()
+	}
+	return page, nil
+}
+
+// open reads an inbox entry back. Its signature was checked when it was
+// ingested, so the sender's key isn't needed again.
+func (s *service) open(owner model.UserID, privateKey *ecdsa.PrivateKey, entry *model.InboxEntry) (*model.DirectMessageRecord, error) {
+	msg, err := message.ParseStored([]byte(entry.Message))
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := msg.Decrypt(message.Address(s.self(owner)), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	envelope := &message.Envelope{}
+	if err := json.Unmarshal(msg.Payload, envelope); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling envelope: %s", model.ErrorInvalidPayload, err)
+	}
+	if model.ContentType(decrypted.ContentType) != model.ContentTypeDirect {
+		return nil, &model.UnsupportedContentTypeError{ContentType: decrypted.ContentType}
+	}
+
+	record := &model.DirectMessageRecord{
+		ID:            msg.ID,
+		SentAt:        time.UnixMilli(msg.Header.Timestamp).UTC(),
+		SenderAddress: entry.SenderAddress,
+		ExpiresAt:     msg.Header.Expires(),
+	}
+	for _, to := range envelope.To() {
+		record.To = append(record.To, model.UserAddress(to))
+	}
+	if err := json.Unmarshal(decrypted.Payload, &record.DirectMessage); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling direct message: %s", model.ErrorInvalidPayload, err)
+	}
+	return record, nil
+}
+
+// unreadable reports whether an inbox entry failed to open because of what
+// it holds, rather than something that might not happen next time.
+func unreadable(err error) bool {
+	var unsupportedContentType *model.UnsupportedContentTypeError
+	return errors.Is(err, message.ErrorDecryptionFailed) ||
+		errors.Is(err, message.ErrorNotRecipient) ||
+		errors.Is(err, message.ErrorNotEncrypted) ||
+		errors.Is(err, message.ErrorInvalidMessage) ||
+		errors.Is(err, message.ErrorExpiredMessage) ||
+		errors.Is(err, model.ErrorInvalidPayload) ||
+		errors.As(err, &unsupportedContentType)
+}
+
+// recipients qualifies the addresses a message is sent to, dropping any
+// given more than once.
+func (s *service) recipients(to []model.UserAddress) ([]model.UserAddress, error) {
+	if len(to) == 0 {
+		return nil, fmt.Errorf("%w: direct message has no recipients", model.ErrorInvalidPayload)
+	}
+	if len(to) > MaxRecipients {
+		return nil, fmt.Errorf("%w: direct message has more than %d recipients", model.ErrorInvalidPayload, MaxRecipients)
+	}
+
+	seen := make(map[model.UserAddress]bool, len(to))
+	qualified := make([]model.UserAddress, 0, len(to))
+	for _, address := range to {
+		address, err := address.Qualified(s.localDomain)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[address] {
+			seen[address] = true
+			qualified = append(qualified, address)
+		}
+	}
+	return qualified, nil
+}
+
+// self is a local user's own address.
+func (s *service) self(userID model.UserID) model.UserAddress {
+	return model.UserAddress(string(userID) + "@" + s.localDomain)
+}
+
+func checkActive(userStore interface{ Fetch() (*model.User, error) }) error {
+	user, err := userStore.Fetch()
+	if err != nil {
+		return fmt.Errorf("fetching user: %w", err)
+	}
+	return user.CheckActive(time.Now().UTC())
+}
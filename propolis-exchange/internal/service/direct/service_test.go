@@ -0,0 +1,290 @@
+package direct
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+const testDomain = "local.example.com"
+
+type testConfig struct {
+	dataDir string
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) ServerBaseURL() string {
+	return "https://" + testDomain
+}
+
+func (c *testConfig) StoreMaxOpen() int {
+	return 16
+}
+
+func (c *testConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+type testKeys map[model.UserAddress]crypto.PublicKey
+
+func (k testKeys) PublicKeyFor(address model.UserAddress) (crypto.PublicKey, error) {
+	key, ok := k[address]
+	if !ok {
+		return nil, model.ErrorUserNotFound
+	}
+	return key, nil
+}
+
+type testDelivery struct {
+	signed     string
+	recipients []model.UserAddress
+}
+
+func (d *testDelivery) Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error) {
+	d.signed = signed
+	d.recipients = recipients
+	return nil, nil
+}
+
+func address(userID model.UserID) model.UserAddress {
+	return model.UserAddress(string(userID) + "@" + testDomain)
+}
+
+func newTestUser(t *testing.T, config store.Config, keys testKeys) (model.UserID, *ecdsa.PrivateKey) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestUserWithKey(t, config, keys, privateKey), privateKey
+}
+
+func newTestUserWithKey(t *testing.T, config store.Config, keys testKeys, privateKey crypto.Signer) model.UserID {
+	userID := model.UserID(user.IDFromPublicKey(privateKey.Public()))
+	userStore, err := store.NewUserStore(&model.User{
+		ID:        userID,
+		CreatedAt: time.Now().UTC(),
+		Status:    model.UserStatusActive,
+		Handle:    string(userID),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Close()
+	keys[address(userID)] = privateKey.Public()
+	return userID
+}
+
+func TestDirectService(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &testConfig{t.TempDir()}
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+
+	keys := testKeys{}
+	delivery := &testDelivery{}
+	service, err := New(config, stores, keys, delivery)
+	assert.Nil(err)
+
+	alice, aliceKey := newTestUser(t, config, keys)
+	bob, bobKey := newTestUser(t, config, keys)
+
+	// deliver passes the last queued message to the service, as ingest would.
+	deliver := func(recipient model.UserAddress) error {
+		msg, err := message.Parse([]byte(delivery.signed), func(header *message.Header) (crypto.PublicKey, error) {
+			return keys.PublicKeyFor(model.UserAddress(header.KeyID))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope := &message.Envelope{}
+		if err := json.Unmarshal(msg.Payload, envelope); err != nil {
+			t.Fatal(err)
+		}
+		return service.Receive(recipient, msg, envelope)
+	}
+
+	t.Run("Send", func(t *testing.T) {
+		sent, err := service.Send(alice, aliceKey, []model.UserAddress{model.UserAddress(bob)}, &model.DirectMessage{Content: "hello bob"}, nil)
+		assert.Nil(err)
+		assert.Equal(address(alice), sent.SenderAddress)
+		assert.Equal([]model.UserAddress{address(bob)}, delivery.recipients)
+		assert.NotContains(delivery.signed, "hello bob")
+
+		assert.Nil(deliver(address(bob)))
+
+		page, err := service.Inbox(bob, bobKey, nil, 0)
+		assert.Nil(err)
+		if assert.Len(page.Messages, 1) {
+			assert.Equal(sent.ID, page.Messages[0].ID)
+			assert.Equal(address(alice), page.Messages[0].SenderAddress)
+			assert.Equal("hello bob", page.Messages[0].Content)
+			assert.Equal([]model.UserAddress{address(bob)}, page.Messages[0].To)
+		}
+	})
+
+	t.Run("Send Empty", func(t *testing.T) {
+		_, err := service.Send(alice, aliceKey, []model.UserAddress{address(bob)}, &model.DirectMessage{}, nil)
+		assert.ErrorIs(err, model.ErrorInvalidPayload)
+
+		_, err = service.Send(alice, aliceKey, nil, &model.DirectMessage{Content: "hello"}, nil)
+		assert.ErrorIs(err, model.ErrorInvalidPayload)
+	})
+
+	t.Run("Unknown Recipient", func(t *testing.T) {
+		_, err := service.Send(alice, aliceKey, []model.UserAddress{"nobody@remote.example.com"}, &model.DirectMessage{Content: "hello"}, nil)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Someone Else's Message", func(t *testing.T) {
+		_, err := service.Send(bob, bobKey, []model.UserAddress{address(alice)}, &model.DirectMessage{Content: "hello alice"}, nil)
+		assert.Nil(err)
+
+		err = deliver(address(bob))
+		assert.ErrorIs(err, model.ErrorNotInAudience)
+	})
+
+	t.Run("Group", func(t *testing.T) {
+		carol, carolKey := newTestUser(t, config, keys)
+		dave, daveKey := newTestUser(t, config, keys)
+
+		sent, err := service.Send(alice, aliceKey, []model.UserAddress{model.UserAddress(carol), address(dave), address(carol)}, &model.DirectMessage{Content: "hello group"}, nil)
+		assert.Nil(err)
+		assert.Equal([]model.UserAddress{address(carol), address(dave)}, delivery.recipients)
+
+		for userID, privateKey := range map[model.UserID]*ecdsa.PrivateKey{carol: carolKey, dave: daveKey} {
+			assert.Nil(deliver(address(userID)))
+
+			page, err := service.Inbox(userID, privateKey, nil, 0)
+			assert.Nil(err)
+			if assert.Len(page.Messages, 1) {
+				assert.Equal(sent.ID, page.Messages[0].ID)
+				assert.Equal("hello group", page.Messages[0].Content)
+				assert.ElementsMatch([]model.UserAddress{address(carol), address(dave)}, page.Messages[0].To)
+			}
+		}
+
+		err = deliver(address(bob))
+		assert.ErrorIs(err, model.ErrorNotInAudience)
+	})
+
+	t.Run("Sender Key Not Fetched", func(t *testing.T) {
+		// the signature was checked at ingest, so reading doesn't need the
+		// sender's key, wherever it lives
+		aliceAddress := address(alice)
+		aliceKey := keys[aliceAddress]
+		delete(keys, aliceAddress)
+		defer func() { keys[aliceAddress] = aliceKey }()
+
+		page, err := service.Inbox(bob, bobKey, nil, 0)
+		assert.Nil(err)
+		assert.NotEmpty(page.Messages)
+	})
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		page, err := service.Inbox(bob, aliceKey, nil, 0)
+		assert.Nil(err)
+		assert.Empty(page.Messages)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		_, err := service.Send(alice, aliceKey, []model.UserAddress{address(bob)}, &model.DirectMessage{Content: "hello again"}, nil)
+		assert.Nil(err)
+		assert.Nil(deliver(address(bob)))
+
+		first, err := service.Inbox(bob, bobKey, nil, 1)
+		assert.Nil(err)
+		assert.Len(first.Messages, 1)
+		assert.NotEmpty(first.Next)
+
+		cursor, err := model.ParseTimelineCursor(first.Next)
+		assert.Nil(err)
+		second, err := service.Inbox(bob, bobKey, cursor, 1)
+		assert.Nil(err)
+		assert.Len(second.Messages, 1)
+		assert.Empty(second.Next)
+		assert.NotEqual(first.Messages[0].ID, second.Messages[0].ID)
+	})
+
+	t.Run("Expiring", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour)
+		sent, err := service.Send(alice, aliceKey, []model.UserAddress{address(bob)}, &model.DirectMessage{Content: "gone soon"}, &expiresAt)
+		assert.Nil(err)
+		if assert.NotNil(sent.ExpiresAt) {
+			assert.Equal(expiresAt.UnixMilli(), sent.ExpiresAt.UnixMilli())
+		}
+		assert.Nil(deliver(address(bob)))
+
+		// sent in the same millisecond as another, it may not be first
+		page, err := service.Inbox(bob, bobKey, nil, 0)
+		assert.Nil(err)
+		var received *model.DirectMessageRecord
+		for _, record := range page.Messages {
+			if record.ID == sent.ID {
+				received = record
+			}
+		}
+		if assert.NotNil(received) && assert.NotNil(received.ExpiresAt) {
+			assert.Equal(expiresAt.UnixMilli(), received.ExpiresAt.UnixMilli())
+		}
+
+		past := time.Now().Add(-time.Minute)
+		_, err = service.Send(alice, aliceKey, []model.UserAddress{address(bob)}, &model.DirectMessage{Content: "too late"}, &past)
+		assert.ErrorIs(err, model.ErrorInvalidPayload)
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(err)
+		ed := newTestUserWithKey(t, config, keys, edKey)
+
+		_, err = service.Send(ed, edKey, []model.UserAddress{address(bob)}, &model.DirectMessage{Content: "hello from ed"}, nil)
+		assert.Nil(err)
+		assert.Nil(deliver(address(bob)))
+
+		_, err = service.Send(alice, aliceKey, []model.UserAddress{address(ed)}, &model.DirectMessage{Content: "hello ed"}, nil)
+		assert.ErrorIs(err, model.ErrorEncryptionUnsupported)
+
+		page, err := service.Inbox(ed, edKey, nil, 0)
+		assert.Nil(err)
+		assert.Empty(page.Messages)
+	})
+}
+
+func TestUnreadable(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, err := range []error{
+		message.ErrorDecryptionFailed,
+		message.ErrorNotRecipient,
+		fmt.Errorf("%w: bad nonce", message.ErrorInvalidMessage),
+		&model.UnsupportedContentTypeError{ContentType: "x-other"},
+	} {
+		assert.True(unreadable(err), err.Error())
+	}
+
+	// a store or network failure might not happen next time, so the page
+	// fails rather than skipping the message
+	assert.False(unreadable(nil))
+	assert.False(unreadable(errors.New("connection refused")))
+}
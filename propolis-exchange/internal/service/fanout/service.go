@@ -0,0 +1,119 @@
+package fanout
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+)
+
+type Config interface {
+	store.Config
+}
+
+// pageSize is how many followers are read from the store at a time.
+const pageSize int = 500
+
+var (
+	fanoutRecipients = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "propolis",
+		Subsystem: "fanout",
+		Name:      "recipients",
+		Help:      "Number of recipients a published message is addressed to.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+	fanoutDeliveries = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "propolis",
+		Subsystem: "fanout",
+		Name:      "deliveries",
+		Help:      "Number of server deliveries a published message is queued as.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+	fanoutDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "propolis",
+		Subsystem: "fanout",
+		Name:      "duration_seconds",
+		Help:      "Time taken to expand a published message to its audience and queue it.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+type Delivery interface {
+	Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error)
+}
+
+// service sends what a user publishes to their audience. Delivery groups the
+// audience by server so each server is sent a message once.
+type service struct {
+	config   Config
+	stores   *store.Manager
+	delivery Delivery
+}
+
+func New(config Config, stores *store.Manager, delivery Delivery) (*service, error) {
+	return &service{
+		config:   config,
+		stores:   stores,
+		delivery: delivery,
+	}, nil
+}
+
+// Publish queues a signed message from a local user for delivery to their
+// audience, returning the outbox entries written. Direct messages go only to
+// the recipients given and everything else to the sender's followers.
+func (s *service) Publish(sender model.UserID, id string, contentType model.ContentType, signed string, visibility model.Visibility, to []model.UserAddress) ([]*model.OutboxEntry, error) {
+	start := time.Now()
+
+	var err error
+	audience := to
+	if visibility != model.VisibilityDirect {
+		audience, err = s.followers(sender)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []*model.OutboxEntry
+	if len(audience) > 0 {
+		entries, err = s.delivery.Enqueue(sender, id, contentType, signed, audience)
+		if err != nil {
+			return nil, fmt.Errorf("queueing %s: %w", id, err)
+		}
+	}
+
+	fanoutRecipients.Observe(float64(len(audience)))
+	fanoutDeliveries.Observe(float64(len(entries)))
+	fanoutDuration.Observe(time.Since(start).Seconds())
+
+	return entries, nil
+}
+
+// followers is everyone who has been accepted as a follower of the sender.
+func (s *service) followers(sender model.UserID) ([]model.UserAddress, error) {
+	userStore, err := s.stores.ForUser(sender)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	audience := []model.UserAddress{}
+	var after model.UserAddress
+	for {
+		follows, err := userStore.Followers(after, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, follow := range follows {
+			if follow.Status == model.FollowStatusAccepted {
+				audience = append(audience, follow.Address)
+			}
+		}
+		if len(follows) < pageSize {
+			return audience, nil
+		}
+		after = follows[len(follows)-1].Address
+	}
+}
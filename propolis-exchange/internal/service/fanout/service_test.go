@@ -0,0 +1,109 @@
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+)
+
+type testConfig struct {
+	dataDir string
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) StoreMaxOpen() int {
+	return 16
+}
+
+func (c *testConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+type testDelivery struct {
+	recipients []model.UserAddress
+	calls      int
+}
+
+func (d *testDelivery) Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error) {
+	d.calls++
+	d.recipients = recipients
+	return []*model.OutboxEntry{{Hash: id, Recipients: recipients}}, nil
+}
+
+func newTestUser(t *testing.T, config store.Config, userID model.UserID, followers map[model.UserAddress]model.FollowStatus) {
+	userStore, err := store.NewUserStore(&model.User{
+		ID:        userID,
+		CreatedAt: time.Now().UTC(),
+		Status:    model.UserStatusActive,
+		Handle:    string(userID),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer userStore.Close()
+
+	for address, status := range followers {
+		err := userStore.PutFollower(&model.Follow{
+			Address:   address,
+			Status:    status,
+			RequestID: "request",
+			CreatedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &testConfig{t.TempDir()}
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+
+	delivery := &testDelivery{}
+	service, err := New(config, stores, delivery)
+	assert.Nil(err)
+
+	t.Run("Followers", func(t *testing.T) {
+		newTestUser(t, config, "author", map[model.UserAddress]model.FollowStatus{
+			"follower1@local.example.com":  model.FollowStatusAccepted,
+			"follower2@remote.example.com": model.FollowStatusAccepted,
+			"pending@remote.example.com":   model.FollowStatusPending,
+		})
+
+		entries, err := service.Publish("author", "id", model.ContentTypePost, "signed", model.VisibilityFollowers, nil)
+		assert.Nil(err)
+		assert.Len(entries, 1)
+		assert.Equal([]model.UserAddress{"follower1@local.example.com", "follower2@remote.example.com"}, delivery.recipients)
+	})
+
+	t.Run("Direct", func(t *testing.T) {
+		to := []model.UserAddress{"friend@remote.example.com"}
+		entries, err := service.Publish("author", "id", model.ContentTypePost, "signed", model.VisibilityDirect, to)
+		assert.Nil(err)
+		assert.Len(entries, 1)
+		assert.Equal(to, delivery.recipients)
+	})
+
+	t.Run("No Followers", func(t *testing.T) {
+		newTestUser(t, config, "loner", nil)
+		calls := delivery.calls
+
+		entries, err := service.Publish("loner", "id", model.ContentTypePost, "signed", model.VisibilityPublic, nil)
+		assert.Nil(err)
+		assert.Empty(entries)
+		assert.Equal(calls, delivery.calls)
+	})
+}
@@ -0,0 +1,436 @@
+package follow
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type Config interface {
+	store.Config
+	ServerBaseURL() string
+}
+
+const (
+	DefaultListLimit int = 50
+	MaxListLimit     int = 200
+)
+
+type Delivery interface {
+	Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error)
+}
+
+// Instance signs messages as this server.
+type Instance interface {
+	NewMessage(payload interface{}, contentType model.ContentType) (string, string, error)
+}
+
+// service maintains the social graph. Both sides of a follow keep their own
+// record of it: the follower in their following table and the followee in
+// their follower table, kept in step by follow, unfollow, accept and reject
+// messages. Addresses in the graph always carry a domain, so the same user
+// has the same address whichever server they're seen from. Followers accepted
+// automatically are answered by the server, since the user may have no
+// session and so no key to sign with.
+type service struct {
+	config      Config
+	stores      *store.Manager
+	delivery    Delivery
+	instance    Instance
+	localDomain string
+}
+
+func New(config Config, stores *store.Manager, delivery Delivery, instance Instance) (*service, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	return &service{
+		config:      config,
+		stores:      stores,
+		delivery:    delivery,
+		instance:    instance,
+		localDomain: strings.ToLower(baseURL.Host),
+	}, nil
+}
+
+// Follow asks to follow another user. The follow stays pending until they
+// accept it.
+func (s *service) Follow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) (*model.Follow, error) {
+	followee, err := s.qualified(followee)
+	if err != nil {
+		return nil, err
+	}
+	if followee == s.self(follower) {
+		return nil, fmt.Errorf("%w: cannot follow yourself", model.ErrorInvalidAddress)
+	}
+
+	userStore, err := s.stores.ForUser(follower)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	existing, err := userStore.FetchFollowing(followee)
+	if err == nil && existing.Status == model.FollowStatusAccepted {
+		return existing, nil
+	}
+	if err != nil && err != model.ErrorFollowNotFound {
+		return nil, err
+	}
+
+	id, err := s.send(follower, privateKey, model.ContentTypeFollow, &model.FollowRequest{Target: followee}, followee)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	follow := &model.Follow{
+		Address:   followee,
+		Status:    model.FollowStatusPending,
+		RequestID: id,
+		CreatedAt: now,
+	}
+	if existing != nil {
+		follow.CreatedAt = existing.CreatedAt
+		follow.UpdatedAt = &now
+	}
+	if err := userStore.PutFollowing(follow); err != nil {
+		return nil, err
+	}
+	return follow, nil
+}
+
+// Unfollow stops following a user, or withdraws a request to.
+func (s *service) Unfollow(follower model.UserID, privateKey crypto.Signer, followee model.UserAddress) error {
+	followee, err := s.qualified(followee)
+	if err != nil {
+		return err
+	}
+
+	userStore, err := s.stores.ForUser(follower)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if _, err := userStore.FetchFollowing(followee); err != nil {
+		return err
+	}
+
+	_, err = s.send(follower, privateKey, model.ContentTypeUnfollow, &model.FollowRequest{Target: followee}, followee)
+	if err != nil {
+		return err
+	}
+	return userStore.DeleteFollowing(followee)
+}
+
+// Approve accepts a pending follower.
+func (s *service) Approve(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) (*model.Follow, error) {
+	follower, err := s.qualified(follower)
+	if err != nil {
+		return nil, err
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	follow, err := userStore.FetchFollower(follower)
+	if err != nil {
+		return nil, err
+	}
+	if follow.Status == model.FollowStatusAccepted && follow.Responded {
+		return follow, nil
+	}
+
+	response := &model.FollowResponse{Follower: follower, Request: follow.RequestID}
+	if _, err := s.send(owner, privateKey, model.ContentTypeAccept, response, follower); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	follow.Status = model.FollowStatusAccepted
+	follow.Responded = true
+	follow.UpdatedAt = &now
+	if err := userStore.PutFollower(follow); err != nil {
+		return nil, err
+	}
+	return follow, nil
+}
+
+// Reject turns down a pending follower, or removes an accepted one.
+func (s *service) Reject(owner model.UserID, privateKey crypto.Signer, follower model.UserAddress) error {
+	follower, err := s.qualified(follower)
+	if err != nil {
+		return err
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	follow, err := userStore.FetchFollower(follower)
+	if err != nil {
+		return err
+	}
+
+	response := &model.FollowResponse{Follower: follower, Request: follow.RequestID}
+	if _, err := s.send(owner, privateKey, model.ContentTypeReject, response, follower); err != nil {
+		return err
+	}
+	return userStore.DeleteFollower(follower)
+}
+
+// SetApproveFollowers chooses whether new followers are accepted straight
+// away or wait for the user to approve them. Followers already waiting are
+// left waiting.
+func (s *service) SetApproveFollowers(owner model.UserID, approve bool) (*model.User, error) {
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if err := userStore.SetApproveFollowers(approve); err != nil {
+		return nil, err
+	}
+	return userStore.Fetch()
+}
+
+func (s *service) Followers(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error) {
+	return s.list(owner, limit, func(userStore followStore, limit int) ([]*model.Follow, error) {
+		return userStore.Followers(after, limit)
+	})
+}
+
+func (s *service) Following(owner model.UserID, after model.UserAddress, limit int) (*model.FollowPage, error) {
+	return s.list(owner, limit, func(userStore followStore, limit int) ([]*model.Follow, error) {
+		return userStore.Following(after, limit)
+	})
+}
+
+// ReceiveRequest handles follow and unfollow messages sent to a local user.
+func (s *service) ReceiveRequest(recipient model.UserAddress, msg *message.Message, contentType model.ContentType, request *model.FollowRequest) error {
+	owner, err := s.localUser(recipient)
+	if err != nil {
+		return err
+	}
+	target, err := s.qualified(request.Target)
+	if err != nil || target != s.self(owner) {
+		return fmt.Errorf("%w: message is for someone else", model.ErrorSenderMismatch)
+	}
+	follower, err := s.qualified(model.UserAddress(msg.Header.KeyID))
+	if err != nil {
+		return err
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	user, err := userStore.Fetch()
+	if err != nil {
+		return fmt.Errorf("fetching user: %w", err)
+	}
+	if err := user.CheckActive(time.Now().UTC()); err != nil {
+		return err
+	}
+
+	switch contentType {
+	case model.ContentTypeFollow:
+		now := time.Now().UTC()
+		follow := &model.Follow{
+			Address:   follower,
+			Status:    model.FollowStatusPending,
+			RequestID: msg.ID,
+			CreatedAt: now,
+		}
+		existing, err := userStore.FetchFollower(follower)
+		if err != nil && err != model.ErrorFollowNotFound {
+			return err
+		}
+		if existing != nil {
+			follow.CreatedAt = existing.CreatedAt
+			follow.UpdatedAt = &now
+		}
+		// someone already following is answered again, in case the first
+		// accept was lost
+		if !user.ApproveFollowers || (existing != nil && existing.Status == model.FollowStatusAccepted) {
+			if err := s.acceptFor(owner, follow); err != nil {
+				return err
+			}
+			follow.Status = model.FollowStatusAccepted
+			follow.Responded = true
+		}
+		return userStore.PutFollower(follow)
+
+	case model.ContentTypeUnfollow:
+		err := userStore.DeleteFollower(follower)
+		if err == model.ErrorFollowNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return &model.UnsupportedContentTypeError{ContentType: string(contentType)}
+}
+
+// ReceiveResponse handles accept and reject messages sent to a local user in
+// answer to a follow request of theirs. Anything but an answer to their
+// latest request is ignored.
+func (s *service) ReceiveResponse(recipient model.UserAddress, msg *message.Message, contentType model.ContentType, response *model.FollowResponse) error {
+	owner, err := s.localUser(recipient)
+	if err != nil {
+		return err
+	}
+	follower, err := s.qualified(response.Follower)
+	if err != nil || follower != s.self(owner) {
+		return fmt.Errorf("%w: message is for someone else", model.ErrorSenderMismatch)
+	}
+	followee, err := s.responder(msg, contentType, response)
+	if err != nil {
+		return err
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	follow, err := userStore.FetchFollowing(followee)
+	if err == model.ErrorFollowNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if follow.RequestID != response.Request {
+		return nil
+	}
+
+	switch contentType {
+	case model.ContentTypeAccept:
+		now := time.Now().UTC()
+		follow.Status = model.FollowStatusAccepted
+		follow.UpdatedAt = &now
+		return userStore.PutFollowing(follow)
+
+	case model.ContentTypeReject:
+		return userStore.DeleteFollowing(followee)
+	}
+
+	return &model.UnsupportedContentTypeError{ContentType: string(contentType)}
+}
+
+type followStore interface {
+	Followers(after model.UserAddress, limit int) ([]*model.Follow, error)
+	Following(after model.UserAddress, limit int) ([]*model.Follow, error)
+}
+
+func (s *service) list(owner model.UserID, limit int, fetch func(userStore followStore, limit int) ([]*model.Follow, error)) (*model.FollowPage, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	follows, err := fetch(userStore, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.FollowPage{Follows: follows}
+	if len(follows) == limit {
+		page.Next = follows[len(follows)-1].Address
+	}
+	return page, nil
+}
+
+// send signs a message from a local user and queues it for delivery to one
+// recipient, returning the message ID.
+func (s *service) send(sender model.UserID, privateKey crypto.Signer, contentType model.ContentType, payload interface{}, recipient model.UserAddress) (string, error) {
+	if user.IDFromPublicKey(privateKey.Public()) != string(sender) {
+		return "", model.ErrorSenderMismatch
+	}
+
+	signed, id, err := message.New(payload, message.Address(s.self(sender)), string(contentType), privateKey)
+	if err != nil {
+		return "", fmt.Errorf("creating message: %w", err)
+	}
+
+	_, err = s.delivery.Enqueue(sender, id, contentType, signed, []model.UserAddress{recipient})
+	if err != nil {
+		return "", fmt.Errorf("queueing %s: %w", contentType, err)
+	}
+	return id, nil
+}
+
+// acceptFor queues an accept to a follower of a local user, signed by this
+// server on the user's behalf.
+func (s *service) acceptFor(owner model.UserID, follow *model.Follow) error {
+	response := &model.FollowResponse{Follower: follow.Address, Followee: s.self(owner), Request: follow.RequestID}
+	signed, id, err := s.instance.NewMessage(response, model.ContentTypeAccept)
+	if err != nil {
+		return fmt.Errorf("creating message: %w", err)
+	}
+	_, err = s.delivery.Enqueue(owner, id, model.ContentTypeAccept, signed, []model.UserAddress{follow.Address})
+	if err != nil {
+		return fmt.Errorf("queueing %s: %w", model.ContentTypeAccept, err)
+	}
+	return nil
+}
+
+// responder is the user who answered a follow request. An accept from their
+// server names them in the payload, and they must belong to that server.
+func (s *service) responder(msg *message.Message, contentType model.ContentType, response *model.FollowResponse) (model.UserAddress, error) {
+	if response.Followee == "" {
+		return s.qualified(model.UserAddress(msg.Header.KeyID))
+	}
+	_, domain, err := response.Followee.Parse()
+	if err != nil || contentType != model.ContentTypeAccept || domain != strings.ToLower(msg.Header.KeyID) {
+		return "", fmt.Errorf("%w: followee does not belong to the server that answered", model.ErrorSenderMismatch)
+	}
+	return response.Followee, nil
+}
+
+func (s *service) qualified(address model.UserAddress) (model.UserAddress, error) {
+	return address.Qualified(s.localDomain)
+}
+
+// self is a local user's own address.
+func (s *service) self(userID model.UserID) model.UserAddress {
+	return model.UserAddress(string(userID) + "@" + s.localDomain)
+}
+
+func (s *service) localUser(recipient model.UserAddress) (model.UserID, error) {
+	userID, _, err := recipient.Parse()
+	if err != nil {
+		return "", err
+	}
+	if !recipient.IsLocal(s.localDomain) {
+		return "", fmt.Errorf("%w: %s is not local", model.ErrorUserNotFound, recipient)
+	}
+	return userID, nil
+}
@@ -0,0 +1,292 @@
+package follow
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+const testDomain = "local.example.com"
+
+type testConfig struct {
+	dataDir string
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) ServerBaseURL() string {
+	return "https://" + testDomain
+}
+
+func (c *testConfig) StoreMaxOpen() int {
+	return 16
+}
+
+func (c *testConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+type queued struct {
+	signed    string
+	recipient model.UserAddress
+}
+
+// testDelivery holds on to queued messages until the test delivers them.
+type testDelivery struct {
+	queue []queued
+	keys  map[model.UserAddress]*ecdsa.PublicKey
+}
+
+func (d *testDelivery) Enqueue(sender model.UserID, id string, contentType model.ContentType, signed string, recipients []model.UserAddress) ([]*model.OutboxEntry, error) {
+	for _, recipient := range recipients {
+		d.queue = append(d.queue, queued{signed, recipient})
+	}
+	return nil, nil
+}
+
+// deliver passes every queued message to the service, as ingest would.
+func (d *testDelivery) deliver(t *testing.T, s *service) {
+	queue := d.queue
+	d.queue = nil
+	for _, q := range queue {
+		msg, err := message.Parse([]byte(q.signed), func(header *message.Header) (crypto.PublicKey, error) {
+			return d.keys[model.UserAddress(header.KeyID)], nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch contentType := model.ContentType(msg.ContentType); contentType {
+		case model.ContentTypeFollow, model.ContentTypeUnfollow:
+			request := &model.FollowRequest{}
+			if err := json.Unmarshal(msg.Payload, request); err != nil {
+				t.Fatal(err)
+			}
+			err = s.ReceiveRequest(q.recipient, msg, contentType, request)
+		default:
+			response := &model.FollowResponse{}
+			if err := json.Unmarshal(msg.Payload, response); err != nil {
+				t.Fatal(err)
+			}
+			err = s.ReceiveResponse(q.recipient, msg, contentType, response)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testInstance signs as the server at testDomain.
+type testInstance struct {
+	key *ecdsa.PrivateKey
+}
+
+func (i *testInstance) NewMessage(payload interface{}, contentType model.ContentType) (string, string, error) {
+	return message.New(payload, testDomain, string(contentType), i.key)
+}
+
+func (d *testDelivery) newUser(t *testing.T, config store.Config) (model.UserID, *ecdsa.PrivateKey) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := model.UserID(user.IDFromPublicKey(&privateKey.PublicKey))
+	userStore, err := store.NewUserStore(&model.User{
+		ID:        userID,
+		CreatedAt: time.Now().UTC(),
+		Status:    model.UserStatusActive,
+		Handle:    string(userID),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Close()
+	d.keys[address(userID)] = &privateKey.PublicKey
+	return userID, privateKey
+}
+
+func address(userID model.UserID) model.UserAddress {
+	return model.UserAddress(string(userID) + "@" + testDomain)
+}
+
+func TestFollowService(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &testConfig{t.TempDir()}
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+
+	instanceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	delivery := &testDelivery{keys: map[model.UserAddress]*ecdsa.PublicKey{testDomain: &instanceKey.PublicKey}}
+	service, err := New(config, stores, delivery, &testInstance{instanceKey})
+	assert.Nil(err)
+
+	alice, aliceKey := delivery.newUser(t, config)
+	bob, bobKey := delivery.newUser(t, config)
+	carol, carolKey := delivery.newUser(t, config)
+
+	status := func(list func(model.UserID, model.UserAddress, int) (*model.FollowPage, error), owner model.UserID) map[model.UserAddress]model.FollowStatus {
+		page, err := list(owner, "", 0)
+		assert.Nil(err)
+		statuses := map[model.UserAddress]model.FollowStatus{}
+		for _, follow := range page.Follows {
+			statuses[follow.Address] = follow.Status
+		}
+		return statuses
+	}
+
+	t.Run("Follow", func(t *testing.T) {
+		follow, err := service.Follow(alice, aliceKey, model.UserAddress(bob))
+		assert.Nil(err)
+		assert.Equal(address(bob), follow.Address)
+		assert.Equal(model.FollowStatusPending, follow.Status)
+
+		// bob accepts automatically, and the server answers for him
+		delivery.deliver(t, service)
+		assert.Equal(map[model.UserAddress]model.FollowStatus{address(alice): model.FollowStatusAccepted}, status(service.Followers, bob))
+		assert.Len(delivery.queue, 1)
+
+		delivery.deliver(t, service)
+		assert.Equal(map[model.UserAddress]model.FollowStatus{address(bob): model.FollowStatusAccepted}, status(service.Following, alice))
+		assert.Empty(delivery.queue)
+	})
+
+	t.Run("Accept For Another Server's User", func(t *testing.T) {
+		follow, err := service.Follow(alice, aliceKey, "dave@remote.example.com")
+		assert.Nil(err)
+		delivery.queue = nil
+
+		response := &model.FollowResponse{Follower: address(alice), Followee: "dave@remote.example.com", Request: follow.RequestID}
+		signed, _, err := message.New(response, testDomain, string(model.ContentTypeAccept), instanceKey)
+		assert.Nil(err)
+		msg, err := message.Parse([]byte(signed), func(header *message.Header) (crypto.PublicKey, error) {
+			return &instanceKey.PublicKey, nil
+		})
+		assert.Nil(err)
+
+		err = service.ReceiveResponse(address(alice), msg, model.ContentTypeAccept, response)
+		assert.ErrorIs(err, model.ErrorSenderMismatch)
+		assert.Equal(model.FollowStatusPending, status(service.Following, alice)["dave@remote.example.com"])
+		assert.Nil(service.Unfollow(alice, aliceKey, "dave@remote.example.com"))
+		delivery.queue = nil
+	})
+
+	t.Run("Follow Again", func(t *testing.T) {
+		_, err := service.Follow(carol, carolKey, address(alice))
+		assert.Nil(err)
+		delivery.queue = nil
+		page, err := service.Following(carol, "", 0)
+		assert.Nil(err)
+		first := page.Follows[0]
+		assert.Nil(first.UpdatedAt)
+
+		time.Sleep(5 * time.Millisecond)
+		before := time.Now().UTC()
+		again, err := service.Follow(carol, carolKey, address(alice))
+		assert.Nil(err)
+		delivery.queue = nil
+		assert.Equal(first.CreatedAt.UnixMilli(), again.CreatedAt.UnixMilli())
+		if assert.NotNil(again.UpdatedAt) {
+			assert.False(again.UpdatedAt.Before(before))
+		}
+
+		assert.Nil(service.Unfollow(carol, carolKey, address(alice)))
+		delivery.queue = nil
+	})
+
+	t.Run("Follow Self", func(t *testing.T) {
+		_, err := service.Follow(alice, aliceKey, address(alice))
+		assert.ErrorIs(err, model.ErrorInvalidAddress)
+	})
+
+	t.Run("Manual Approval", func(t *testing.T) {
+		user, err := service.SetApproveFollowers(carol, true)
+		assert.Nil(err)
+		assert.True(user.ApproveFollowers)
+
+		_, err = service.Follow(alice, aliceKey, address(carol))
+		assert.Nil(err)
+		_, err = service.Follow(bob, bobKey, address(carol))
+		assert.Nil(err)
+		delivery.deliver(t, service)
+		assert.Equal(map[model.UserAddress]model.FollowStatus{
+			address(alice): model.FollowStatusPending,
+			address(bob):   model.FollowStatusPending,
+		}, status(service.Followers, carol))
+
+		assert.Empty(delivery.queue)
+
+		follow, err := service.Approve(carol, carolKey, address(alice))
+		assert.Nil(err)
+		assert.Equal(model.FollowStatusAccepted, follow.Status)
+		assert.Nil(service.Reject(carol, carolKey, address(bob)))
+		delivery.deliver(t, service)
+
+		assert.Equal(map[model.UserAddress]model.FollowStatus{address(alice): model.FollowStatusAccepted}, status(service.Followers, carol))
+		assert.Equal(model.FollowStatusAccepted, status(service.Following, alice)[address(carol)])
+		assert.NotContains(status(service.Following, bob), address(carol))
+	})
+
+	t.Run("Stale Response", func(t *testing.T) {
+		_, err := service.Follow(bob, bobKey, address(carol))
+		assert.Nil(err)
+		delivery.deliver(t, service)
+
+		signed, _, err := message.New(&model.FollowResponse{Follower: address(bob), Request: "earlier"}, message.Address(address(carol)), string(model.ContentTypeAccept), carolKey)
+		assert.Nil(err)
+		delivery.queue = append(delivery.queue, queued{signed, address(bob)})
+		delivery.deliver(t, service)
+		assert.Equal(model.FollowStatusPending, status(service.Following, bob)[address(carol)])
+	})
+
+	t.Run("Someone Else's Request", func(t *testing.T) {
+		signed, _, err := message.New(&model.FollowRequest{Target: address(carol)}, message.Address(address(alice)), string(model.ContentTypeFollow), aliceKey)
+		assert.Nil(err)
+		msg, err := message.Parse([]byte(signed), func(header *message.Header) (crypto.PublicKey, error) {
+			return &aliceKey.PublicKey, nil
+		})
+		assert.Nil(err)
+
+		err = service.ReceiveRequest(address(bob), msg, model.ContentTypeFollow, &model.FollowRequest{Target: address(carol)})
+		assert.ErrorIs(err, model.ErrorSenderMismatch)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		first, err := service.Followers(carol, "", 1)
+		assert.Nil(err)
+		assert.Len(first.Follows, 1)
+		assert.NotEmpty(first.Next)
+
+		second, err := service.Followers(carol, first.Next, 1)
+		assert.Nil(err)
+		assert.Len(second.Follows, 1)
+		assert.NotEqual(first.Follows[0].Address, second.Follows[0].Address)
+	})
+
+	t.Run("Unfollow", func(t *testing.T) {
+		assert.Nil(service.Unfollow(alice, aliceKey, address(bob)))
+		delivery.deliver(t, service)
+		assert.NotContains(status(service.Following, alice), address(bob))
+		assert.NotContains(status(service.Followers, bob), address(alice))
+
+		err := service.Unfollow(alice, aliceKey, address(bob))
+		assert.ErrorIs(err, model.ErrorFollowNotFound)
+	})
+}
@@ -0,0 +1,247 @@
+package instance
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/crypt"
+	"uk.co.dudmesh.propolis/pkg/httpsig"
+	"uk.co.dudmesh.propolis/pkg/message"
+)
+
+const (
+	keyFile              = "instance.key"
+	remoteRequestTimeout = 10 * time.Second
+	// maxRemoteKeys bounds how many other servers' keys are cached, since
+	// any request can name a server.
+	maxRemoteKeys = 1024
+)
+
+type Config interface {
+	store.Config
+	ServerBaseURL() string
+	PublicKeyCacheTTL() time.Duration
+	ServerSignatureMaxAge() time.Duration
+}
+
+type cachedKey struct {
+	key     *ecdsa.PublicKey
+	expires time.Time
+}
+
+// service holds this server's own signing key, which identifies it to other
+// servers when it delivers messages, and verifies the requests they send.
+// Servers are identified by their domain, which is also the keyid their
+// requests are signed with.
+type service struct {
+	config        Config
+	key           *ecdsa.PrivateKey
+	localDomain   string
+	remoteScheme  string
+	client        *http.Client
+	mu            sync.Mutex
+	remoteKeys    map[string]cachedKey
+	maxRemoteKeys int
+}
+
+// New loads the instance key from the data directory, generating it the
+// first time the server starts.
+func New(config Config) (*service, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+
+	key, err := loadKey(filepath.Join(config.DataDirectory(), keyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &service{
+		config:        config,
+		key:           key,
+		localDomain:   strings.ToLower(baseURL.Host),
+		remoteScheme:  "https",
+		client:        &http.Client{Timeout: remoteRequestTimeout},
+		remoteKeys:    map[string]cachedKey{},
+		maxRemoteKeys: maxRemoteKeys,
+	}, nil
+}
+
+func loadKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateKey(keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading instance key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("decoding instance key: no PEM data in %s", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing instance key: %w", err)
+	}
+	return key, nil
+}
+
+func generateKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating instance key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling instance key: %w", err)
+	}
+
+	// O_EXCL so that if another process got there first, its key wins
+	file, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return loadKey(keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating instance key file: %w", err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, fmt.Errorf("writing instance key: %w", err)
+	}
+	return key, nil
+}
+
+// KeyID is the keyid this server signs requests with.
+func (s *service) KeyID() string {
+	return s.localDomain
+}
+
+func (s *service) PublicKey() *ecdsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+// Sign signs a delivery to another server, covering the recipient header so
+// that it can't be redirected to someone else.
+func (s *service) Sign(req *http.Request, body []byte) error {
+	return httpsig.Sign(req, body, s.localDomain, s.key, model.HeaderRecipient)
+}
+
+// Verify checks the server signature on a delivery and returns the domain of
+// the server that signed it.
+func (s *service) Verify(req *http.Request, body []byte) (string, error) {
+	domain, err := httpsig.Verify(req, body, s.PublicKeyFor, s.config.ServerSignatureMaxAge(), model.HeaderRecipient)
+	return strings.ToLower(domain), err
+}
+
+// NewMessage signs a message as this server rather than as one of its users,
+// for answers it gives on a user's behalf when it doesn't hold their key.
+func (s *service) NewMessage(payload interface{}, contentType model.ContentType) (string, string, error) {
+	return message.New(payload, message.Address(s.localDomain), string(contentType), s.key)
+}
+
+// PublicKeyFor finds the key of the server at domain, fetching it from the
+// server if it isn't cached.
+func (s *service) PublicKeyFor(domain string) (*ecdsa.PublicKey, error) {
+	domain = strings.ToLower(domain)
+	if domain == s.localDomain {
+		return s.PublicKey(), nil
+	}
+	if domain == "" || strings.ContainsAny(domain, "/?#@\\ ") {
+		return nil, fmt.Errorf("%w: %q is not a server", httpsig.ErrorUnknownKey, domain)
+	}
+
+	s.mu.Lock()
+	cached, ok := s.remoteKeys[domain]
+	s.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := s.remotePublicKey(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cacheKey(domain, key)
+	s.mu.Unlock()
+
+	return key, nil
+}
+
+// cacheKey remembers a server's key, making room by dropping expired keys
+// and then, if there are still too many, any other. The caller must hold
+// s.mu.
+func (s *service) cacheKey(domain string, key *ecdsa.PublicKey) {
+	now := time.Now()
+	if len(s.remoteKeys) >= s.maxRemoteKeys {
+		for cachedDomain, cached := range s.remoteKeys {
+			if !now.Before(cached.expires) {
+				delete(s.remoteKeys, cachedDomain)
+			}
+		}
+	}
+	for cachedDomain := range s.remoteKeys {
+		if len(s.remoteKeys) < s.maxRemoteKeys {
+			break
+		}
+		delete(s.remoteKeys, cachedDomain)
+	}
+	s.remoteKeys[domain] = cachedKey{key, now.Add(s.config.PublicKeyCacheTTL())}
+}
+
+// remotePublicKey fetches the key another server publishes for itself. Only a
+// server that says it has no key, or serves something that isn't one, makes
+// the key unknown; any other failure may pass, so the key is unavailable.
+func (s *service) remotePublicKey(domain string) (*ecdsa.PublicKey, error) {
+	keyURL := url.URL{Scheme: s.remoteScheme, Host: domain, Path: model.InstanceKeyPath}
+
+	res, err := s.client.Get(keyURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetching instance key: %s", model.ErrorKeyUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %s has no instance key", httpsig.ErrorUnknownKey, domain)
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: fetching instance key: server responded %d", model.ErrorKeyUnavailable, res.StatusCode)
+	}
+
+	var keyEncoded string
+	err = json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&keyEncoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding instance key response: %s", httpsig.ErrorUnknownKey, err)
+	}
+
+	key, err := crypt.DecodePublicKey(keyEncoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding instance key: %s", httpsig.ErrorUnknownKey, err)
+	}
+	// server signatures are only ever ES256
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported instance key type: %T", httpsig.ErrorUnknownKey, key)
+	}
+	return ecdsaKey, nil
+}
@@ -0,0 +1,172 @@
+package instance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/crypt"
+	"uk.co.dudmesh.propolis/pkg/httpsig"
+)
+
+type testConfig struct {
+	dataDir string
+	baseURL string
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) ServerBaseURL() string {
+	return c.baseURL
+}
+
+func (c *testConfig) PublicKeyCacheTTL() time.Duration {
+	return time.Hour
+}
+
+func (c *testConfig) ServerSignatureMaxAge() time.Duration {
+	return time.Minute
+}
+
+// publishKey serves an instance's key the way the instance key handler does,
+// counting how many times it's fetched.
+func publishKey(t *testing.T, instance *service, fetches *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != model.InstanceKeyPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		*fetches++
+		keyEncoded, err := crypt.EncodePublicKey(instance.PublicKey(), instance.KeyID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(keyEncoded)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func signedDelivery(t *testing.T, signer *service, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://local.example.com/ingest", strings.NewReader(body))
+	req.Header.Set(model.HeaderRecipient, "recipient")
+	if err := signer.Sign(req, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestInstanceKey(t *testing.T) {
+	assert := assert.New(t)
+	config := &testConfig{t.TempDir(), "https://local.example.com"}
+
+	first, err := New(config)
+	assert.Nil(err)
+	second, err := New(config)
+	assert.Nil(err)
+	assert.True(first.PublicKey().Equal(second.PublicKey()))
+	assert.Equal("local.example.com", first.KeyID())
+
+	other, err := New(&testConfig{t.TempDir(), "https://local.example.com"})
+	assert.Nil(err)
+	assert.False(first.PublicKey().Equal(other.PublicKey()))
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	local, err := New(&testConfig{t.TempDir(), "https://local.example.com"})
+	assert.Nil(err)
+
+	fetches := 0
+	remote, err := New(&testConfig{t.TempDir(), "https://remote.example.com"})
+	assert.Nil(err)
+	server := publishKey(t, remote, &fetches)
+
+	// the remote instance is reached at the test server's address
+	serverURL, _ := url.Parse(server.URL)
+	remote.localDomain = serverURL.Host
+	local.remoteScheme = "http"
+
+	t.Run("Local", func(t *testing.T) {
+		domain, err := local.Verify(signedDelivery(t, local, "body"), []byte("body"))
+		assert.Nil(err)
+		assert.Equal("local.example.com", domain)
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			domain, err := local.Verify(signedDelivery(t, remote, "body"), []byte("body"))
+			assert.Nil(err)
+			assert.Equal(serverURL.Host, domain)
+		}
+		assert.Equal(1, fetches)
+	})
+
+	t.Run("Unreachable Server", func(t *testing.T) {
+		unreachable, err := New(&testConfig{t.TempDir(), "http://127.0.0.1:1"})
+		assert.Nil(err)
+		_, err = local.Verify(signedDelivery(t, unreachable, "body"), []byte("body"))
+		assert.ErrorIs(err, model.ErrorKeyUnavailable)
+		assert.NotErrorIs(err, httpsig.ErrorUnknownKey)
+	})
+
+	t.Run("Key Endpoint Failing", func(t *testing.T) {
+		for status, want := range map[int]error{
+			http.StatusNotFound:            httpsig.ErrorUnknownKey,
+			http.StatusInternalServerError: model.ErrorKeyUnavailable,
+			http.StatusServiceUnavailable:  model.ErrorKeyUnavailable,
+		} {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(status)
+			}))
+			failingURL, _ := url.Parse(failing.URL)
+			signer, err := New(&testConfig{t.TempDir(), failing.URL})
+			assert.Nil(err)
+			signer.localDomain = failingURL.Host
+
+			_, err = local.Verify(signedDelivery(t, signer, "body"), []byte("body"))
+			assert.ErrorIs(err, want, "status %d", status)
+			failing.Close()
+		}
+	})
+
+	t.Run("Impersonation", func(t *testing.T) {
+		impostor, err := New(&testConfig{t.TempDir(), "https://local.example.com"})
+		assert.Nil(err)
+		impostor.localDomain = serverURL.Host
+		_, err = local.Verify(signedDelivery(t, impostor, "body"), []byte("body"))
+		assert.ErrorIs(err, httpsig.ErrorInvalidSignature)
+	})
+}
+
+func TestRemoteKeyCache(t *testing.T) {
+	assert := assert.New(t)
+
+	local, err := New(&testConfig{t.TempDir(), "https://local.example.com"})
+	assert.Nil(err)
+	local.maxRemoteKeys = 2
+
+	local.cacheKey("expired.example.com", local.PublicKey())
+	local.remoteKeys["expired.example.com"] = cachedKey{local.PublicKey(), time.Now().Add(-time.Second)}
+	local.cacheKey("first.example.com", local.PublicKey())
+	assert.Len(local.remoteKeys, 2)
+
+	// expired keys make way first
+	local.cacheKey("second.example.com", local.PublicKey())
+	assert.Len(local.remoteKeys, 2)
+	assert.NotContains(local.remoteKeys, "expired.example.com")
+	assert.Contains(local.remoteKeys, "second.example.com")
+
+	local.cacheKey("third.example.com", local.PublicKey())
+	assert.Len(local.remoteKeys, 2)
+	assert.Contains(local.remoteKeys, "third.example.com")
+}
@@ -0,0 +1,20 @@
+package mailer
+
+import (
+	"github.com/labstack/gommon/log"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+// service delivers verification tokens by writing them to the server log. It
+// stands in for a mail transport, so that in development a new user can be
+// verified by whoever can read the log, and never by the registrant alone.
+type service struct{}
+
+func New() (*service, error) {
+	return &service{}, nil
+}
+
+func (s *service) SendVerification(user *model.User, token string) error {
+	log.Infof("verification token for %s <%s> (%s): %s", user.Handle, user.Email, user.ID, token)
+	return nil
+}
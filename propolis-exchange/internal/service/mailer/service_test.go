@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func TestSendVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stdout)
+
+	service, err := New()
+	assert.Nil(err)
+
+	user := &model.User{ID: "3GFQNuSg3dPqDD1emxv5bqX42oxq", Handle: "alice", Email: "alice@example.com"}
+	assert.Nil(service.SendVerification(user, "token123"))
+	assert.Contains(out.String(), "alice@example.com")
+	assert.Contains(out.String(), "token123")
+}
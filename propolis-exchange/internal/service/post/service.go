@@ -1 +1,455 @@
 package post
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type Config interface {
+	store.Config
+	ServerBaseURL() string
+}
+
+const (
+	DefaultTimelineLimit int = 20
+	MaxTimelineLimit     int = 100
+)
+
+type postStore interface {
+	PutPost(post *model.PostRecord) error
+	FetchPost(id model.PostID) (*model.PostRecord, error)
+	ReplacePost(replacement *model.PostRecord) error
+	DeletePost(ids []model.PostID, tombstone string) error
+}
+
+type followingStore interface {
+	FetchFollowing(address model.UserAddress) (*model.Follow, error)
+}
+
+// Publisher sends a signed message from a local user to their audience,
+// which for direct messages is the recipients given.
+type Publisher interface {
+	Publish(sender model.UserID, id string, contentType model.ContentType, signed string, visibility model.Visibility, to []model.UserAddress) ([]*model.OutboxEntry, error)
+}
+
+type service struct {
+	config      Config
+	stores      *store.Manager
+	publisher   Publisher
+	localDomain string
+}
+
+func New(config Config, stores *store.Manager, publisher Publisher) (*service, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	return &service{
+		config:      config,
+		stores:      stores,
+		publisher:   publisher,
+		localDomain: strings.ToLower(baseURL.Host),
+	}, nil
+}
+
+// Create publishes a new post. If expiresAt is given the post stops being
+// valid then, and is dropped by every server holding it.
+func (s *service) Create(author model.UserID, privateKey crypto.Signer, post *model.Post, expiresAt *time.Time) (*model.PostRecord, error) {
+	post.Action = ""
+	post.Replaces = ""
+	post.ReplacedBy = ""
+	return s.publish(author, privateKey, post, expiresAt)
+}
+
+// Update publishes a new revision of a post, which expires along with the
+// original.
+func (s *service) Update(author model.UserID, privateKey crypto.Signer, id model.PostID, post *model.Post) (*model.PostRecord, error) {
+	post.Action = model.ActionVerbUpdate
+	post.Replaces = id
+	post.ReplacedBy = ""
+	return s.publish(author, privateKey, post, nil)
+}
+
+func (s *service) Delete(author model.UserID, privateKey crypto.Signer, id model.PostID) (*model.PostRecord, error) {
+	return s.publish(author, privateKey, &model.Post{
+		Action:   model.ActionVerbDelete,
+		Replaces: id,
+	}, nil)
+}
+
+func (s *service) Fetch(owner model.UserID, id model.PostID) (*model.PostRecord, error) {
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	return userStore.FetchPost(id)
+}
+
+// History returns every revision of the post with the given ID, oldest first.
+func (s *service) History(owner model.UserID, id model.PostID) ([]*model.PostRecord, error) {
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	return revisions(userStore, id)
+}
+
+func (s *service) Timeline(owner model.UserID, cursor *model.TimelineCursor, limit int) (*model.TimelinePage, error) {
+	if limit <= 0 {
+		limit = DefaultTimelineLimit
+	}
+	if limit > MaxTimelineLimit {
+		limit = MaxTimelineLimit
+	}
+
+	userStore, err := s.stores.ForUser(owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	posts, next, err := userStore.Timeline(s.self(owner), cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.TimelinePage{Posts: posts}
+	if next != nil {
+		page.Next = next.String()
+	}
+	return page, nil
+}
+
+func (s *service) Receive(recipient model.UserAddress, msg *message.Message, post *model.Post) error {
+	userID, _, err := recipient.Parse()
+	if err != nil {
+		return err
+	}
+	if !recipient.IsLocal(s.localDomain) {
+		return fmt.Errorf("%w: %s is not local", model.ErrorUserNotFound, recipient)
+	}
+
+	userStore, err := s.stores.ForUser(userID)
+	if err != nil {
+		return fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if err := checkActive(userStore); err != nil {
+		return err
+	}
+
+	author, err := model.UserAddress(msg.Header.KeyID).Qualified(s.localDomain)
+	if err != nil {
+		return err
+	}
+	post.Normalise()
+	if err := s.checkAudience(userStore, s.self(userID), author, post); err != nil {
+		return err
+	}
+
+	err = userStore.PutInbox(&model.InboxEntry{
+		ID:            msg.ID,
+		ReceivedAt:    time.Now().UTC(),
+		Timestamp:     msg.Header.Timestamp,
+		SenderAddress: model.UserAddress(msg.Header.KeyID),
+		ContentType:   msg.ContentType,
+		ExpiresAt:     msg.Header.Expires(),
+		Message:       msg.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("storing inbox entry: %w", err)
+	}
+
+	record := &model.PostRecord{
+		ID:            model.PostID(msg.ID),
+		CreatedAt:     time.UnixMilli(msg.Header.Timestamp).UTC(),
+		Status:        model.PostStatusReceived,
+		AuthorAddress: author,
+		ExpiresAt:     msg.Header.Expires(),
+		Message:       msg.String(),
+		Post:          *post,
+	}
+
+	err = apply(userStore, record)
+	if err != nil {
+		return fmt.Errorf("storing post: %w", err)
+	}
+
+	return nil
+}
+
+// View returns a post by a local author if the viewer, who may be nobody, is
+// in its audience. Posts that can't be seen are reported as not found.
+func (s *service) View(author model.UserID, id model.PostID, viewer model.UserID) (*model.PostRecord, error) {
+	userStore, err := s.stores.ForUser(author)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	record, err := userStore.FetchPost(id)
+	if err != nil {
+		return nil, err
+	}
+	if viewer == author {
+		return record, nil
+	}
+	// the author's store also holds posts they've received, which are theirs
+	// alone to read
+	if record.AuthorAddress != s.self(author) {
+		return nil, model.ErrorPostNotFound
+	}
+
+	switch record.Visibility {
+	case model.VisibilityPublic, model.VisibilityUnlisted:
+		return record, nil
+	case model.VisibilityFollowers:
+		if viewer == "" {
+			return nil, model.ErrorPostNotFound
+		}
+		follower, err := userStore.FetchFollower(s.self(viewer))
+		if err != nil && err != model.ErrorFollowNotFound {
+			return nil, err
+		}
+		if follower != nil && follower.Status == model.FollowStatusAccepted {
+			return record, nil
+		}
+	case model.VisibilityDirect:
+		if viewer != "" && contains(record.To, s.self(viewer)) {
+			return record, nil
+		}
+	}
+	return nil, model.ErrorPostNotFound
+}
+
+// checkAudience rejects a followers post sent to someone who doesn't follow
+// its author, or a direct post sent to someone it isn't addressed to.
+func (s *service) checkAudience(userStore followingStore, recipient, author model.UserAddress, post *model.Post) error {
+	switch post.Visibility {
+	case model.VisibilityFollowers:
+		following, err := userStore.FetchFollowing(author)
+		if err != nil && err != model.ErrorFollowNotFound {
+			return err
+		}
+		if following == nil || following.Status != model.FollowStatusAccepted {
+			return fmt.Errorf("%w: %s does not follow %s", model.ErrorNotInAudience, recipient, author)
+		}
+		return nil
+	case model.VisibilityDirect:
+		for _, to := range post.To {
+			if address, err := to.Qualified(s.localDomain); err == nil && address == recipient {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not a recipient", model.ErrorNotInAudience, recipient)
+	}
+	return nil
+}
+
+func (s *service) publish(author model.UserID, privateKey crypto.Signer, post *model.Post, expiresAt *time.Time) (*model.PostRecord, error) {
+	post.Normalise()
+	if err := post.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return nil, fmt.Errorf("%w: post expires in the past", model.ErrorInvalidPayload)
+		}
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+
+	if user.IDFromPublicKey(privateKey.Public()) != string(author) {
+		return nil, model.ErrorSenderMismatch
+	}
+
+	userStore, err := s.stores.ForUser(author)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer userStore.Close()
+
+	if err := checkActive(userStore); err != nil {
+		return nil, err
+	}
+
+	// posts are signed with the full address so that other servers can tell
+	// where to find the author's key
+	address := s.self(author)
+
+	if post.Replaces != "" {
+		// check before signing so that a bad edit doesn't leave a signed
+		// message lying around
+		original, err := target(userStore, address, post.Replaces)
+		if err != nil {
+			return nil, err
+		}
+		// every revision goes to the audience of the original, and an edit
+		// expires with it
+		post.Visibility = original.Visibility
+		post.To = original.To
+		if post.Verb() == model.ActionVerbUpdate {
+			expiresAt = original.ExpiresAt
+		}
+	}
+	for i, to := range post.To {
+		if post.To[i], err = to.Qualified(s.localDomain); err != nil {
+			return nil, err
+		}
+	}
+
+	var opts []message.Option
+	if expiresAt != nil {
+		opts = append(opts, message.WithExpiry(*expiresAt))
+	}
+	signed, id, err := message.New(post, message.Address(address), string(model.ContentTypePost), privateKey, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating message: %w", err)
+	}
+
+	record := &model.PostRecord{
+		ID:            model.PostID(id),
+		CreatedAt:     now,
+		Status:        model.PostStatusPending,
+		AuthorAddress: address,
+		ExpiresAt:     expiresAt,
+		Message:       signed,
+		Post:          *post,
+	}
+
+	err = apply(userStore, record)
+	if err != nil {
+		return nil, fmt.Errorf("storing post: %w", err)
+	}
+
+	_, err = s.publisher.Publish(author, id, model.ContentTypePost, signed, post.Visibility, post.To)
+	if err != nil {
+		return nil, fmt.Errorf("publishing post: %w", err)
+	}
+
+	return record, nil
+}
+
+// self is a local user's own address.
+func (s *service) self(userID model.UserID) model.UserAddress {
+	return model.UserAddress(string(userID) + "@" + s.localDomain)
+}
+
+func contains(addresses []model.UserAddress, address model.UserAddress) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+func checkActive(userStore interface{ Fetch() (*model.User, error) }) error {
+	user, err := userStore.Fetch()
+	if err != nil {
+		return fmt.Errorf("fetching user: %w", err)
+	}
+	return user.CheckActive(time.Now().UTC())
+}
+
+// apply stores a post record in a user store according to its verb. Edits are
+// appended to the revision chain and deletes tombstone the whole chain.
+func apply(userStore postStore, record *model.PostRecord) error {
+	switch record.Verb() {
+	case model.ActionVerbCreate:
+		return userStore.PutPost(record)
+
+	case model.ActionVerbUpdate:
+		_, err := target(userStore, record.AuthorAddress, record.Replaces)
+		if err == model.ErrorPostNotFound {
+			// we never saw the original so this revision starts our chain
+			return userStore.PutPost(record)
+		}
+		if err != nil {
+			return err
+		}
+		return userStore.ReplacePost(record)
+
+	case model.ActionVerbDelete:
+		_, err := target(userStore, record.AuthorAddress, record.Replaces)
+		if err == model.ErrorPostNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		chain, err := revisions(userStore, record.Replaces)
+		if err != nil {
+			return err
+		}
+		ids := make([]model.PostID, 0, len(chain))
+		for _, revision := range chain {
+			ids = append(ids, revision.ID)
+		}
+		return userStore.DeletePost(ids, record.Message)
+	}
+
+	return fmt.Errorf("%w: unknown action %s", model.ErrorInvalidPayload, record.Action)
+}
+
+// target fetches the post an edit or delete refers to and checks that it can
+// be acted on by the given author.
+func target(userStore postStore, author model.UserAddress, id model.PostID) (*model.PostRecord, error) {
+	original, err := userStore.FetchPost(id)
+	if err != nil {
+		return nil, err
+	}
+	if original.AuthorAddress != author {
+		return nil, model.ErrorSenderMismatch
+	}
+	if original.Status == model.PostStatusDeleted {
+		return nil, model.ErrorPostDeleted
+	}
+	if original.ReplacedBy != "" {
+		return nil, model.ErrorPostSuperseded
+	}
+	return original, nil
+}
+
+func revisions(userStore postStore, id model.PostID) ([]*model.PostRecord, error) {
+	post, err := userStore.FetchPost(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for post.Replaces != "" {
+		previous, err := userStore.FetchPost(post.Replaces)
+		if err == model.ErrorPostNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		post = previous
+	}
+
+	chain := []*model.PostRecord{post}
+	for post.ReplacedBy != "" {
+		post, err = userStore.FetchPost(post.ReplacedBy)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, post)
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,424 @@
+package post
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/message"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type testConfig struct {
+	dataDir string
+}
+
+func (c *testConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func (c *testConfig) ServerBaseURL() string {
+	return "https://local.example.com"
+}
+
+func (c *testConfig) StoreMaxOpen() int {
+	return 16
+}
+
+func (c *testConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+func newTestStores(t *testing.T, config store.ManagerConfig) *store.Manager {
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+	return stores
+}
+
+func newTestConfig(t *testing.T) *testConfig {
+	return &testConfig{t.TempDir()}
+}
+
+// testPublisher records what would have been sent to each author's audience.
+type testPublisher struct {
+	published  map[model.UserID][]string
+	visibility model.Visibility
+	to         []model.UserAddress
+}
+
+func (p *testPublisher) Publish(sender model.UserID, id string, contentType model.ContentType, signed string, visibility model.Visibility, to []model.UserAddress) ([]*model.OutboxEntry, error) {
+	p.published[sender] = append(p.published[sender], id)
+	p.visibility = visibility
+	p.to = to
+	return nil, nil
+}
+
+func newTestPublisher() *testPublisher {
+	return &testPublisher{published: map[model.UserID][]string{}}
+}
+
+func newTestUser(t *testing.T, config store.Config) (model.UserID, *ecdsa.PrivateKey) {
+	return newTestUserWithStatus(t, config, model.UserStatusActive)
+}
+
+func newTestUserWithStatus(t *testing.T, config store.Config, status model.UserStatus) (model.UserID, *ecdsa.PrivateKey) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := model.UserID(user.IDFromPublicKey(&privateKey.PublicKey))
+	userStore, err := store.NewUserStore(&model.User{
+		ID:        userID,
+		CreatedAt: time.Now().UTC(),
+		Status:    status,
+		Handle:    string(userID),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Close()
+	return userID, privateKey
+}
+
+func TestPostService(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newTestConfig(t)
+	publisher := newTestPublisher()
+	service, err := New(config, newTestStores(t, config), publisher)
+	assert.Nil(err)
+
+	author, privateKey := newTestUser(t, config)
+	_, otherKey := newTestUser(t, config)
+
+	var original, edit *model.PostRecord
+
+	t.Run("Create", func(t *testing.T) {
+		original, err = service.Create(author, privateKey, &model.Post{Content: "hello"}, nil)
+		assert.Nil(err)
+		assert.NotEmpty(original.Message)
+		assert.Equal(model.PostStatusPending, original.Status)
+		assert.Equal(model.UserAddress(string(author)+"@local.example.com"), original.AuthorAddress)
+		assert.Equal([]string{string(original.ID)}, publisher.published[author])
+
+		fetched, err := service.Fetch(author, original.ID)
+		assert.Nil(err)
+		assert.Equal("hello", fetched.Content)
+	})
+
+	t.Run("Create Inactive", func(t *testing.T) {
+		pending, pendingKey := newTestUserWithStatus(t, config, model.UserStatusPending)
+		_, err := service.Create(pending, pendingKey, &model.Post{Content: "hello"}, nil)
+		assert.ErrorIs(err, model.ErrorUserPending)
+	})
+
+	t.Run("Create Empty", func(t *testing.T) {
+		_, err := service.Create(author, privateKey, &model.Post{}, nil)
+		assert.ErrorIs(err, model.ErrorInvalidPayload)
+	})
+
+	t.Run("Create Expiring", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour)
+		record, err := service.Create(author, privateKey, &model.Post{Content: "gone soon"}, &expiresAt)
+		assert.Nil(err)
+		if assert.NotNil(record.ExpiresAt) {
+			assert.Equal(expiresAt.UnixMilli(), record.ExpiresAt.UnixMilli())
+		}
+		header, err := message.ReadHeader([]byte(record.Message))
+		assert.Nil(err)
+		assert.Equal(expiresAt.UnixMilli(), header.ExpiresAt)
+
+		edit, err := service.Update(author, privateKey, record.ID, &model.Post{Content: "still going soon"})
+		assert.Nil(err)
+		if assert.NotNil(edit.ExpiresAt) {
+			assert.Equal(expiresAt.UnixMilli(), edit.ExpiresAt.UnixMilli())
+		}
+
+		past := time.Now().Add(-time.Minute)
+		_, err = service.Create(author, privateKey, &model.Post{Content: "too late"}, &past)
+		assert.ErrorIs(err, model.ErrorInvalidPayload)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		edit, err = service.Update(author, privateKey, original.ID, &model.Post{Content: "hello again"})
+		assert.Nil(err)
+		assert.Equal(original.ID, edit.Replaces)
+
+		fetched, err := service.Fetch(author, original.ID)
+		assert.Nil(err)
+		assert.Equal(edit.ID, fetched.ReplacedBy)
+	})
+
+	t.Run("Update Superseded", func(t *testing.T) {
+		_, err := service.Update(author, privateKey, original.ID, &model.Post{Content: "too late"})
+		assert.ErrorIs(err, model.ErrorPostSuperseded)
+	})
+
+	t.Run("History", func(t *testing.T) {
+		for _, id := range []model.PostID{original.ID, edit.ID} {
+			history, err := service.History(author, id)
+			assert.Nil(err)
+			if assert.Len(history, 2) {
+				assert.Equal(original.ID, history[0].ID)
+				assert.Equal(edit.ID, history[1].ID)
+			}
+		}
+	})
+
+	t.Run("Delete Wrong Author", func(t *testing.T) {
+		_, err := service.Delete(author, otherKey, edit.ID)
+		assert.ErrorIs(err, model.ErrorSenderMismatch)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		deleted, err := service.Delete(author, privateKey, edit.ID)
+		assert.Nil(err)
+
+		history, err := service.History(author, edit.ID)
+		assert.Nil(err)
+		for _, revision := range history {
+			assert.Equal(model.PostStatusDeleted, revision.Status)
+			assert.Empty(revision.Content)
+			assert.Equal(deleted.Message, revision.Message)
+		}
+
+		_, err = service.Update(author, privateKey, edit.ID, &model.Post{Content: "back from the dead"})
+		assert.ErrorIs(err, model.ErrorPostDeleted)
+	})
+}
+
+func TestTimeline(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newTestConfig(t)
+	service, err := New(config, newTestStores(t, config), newTestPublisher())
+	assert.Nil(err)
+
+	owner, privateKey := newTestUser(t, config)
+	remote, remoteKey := newTestUser(t, config)
+
+	ids := []model.PostID{}
+	for i := 0; i < 4; i++ {
+		record, err := service.Create(owner, privateKey, &model.Post{Content: "post"}, nil)
+		assert.Nil(err)
+		ids = append(ids, record.ID)
+		// keep timestamps distinct so positions are deterministic
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	signed, _, err := message.New(&model.Post{Content: "remote post"}, message.Address(remote), string(model.ContentTypePost), remoteKey)
+	assert.Nil(err)
+	msg, err := message.Parse([]byte(signed), func(header *message.Header) (crypto.PublicKey, error) {
+		return &remoteKey.PublicKey, nil
+	})
+	assert.Nil(err)
+	assert.Nil(service.Receive(model.UserAddress(owner), msg, &model.Post{Content: "remote post"}))
+	ids = append(ids, model.PostID(msg.ID))
+
+	page := func(cursor string) *model.TimelinePage {
+		var parsed *model.TimelineCursor
+		if cursor != "" {
+			parsed, err = model.ParseTimelineCursor(cursor)
+			assert.Nil(err)
+		}
+		page, err := service.Timeline(owner, parsed, 2)
+		assert.Nil(err)
+		return page
+	}
+
+	t.Run("Paginate", func(t *testing.T) {
+		seen := []model.PostID{}
+		cursor := ""
+		for {
+			p := page(cursor)
+			assert.LessOrEqual(len(p.Posts), 2)
+			for _, post := range p.Posts {
+				seen = append(seen, post.ID)
+			}
+			if p.Next == "" {
+				break
+			}
+			cursor = p.Next
+		}
+		assert.ElementsMatch(ids, seen)
+		assert.Equal(model.PostID(msg.ID), seen[0])
+	})
+
+	t.Run("Edit Keeps Position", func(t *testing.T) {
+		edit, err := service.Update(owner, privateKey, ids[0], &model.Post{Content: "edited"})
+		assert.Nil(err)
+
+		all, err := service.Timeline(owner, nil, MaxTimelineLimit)
+		assert.Nil(err)
+		assert.Len(all.Posts, len(ids))
+		assert.Equal(edit.ID, all.Posts[len(all.Posts)-1].ID)
+
+		_, err = service.Delete(owner, privateKey, edit.ID)
+		assert.Nil(err)
+
+		all, err = service.Timeline(owner, nil, MaxTimelineLimit)
+		assert.Nil(err)
+		assert.Len(all.Posts, len(ids)-1)
+	})
+
+	t.Run("Invalid Cursor", func(t *testing.T) {
+		_, err := model.ParseTimelineCursor("not a cursor")
+		assert.ErrorIs(err, model.ErrorInvalidCursor)
+	})
+}
+
+func TestVisibility(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newTestConfig(t)
+	stores := newTestStores(t, config)
+	publisher := newTestPublisher()
+	service, err := New(config, stores, publisher)
+	assert.Nil(err)
+
+	author, authorKey := newTestUser(t, config)
+	follower, _ := newTestUser(t, config)
+	stranger, _ := newTestUser(t, config)
+	address := func(userID model.UserID) model.UserAddress {
+		return model.UserAddress(string(userID) + "@local.example.com")
+	}
+
+	// follower follows author, as recorded at both ends
+	authorStore, err := stores.ForUser(author)
+	assert.Nil(err)
+	assert.Nil(authorStore.PutFollower(&model.Follow{Address: address(follower), Status: model.FollowStatusAccepted, CreatedAt: time.Now().UTC()}))
+	authorStore.Close()
+	followerStore, err := stores.ForUser(follower)
+	assert.Nil(err)
+	assert.Nil(followerStore.PutFollowing(&model.Follow{Address: address(author), Status: model.FollowStatusAccepted, CreatedAt: time.Now().UTC()}))
+	followerStore.Close()
+
+	posts := map[model.Visibility]*model.PostRecord{}
+
+	t.Run("Publish", func(t *testing.T) {
+		for _, visibility := range []model.Visibility{model.VisibilityPublic, model.VisibilityUnlisted, model.VisibilityFollowers} {
+			record, err := service.Create(author, authorKey, &model.Post{Content: "hello " + string(visibility), Visibility: visibility}, nil)
+			assert.Nil(err)
+			assert.Equal(visibility, publisher.visibility)
+			assert.Empty(publisher.to)
+			posts[visibility] = record
+		}
+
+		record, err := service.Create(author, authorKey, &model.Post{Content: "hello", Visibility: model.VisibilityDirect, To: model.Recipients{model.UserAddress(stranger)}}, nil)
+		assert.Nil(err)
+		assert.Equal(model.VisibilityDirect, publisher.visibility)
+		assert.Equal([]model.UserAddress{address(stranger)}, publisher.to)
+		posts[model.VisibilityDirect] = record
+
+		record, err = service.Create(author, authorKey, &model.Post{Content: "hello again"}, nil)
+		assert.Nil(err)
+		assert.Equal(model.VisibilityPublic, record.Visibility)
+	})
+
+	t.Run("Publish Invalid", func(t *testing.T) {
+		for _, post := range []*model.Post{
+			{Content: "hello", Visibility: model.VisibilityDirect},
+			{Content: "hello", Visibility: model.VisibilityFollowers, To: model.Recipients{address(stranger)}},
+			{Content: "hello", Visibility: "friends"},
+		} {
+			_, err := service.Create(author, authorKey, post, nil)
+			assert.ErrorIs(err, model.ErrorInvalidPayload)
+		}
+	})
+
+	t.Run("Edit Keeps Audience", func(t *testing.T) {
+		edit, err := service.Update(author, authorKey, posts[model.VisibilityFollowers].ID, &model.Post{Content: "edited", Visibility: model.VisibilityPublic})
+		assert.Nil(err)
+		assert.Equal(model.VisibilityFollowers, edit.Visibility)
+		assert.Equal(model.VisibilityFollowers, publisher.visibility)
+	})
+
+	t.Run("View", func(t *testing.T) {
+		// who can see each post, nobody included
+		audiences := map[model.Visibility]map[model.UserID]bool{
+			model.VisibilityPublic:    {"": true, author: true, follower: true, stranger: true},
+			model.VisibilityUnlisted:  {"": true, author: true, follower: true, stranger: true},
+			model.VisibilityFollowers: {author: true, follower: true},
+			model.VisibilityDirect:    {author: true, stranger: true},
+		}
+		for visibility, audience := range audiences {
+			for _, viewer := range []model.UserID{"", author, follower, stranger} {
+				_, err := service.View(author, posts[visibility].ID, viewer)
+				if audience[viewer] {
+					assert.Nil(err, "%s post viewed by %q", visibility, viewer)
+				} else {
+					assert.ErrorIs(err, model.ErrorPostNotFound, "%s post viewed by %q", visibility, viewer)
+				}
+			}
+		}
+	})
+
+	receive := func(recipient model.UserID, post *model.Post) (model.PostID, error) {
+		signed, id, err := message.New(post, message.Address(address(author)), string(model.ContentTypePost), authorKey)
+		assert.Nil(err)
+		msg, err := message.Parse([]byte(signed), func(header *message.Header) (crypto.PublicKey, error) {
+			return &authorKey.PublicKey, nil
+		})
+		assert.Nil(err)
+		return model.PostID(id), service.Receive(address(recipient), msg, post)
+	}
+
+	t.Run("Receive", func(t *testing.T) {
+		_, err := receive(stranger, &model.Post{Content: "hello", Visibility: model.VisibilityPublic})
+		assert.Nil(err)
+		_, err = receive(stranger, &model.Post{Content: "hello", Visibility: model.VisibilityUnlisted})
+		assert.Nil(err)
+		_, err = receive(follower, &model.Post{Content: "hello", Visibility: model.VisibilityFollowers})
+		assert.Nil(err)
+		_, err = receive(stranger, &model.Post{Content: "hello", Visibility: model.VisibilityFollowers})
+		assert.ErrorIs(err, model.ErrorNotInAudience)
+		_, err = receive(stranger, &model.Post{Content: "hello", Visibility: model.VisibilityDirect, To: model.Recipients{address(stranger)}})
+		assert.Nil(err)
+		_, err = receive(follower, &model.Post{Content: "hello", Visibility: model.VisibilityDirect, To: model.Recipients{address(stranger)}})
+		assert.ErrorIs(err, model.ErrorNotInAudience)
+	})
+
+	t.Run("Received Posts Are Private", func(t *testing.T) {
+		id, err := receive(stranger, &model.Post{Content: "hello again", Visibility: model.VisibilityPublic})
+		assert.Nil(err)
+		_, err = service.View(stranger, id, stranger)
+		assert.Nil(err)
+		_, err = service.View(stranger, id, follower)
+		assert.ErrorIs(err, model.ErrorPostNotFound)
+	})
+
+	t.Run("Timeline", func(t *testing.T) {
+		page, err := service.Timeline(follower, nil, MaxTimelineLimit)
+		assert.Nil(err)
+		assert.Len(page.Posts, 1)
+
+		// followers posts already received are hidden again after unfollowing
+		followerStore, err := stores.ForUser(follower)
+		assert.Nil(err)
+		assert.Nil(followerStore.DeleteFollowing(address(author)))
+		followerStore.Close()
+
+		page, err = service.Timeline(follower, nil, MaxTimelineLimit)
+		assert.Nil(err)
+		assert.Empty(page.Posts)
+
+		// but authors always see their own
+		page, err = service.Timeline(author, nil, MaxTimelineLimit)
+		assert.Nil(err)
+		visibilities := map[model.Visibility]bool{}
+		for _, post := range page.Posts {
+			visibilities[post.Visibility] = true
+		}
+		assert.Len(visibilities, 4)
+	})
+}
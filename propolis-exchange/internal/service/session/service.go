@@ -0,0 +1,186 @@
+package session
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+const tokenSize int = 32
+
+type Config interface {
+	SessionIdleTimeout() time.Duration
+	SessionSweepInterval() time.Duration
+}
+
+type entry struct {
+	session    model.Session
+	privateKey crypto.Signer
+}
+
+// service is the session keyring. It holds the unlocked signing key of each
+// logged in user in memory only, and wipes it when the session ends.
+type service struct {
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	sessions    map[string]*entry
+	done        chan struct{}
+	once        sync.Once
+	wg          sync.WaitGroup
+}
+
+func New(config Config) (*service, error) {
+	s := &service{
+		idleTimeout: config.SessionIdleTimeout(),
+		sessions:    map[string]*entry{},
+		done:        make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.sweep(config.SessionSweepInterval())
+
+	return s, nil
+}
+
+func (s *service) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, e := range s.sessions {
+		s.end(token, e)
+	}
+	return nil
+}
+
+func (s *service) Open(userID model.UserID, privateKey crypto.Signer) (*model.Session, error) {
+	tokenBytes := make([]byte, tokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, fmt.Errorf("generating session token: %w", err)
+	}
+
+	now := time.Now().UTC()
+	e := &entry{
+		session: model.Session{
+			Token:     base64.RawURLEncoding.EncodeToString(tokenBytes),
+			UserID:    userID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(s.idleTimeout),
+		},
+		privateKey: privateKey,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[e.session.Token] = e
+
+	session := e.session
+	return &session, nil
+}
+
+// Lookup returns the session for a token along with the user's signing key,
+// and pushes back the idle expiry.
+func (s *service) Lookup(token string) (*model.Session, crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[token]
+	if !ok {
+		return nil, nil, model.ErrorSessionNotFound
+	}
+
+	now := time.Now().UTC()
+	if !now.Before(e.session.ExpiresAt) {
+		s.end(token, e)
+		return nil, nil, model.ErrorSessionNotFound
+	}
+	e.session.ExpiresAt = now.Add(s.idleTimeout)
+
+	session := e.session
+	return &session, e.privateKey, nil
+}
+
+func (s *service) End(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[token]
+	if !ok {
+		return model.ErrorSessionNotFound
+	}
+	s.end(token, e)
+	return nil
+}
+
+// EndForUser ends every session belonging to a user.
+func (s *service) EndForUser(userID model.UserID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, e := range s.sessions {
+		if e.session.UserID == userID {
+			s.end(token, e)
+		}
+	}
+	return nil
+}
+
+// end must be called with the lock held.
+func (s *service) end(token string, e *entry) {
+	delete(s.sessions, token)
+	zeroKey(e.privateKey)
+}
+
+func (s *service) sweep(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			s.mu.Lock()
+			for token, e := range s.sessions {
+				if !now.Before(e.session.ExpiresAt) {
+					s.end(token, e)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// zeroKey overwrites the private key in place, the scalar of an ECDSA key or
+// the seed and public half of an Ed25519 one. Callers that still hold the key
+// afterwards are left with an unusable key rather than a live one.
+func zeroKey(privateKey crypto.Signer) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if key == nil || key.D == nil {
+			return
+		}
+		words := key.D.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		key.D.SetInt64(0)
+	case ed25519.PrivateKey:
+		for i := range key {
+			key[i] = 0
+		}
+	}
+}
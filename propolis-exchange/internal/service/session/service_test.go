@@ -0,0 +1,122 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type testConfig struct {
+	idleTimeout time.Duration
+}
+
+func (c *testConfig) SessionIdleTimeout() time.Duration {
+	return c.idleTimeout
+}
+
+func (c *testConfig) SessionSweepInterval() time.Duration {
+	return 5 * time.Millisecond
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+func TestSessions(t *testing.T) {
+	t.Run("Lookup And End", func(t *testing.T) {
+		assert := assert.New(t)
+		service, err := New(&testConfig{time.Minute})
+		assert.Nil(err)
+		defer service.Close()
+
+		privateKey := newTestKey(t)
+		session, err := service.Open("user1", privateKey)
+		assert.Nil(err)
+		assert.NotEmpty(session.Token)
+
+		found, key, err := service.Lookup(session.Token)
+		assert.Nil(err)
+		assert.Equal(model.UserID("user1"), found.UserID)
+		assert.Same(privateKey, key)
+
+		assert.Nil(service.End(session.Token))
+		assert.Zero(privateKey.D.Sign())
+
+		_, _, err = service.Lookup(session.Token)
+		assert.ErrorIs(err, model.ErrorSessionNotFound)
+	})
+
+	t.Run("Ed25519 Key", func(t *testing.T) {
+		assert := assert.New(t)
+		service, err := New(&testConfig{time.Minute})
+		assert.Nil(err)
+		defer service.Close()
+
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(err)
+		session, err := service.Open("user1", privateKey)
+		assert.Nil(err)
+
+		assert.Nil(service.End(session.Token))
+		assert.Equal(make(ed25519.PrivateKey, ed25519.PrivateKeySize), privateKey)
+	})
+
+	t.Run("Idle Expiry", func(t *testing.T) {
+		assert := assert.New(t)
+		service, err := New(&testConfig{30 * time.Millisecond})
+		assert.Nil(err)
+		defer service.Close()
+
+		privateKey := newTestKey(t)
+		session, err := service.Open("user1", privateKey)
+		assert.Nil(err)
+
+		// activity keeps the session alive past the idle timeout
+		for i := 0; i < 4; i++ {
+			time.Sleep(10 * time.Millisecond)
+			_, _, err = service.Lookup(session.Token)
+			assert.Nil(err)
+		}
+
+		// the sweeper zeroes the key under the service lock
+		assert.Eventually(func() bool {
+			service.mu.Lock()
+			defer service.mu.Unlock()
+			return privateKey.D.Sign() == 0
+		}, time.Second, 5*time.Millisecond)
+		_, _, err = service.Lookup(session.Token)
+		assert.ErrorIs(err, model.ErrorSessionNotFound)
+	})
+
+	t.Run("End For User", func(t *testing.T) {
+		assert := assert.New(t)
+		service, err := New(&testConfig{time.Minute})
+		assert.Nil(err)
+		defer service.Close()
+
+		first, err := service.Open("user1", newTestKey(t))
+		assert.Nil(err)
+		second, err := service.Open("user1", newTestKey(t))
+		assert.Nil(err)
+		other, err := service.Open("user2", newTestKey(t))
+		assert.Nil(err)
+
+		assert.Nil(service.EndForUser("user1"))
+		_, _, err = service.Lookup(first.Token)
+		assert.ErrorIs(err, model.ErrorSessionNotFound)
+		_, _, err = service.Lookup(second.Token)
+		assert.ErrorIs(err, model.ErrorSessionNotFound)
+		_, _, err = service.Lookup(other.Token)
+		assert.Nil(err)
+	})
+}
@@ -3,21 +3,28 @@ package user
 import (
 	"fmt"
 	"os"
-	"path"
 	"testing"
+
+	"uk.co.dudmesh.propolis/internal/store/storetest"
 )
 
 func TestMain(m *testing.M) {
-	dataDir := os.Getenv("DATA_DIR")
-	files, err := os.ReadDir(dataDir)
+	dataDir, err := os.MkdirTemp("", "propolis-user-test")
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
+	os.Setenv("DATA_DIR", dataDir)
 
-	for _, file := range files {
-		fmt.Println(path.Join(dataDir, file.Name()))
-		os.Remove(path.Join(dataDir, file.Name()))
+	databaseURL, cleanup, err := storetest.DatabaseURL()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	os.Setenv("DATABASE_URL", databaseURL)
 
-	os.Exit(m.Run())
+	code := m.Run()
+	cleanup()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
 }
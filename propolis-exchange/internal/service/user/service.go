@@ -1,19 +1,25 @@
 package user
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
-	"github.com/rakutentech/jwk-go/jwk"
+	"github.com/labstack/gommon/log"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -32,89 +38,428 @@ const (
 	PEMPrivateKeyHeader string = "PRIVATE KEY"
 )
 
+const remoteRequestTimeout time.Duration = 10 * time.Second
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
 type Config interface {
 	store.Config
+	store.PublicKeyCacheConfig
+	store.DirectoryConfig
+	ServerBaseURL() string
+	LoginMaxAttempts() int
+	LoginLockoutDuration() time.Duration
 }
 
 type Database interface {
 	CreateUser(user *model.User) error
 }
 
+type userStore interface {
+	Close() error
+	Fetch() (*model.User, error)
+	UpdateStatus(status model.UserStatus, lockedUntil *time.Time) error
+	UpdateCredentials(previous *model.User, password, privateKey, recoveryKey string) error
+}
+
+type Directory interface {
+	Register(entry *model.DirectoryEntry) error
+	Unregister(userID model.UserID) error
+	Fetch(userID model.UserID) (*model.DirectoryEntry, error)
+	FetchByHandle(handle string) (*model.DirectoryEntry, error)
+	UpdateStatus(userID model.UserID, status model.UserStatus) error
+	List(after model.UserID, limit int) ([]*model.DirectoryEntry, error)
+	Close() error
+}
+
+// Mailer delivers the verification token to the email address a user
+// registered with, so that the account stays pending until someone who can
+// read that mailbox verifies it.
+type Mailer interface {
+	SendVerification(user *model.User, token string) error
+}
+
 type PublicKeyCache interface {
-	Get(userID model.UserID) (*ecdsa.PublicKey, error)
-	Set(userID model.UserID, key *ecdsa.PublicKey) error
+	Get(userID model.UserID) (crypto.PublicKey, error)
+	Set(userID model.UserID, key crypto.PublicKey) error
 	Close() error
 }
 
 type service struct {
 	config         Config
 	publicKeyCache PublicKeyCache
+	directory      Directory
+	stores         *store.Manager
+	mailer         Mailer
+	localDomain    string
+	remoteScheme   string
+	client         *http.Client
 }
 
-func New(config Config) (*service, error) {
-	cache, err := store.NewPublicKeyCache()
+func New(config Config, stores *store.Manager, mailer Mailer) (*service, error) {
+	baseURL, err := url.Parse(config.ServerBaseURL())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	cache, err := store.NewPublicKeyCache(config)
 	if err != nil {
 		return nil, fmt.Errorf("creating public key cache: %w", err)
 	}
+	directory, err := store.NewDirectory(config)
+	if err != nil {
+		cache.Close()
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
 	return &service{
 		config:         config,
 		publicKeyCache: cache,
+		directory:      directory,
+		stores:         stores,
+		mailer:         mailer,
+		localDomain:    strings.ToLower(baseURL.Host),
+		remoteScheme:   "https",
+		client:         &http.Client{Timeout: remoteRequestTimeout},
 	}, nil
 }
 
 func (s *service) Close() error {
-	return s.publicKeyCache.Close()
+	return errors.Join(s.directory.Close(), s.publicKeyCache.Close())
 }
 
-func (s *service) Create(params *model.CreateUserParams) (*model.User, error) {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// Create generates a key pair for a new user and stores them as pending. The
+// verification token that activates the account via Verify is sent through
+// the mailer rather than returned. The handle and email are normalised and
+// must not already be registered.
+func (s *service) Create(params *model.CreateUserParams) (*model.CreateUserResult, error) {
+	params.Normalise()
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	privateKey, err := generateKey(params.Algorithm)
 	if err != nil {
 		return nil, fmt.Errorf("generating public/private key pair: %w", err)
 	}
-	publicKey := privateKey.PublicKey
+	publicKey := privateKey.Public()
 
-	userID := model.UserID(user.IDFromPublicKey(&publicKey))
+	userID := model.UserID(user.IDFromPublicKey(publicKey))
 
 	privateKeyEnc, err := crypt.EncodePrivatekey(privateKey, string(userID), params.Password)
 	if err != nil {
 		return nil, fmt.Errorf("encrypting private key: %w", err)
 	}
 
-	publicKeyEnc, err := crypt.EncodePublicKey(&publicKey, string(userID))
+	publicKeyEnc, err := crypt.EncodePublicKey(publicKey, string(userID))
 	if err != nil {
 		return nil, fmt.Errorf("encoding public key: %w", err)
 	}
 
-	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(params.Password), 10)
+	encodedPassword, err := hashPassword(params.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryKey, err := newRecoveryKey()
+	if err != nil {
+		return nil, fmt.Errorf("generating recovery key: %w", err)
+	}
+	recoveryKeyEnc, err := crypt.EncodePrivatekey(privateKey, string(userID), recoveryKey)
 	if err != nil {
-		return nil, fmt.Errorf("generating encoded password: %w", err)
+		return nil, fmt.Errorf("encrypting private key with recovery key: %w", err)
+	}
+
+	verificationToken, err := newToken()
+	if err != nil {
+		return nil, fmt.Errorf("generating verification token: %w", err)
 	}
-	encodedPassword := base64.StdEncoding.EncodeToString(passwordBytes)
 
 	user := &model.User{
-		ID:         userID,
-		CreatedAt:  time.Now().UTC(),
-		Status:     model.UserStatusActive,
-		Handle:     params.Handle,
-		Email:      params.Email,
-		Password:   encodedPassword,
-		PublicKey:  publicKeyEnc,
-		PrivateKey: privateKeyEnc,
+		ID:                userID,
+		CreatedAt:         time.Now().UTC(),
+		Status:            model.UserStatusPending,
+		Handle:            params.Handle,
+		Email:             params.Email,
+		Password:          encodedPassword,
+		PublicKey:         publicKeyEnc,
+		PrivateKey:        privateKeyEnc,
+		VerificationToken: hashToken(verificationToken),
+		RecoveryKey:       recoveryKeyEnc,
 	}
 
-	store, err := store.NewUserStore(user, s.config)
+	err = s.directory.Register(&model.DirectoryEntry{
+		UserID:    userID,
+		Handle:    user.Handle,
+		Email:     user.Email,
+		Status:    user.Status,
+		Location:  store.Location(userID),
+		CreatedAt: user.CreatedAt,
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	store, err := s.stores.Create(user)
+	if err != nil {
+		if err := s.directory.Unregister(userID); err != nil {
+			log.Warnf("removing directory entry for %s: %+v", userID, err)
+		}
 		return nil, fmt.Errorf("creating userstore: %w", err)
 	}
 	defer store.Close()
 
-	s.publicKeyCache.Set(userID, &publicKey)
+	if err := s.publicKeyCache.Set(userID, publicKey); err != nil {
+		log.Warnf("caching public key for %s: %+v", userID, err)
+	}
 
-	return user, nil
+	if err := s.mailer.SendVerification(user, verificationToken); err != nil {
+		return nil, fmt.Errorf("sending verification token: %w", err)
+	}
+
+	return &model.CreateUserResult{User: user, RecoveryKey: recoveryKey}, nil
+}
+
+// ChangePassword re-encrypts the private key under a new password. The
+// recovery key copy is left alone.
+func (s *service) ChangePassword(params *model.ChangePasswordParams) (*model.User, error) {
+	store, user, err := s.localUser(params.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if err := user.CheckActive(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := checkPassword(user, params.OldPassword); err != nil {
+		return nil, err
+	}
+
+	privateKey, err := privateKeyFromUser(user, params.OldPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPassword, err := hashPassword(params.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyEnc, err := crypt.EncodePrivatekey(privateKey, string(user.ID), params.NewPassword)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting private key: %w", err)
+	}
+
+	err = store.UpdateCredentials(user, encodedPassword, privateKeyEnc, user.RecoveryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Fetch()
+}
+
+// ResetPassword sets a new password using the recovery key in place of the
+// old password. The recovery key is single use, so a fresh one is issued.
+func (s *service) ResetPassword(params *model.ResetPasswordParams) (*model.ResetPasswordResult, error) {
+	store, user, err := s.localUser(params.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if user.Status == model.UserStatusPending || user.Status == model.UserStatusDeleted {
+		return nil, user.CheckActive(time.Now().UTC())
+	}
+	if user.RecoveryKey == "" || params.RecoveryKey == "" {
+		return nil, model.ErrorInvalidRecoveryKey
+	}
+
+	privateKey, err := crypt.DecodePrivateKey(user.RecoveryKey, string(user.ID), params.RecoveryKey)
+	if err != nil {
+		if errors.Is(err, crypt.ErrorIncorrectPassword) {
+			return nil, model.ErrorInvalidRecoveryKey
+		}
+		return nil, fmt.Errorf("decrypting private key with recovery key: %w", err)
+	}
+
+	encodedPassword, err := hashPassword(params.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyEnc, err := crypt.EncodePrivatekey(privateKey, string(user.ID), params.NewPassword)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting private key: %w", err)
+	}
+
+	recoveryKey, err := newRecoveryKey()
+	if err != nil {
+		return nil, fmt.Errorf("generating recovery key: %w", err)
+	}
+	recoveryKeyEnc, err := crypt.EncodePrivatekey(privateKey, string(user.ID), recoveryKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting private key with recovery key: %w", err)
+	}
+
+	err = store.UpdateCredentials(user, encodedPassword, privateKeyEnc, recoveryKeyEnc)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = store.Fetch()
+	if err != nil {
+		return nil, fmt.Errorf("fetching user: %w", err)
+	}
+
+	return &model.ResetPasswordResult{User: user, RecoveryKey: recoveryKey}, nil
+}
+
+func (s *service) Verify(params *model.VerifyUserParams) (*model.User, error) {
+	return s.transition(params.Address, model.UserStatusActive, func(user *model.User) error {
+		if user.Status != model.UserStatusPending {
+			return model.ErrorInvalidStatusTransition
+		}
+		if subtle.ConstantTimeCompare([]byte(user.VerificationToken), []byte(hashToken(params.Token))) != 1 {
+			return model.ErrorInvalidVerificationToken
+		}
+		return nil
+	})
+}
+
+// Unlock lifts a lockout before it runs out.
+func (s *service) Unlock(address model.UserAddress) (*model.User, error) {
+	return s.transition(address, model.UserStatusActive, func(user *model.User) error {
+		if user.Status != model.UserStatusLocked {
+			return model.ErrorInvalidStatusTransition
+		}
+		return nil
+	})
+}
+
+// Delete soft deletes a user. Their store is kept but they can no longer log
+// in, sign or receive messages.
+func (s *service) Delete(address model.UserAddress) (*model.User, error) {
+	return s.transition(address, model.UserStatusDeleted, nil)
+}
+
+// localUser opens the store for a local address and fetches the user. The
+// caller must close the store.
+func (s *service) localUser(address model.UserAddress) (userStore, *model.User, error) {
+	userID, _, err := address.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !address.IsLocal(s.localDomain) {
+		return nil, nil, model.ErrorUserNotFound
+	}
+
+	store, err := s.stores.ForUser(userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading userstore: %w", err)
+	}
+
+	user, err := store.Fetch()
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("fetching user: %w", err)
+	}
+
+	return store, user, nil
+}
+
+func (s *service) transition(address model.UserAddress, status model.UserStatus, check func(user *model.User) error) (*model.User, error) {
+	store, user, err := s.localUser(address)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if check != nil {
+		if err := check(user); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.updateStatus(store, user.ID, status, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Fetch()
+}
+
+// updateStatus changes the status in the user's store and then mirrors it to
+// the directory. The store is authoritative, so a directory failure is only
+// logged; the admin directory-sync command repairs any drift.
+func (s *service) updateStatus(store userStore, userID model.UserID, status model.UserStatus, lockedUntil *time.Time) error {
+	err := store.UpdateStatus(status, lockedUntil)
+	if err != nil {
+		return err
+	}
+	if err := s.directory.UpdateStatus(userID, status); err != nil {
+		log.Warnf("updating directory status for %s: %+v", userID, err)
+	}
+	return nil
+}
+
+// FetchByHandle finds a local user through the directory.
+func (s *service) FetchByHandle(handle string) (*model.User, error) {
+	entry, err := s.directory.FetchByHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	return s.Fetch(entry.UserID)
+}
+
+// Lookup finds a local user by an address made of either their handle or
+// their ID, so that other servers can discover them. Users that are pending or
+// deleted aren't found.
+func (s *service) Lookup(address model.UserAddress) (*model.DirectoryEntry, error) {
+	name, _, err := address.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if !address.IsLocal(s.localDomain) {
+		return nil, model.ErrorUserNotFound
+	}
+
+	entry, err := s.directory.FetchByHandle(string(name))
+	if errors.Is(err, model.ErrorUserNotFound) {
+		entry, err = s.directory.Fetch(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Status != model.UserStatusActive && entry.Status != model.UserStatusLocked {
+		return nil, model.ErrorUserNotFound
+	}
+	return entry, nil
+}
+
+// List pages through the directory in user ID order.
+func (s *service) List(after model.UserID, limit int) (*model.DirectoryPage, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	entries, err := s.directory.List(after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.DirectoryPage{Users: entries}
+	if len(entries) == limit {
+		page.Next = entries[len(entries)-1].UserID
+	}
+	return page, nil
 }
 
 func (s *service) Fetch(userID model.UserID) (*model.User, error) {
-	store, err := store.ForUser(userID, s.config)
+	store, err := s.stores.ForUser(userID)
 	if err != nil {
 		return nil, fmt.Errorf("loading userstore: %w", err)
 	}
@@ -128,79 +473,269 @@ func (s *service) Fetch(userID model.UserID) (*model.User, error) {
 	return user, nil
 }
 
-func (s *service) PublicKeyFor(address model.UserAddress) (*ecdsa.PublicKey, error) {
-	// TODO, handle remote addresses
-	userID := model.UserID(address)
-	key, err := s.publicKeyCache.Get(userID)
+// Authenticate checks a user's password and unlocks their signing key. Failed
+// attempts are counted against the user and reset by a successful login.
+func (s *service) Authenticate(params *model.LoginParams) (*model.User, crypto.Signer, error) {
+	userID, _, err := params.Address.Parse()
+	if err != nil || !params.Address.IsLocal(s.localDomain) {
+		return nil, nil, model.ErrorInvalidUsernameOrPassword
+	}
+
+	store, err := s.stores.ForUser(userID)
 	if err != nil {
-		if err == model.ErrorUserNotFound {
-			store, err := store.ForUser(userID, s.config)
-			if err != nil {
-				return nil, fmt.Errorf("loading userstore: %w", err)
-			}
-			defer store.Close()
+		if errors.Is(err, model.ErrorUserNotFound) {
+			return nil, nil, model.ErrorInvalidUsernameOrPassword
+		}
+		return nil, nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer store.Close()
+
+	user, err := store.Fetch()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching user: %w", err)
+	}
 
-			user, err := store.Fetch()
-			if err != nil {
-				return nil, fmt.Errorf("fetching user: %w", err)
+	now := time.Now().UTC()
+	if err := user.CheckActive(now); err != nil {
+		return nil, nil, err
+	}
+
+	err = checkPassword(user, params.Password)
+	if err != nil {
+		if err != model.ErrorInvalidUsernameOrPassword {
+			return nil, nil, err
+		}
+		attempts, err := store.RecordFailedLogin()
+		if err != nil {
+			return nil, nil, err
+		}
+		if attempts >= s.config.LoginMaxAttempts() {
+			if user.Status == model.UserStatusLocked {
+				// the previous lock ran out, so start a fresh one
+				if err := s.updateStatus(store, userID, model.UserStatusActive, nil); err != nil {
+					return nil, nil, err
+				}
 			}
-			key, err := publicKeyFromUser(user)
-			if err != nil {
-				return nil, fmt.Errorf("getting public key from user: %w", err)
+			lockedUntil := now.Add(s.config.LoginLockoutDuration())
+			if err := s.updateStatus(store, userID, model.UserStatusLocked, &lockedUntil); err != nil {
+				return nil, nil, err
 			}
-			s.publicKeyCache.Set(userID, key)
+			return nil, nil, model.ErrorUserLocked
+		}
+		return nil, nil, model.ErrorInvalidUsernameOrPassword
+	}
+
+	privateKey, err := privateKeyFromUser(user, params.Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unlocking private key: %w", err)
+	}
+
+	if crypt.NeedsUpgrade(user.PrivateKey) {
+		// only login sees the plaintext password, so this is where old key
+		// encryptions get moved to the current KDF
+		upgraded, err := crypt.EncodePrivatekey(privateKey, string(user.ID), params.Password)
+		if err == nil {
+			err = store.UpdateCredentials(user, user.Password, upgraded, user.RecoveryKey)
+		}
+		if err != nil {
+			log.Warnf("upgrading private key encryption for %s: %+v", user.ID, err)
+		} else {
+			user.PrivateKey = upgraded
 		}
+	}
+
+	if user.Status == model.UserStatusLocked {
+		err = s.updateStatus(store, userID, model.UserStatusActive, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		user.Status = model.UserStatusActive
+		user.LockedUntil = nil
+	}
+
+	err = store.RecordLogin(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	user.LastLoggedInAt = &now
+	user.LoginAttempts = 0
+
+	return user, privateKey, nil
+}
+
+// LocalPublicKey gives the key of a local user, for serving to other servers.
+// Remote addresses aren't found, so that callers can't make this server fetch
+// keys from wherever they like.
+func (s *service) LocalPublicKey(address model.UserAddress) (crypto.PublicKey, error) {
+	if _, _, err := address.Parse(); err != nil {
+		return nil, err
+	}
+	if !address.IsLocal(s.localDomain) {
+		return nil, model.ErrorUserNotFound
+	}
+	return s.PublicKeyFor(address)
+}
+
+// PublicKeyFor gives the key of a local or remote user. Remote keys are
+// fetched from the user's server, so this is only for verifying messages
+// being ingested or sent, never for serving keys on request.
+func (s *service) PublicKeyFor(address model.UserAddress) (crypto.PublicKey, error) {
+	userID, domain, err := address.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.publicKeyCache.Get(userID)
+	if err == nil {
+		return key, nil
+	}
+	if err != model.ErrorUserNotFound {
 		return nil, fmt.Errorf("getting public key from cache: %w", err)
 	}
+
+	if address.IsLocal(s.localDomain) {
+		key, err = s.localPublicKey(userID)
+	} else {
+		key, err = s.remotePublicKey(userID, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.publicKeyCache.Set(userID, key); err != nil {
+		log.Warnf("caching public key for %s: %+v", address, err)
+	}
+
 	return key, nil
 }
 
-func publicKeyFromUser(u *model.User) (*ecdsa.PublicKey, error) {
-	return crypt.DecodePublicKey(u.PublicKey)
-}
+func (s *service) localPublicKey(userID model.UserID) (crypto.PublicKey, error) {
+	store, err := s.stores.ForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("loading userstore: %w", err)
+	}
+	defer store.Close()
 
-func privateKeyFromUser(user *model.User, password string) (*ecdsa.PrivateKey, error) {
-	shaHash := sha256.New()
-	shaHash.Write(base58.Decode(string(user.ID)))
-	shaHash.Write([]byte(password))
-	key := shaHash.Sum(nil)
+	user, err := store.Fetch()
+	if err != nil {
+		return nil, fmt.Errorf("fetching user: %w", err)
+	}
+	key, err := publicKeyFromUser(user)
+	if err != nil {
+		return nil, fmt.Errorf("getting public key from user: %w", err)
+	}
+	return key, nil
+}
 
-	parts := strings.Split(user.PrivateKey, ".")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid private key")
+// remotePublicKey fetches a key from the server the user belongs to. The ID is
+// derived from the key so a key that doesn't hash to the ID is rejected,
+// whichever server served it.
+func (s *service) remotePublicKey(userID model.UserID, domain string) (crypto.PublicKey, error) {
+	keyURL := url.URL{
+		Scheme: s.remoteScheme,
+		Host:   domain,
+		Path:   "/user/" + url.PathEscape(string(userID)) + "/publickey",
 	}
-	nonce, err := base64.StdEncoding.DecodeString(parts[0])
+
+	res, err := s.client.Get(keyURL.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode nonce: %w", err)
+		return nil, fmt.Errorf("fetching remote public key: %w", err)
 	}
+	defer res.Body.Close()
 
-	ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+	if res.StatusCode == http.StatusNotFound {
+		return nil, model.ErrorUserNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching remote public key: server responded %d", res.StatusCode)
+	}
+
+	var keyEncoded string
+	err = json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&keyEncoded)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+		return nil, fmt.Errorf("decoding remote public key response: %w", err)
 	}
 
-	block, err := aes.NewCipher(key)
+	key, err := crypt.DecodePublicKey(keyEncoded)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, fmt.Errorf("decoding remote public key: %w", err)
+	}
+
+	if user.IDFromPublicKey(key) != string(userID) {
+		return nil, model.ErrorPublicKeyMismatch
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	return key, nil
+}
+
+func newToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return base58.Encode(tokenBytes), nil
+}
+
+func newRecoveryKey() (string, error) {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", err
+	}
+	return base58.Encode(keyBytes), nil
+}
+
+func hashPassword(password string) (string, error) {
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return "", fmt.Errorf("generating encoded password: %w", err)
 	}
+	return base64.StdEncoding.EncodeToString(passwordBytes), nil
+}
 
-	keyData, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func checkPassword(u *model.User, password string) error {
+	hash, err := base64.StdEncoding.DecodeString(u.Password)
 	if err != nil {
-		if err.Error() == "cipher: message authentication failed" {
-			return nil, model.ErrorInvalidUsernameOrPassword
+		return fmt.Errorf("decoding password hash: %w", err)
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return model.ErrorInvalidUsernameOrPassword
 		}
-		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+		return fmt.Errorf("checking password: %w", err)
 	}
+	return nil
+}
 
-	keySpec, err := jwk.Parse(string(keyData))
-	if err != nil {
-		return nil, fmt.Errorf("parsing public key: %w", err)
+// generateKey creates a key pair for a new user under the algorithm they
+// chose.
+func generateKey(algorithm model.KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case model.KeyAlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case model.KeyAlgorithmEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
 	}
+	return nil, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+}
 
-	return keySpec.Key.(*ecdsa.PrivateKey), nil
+func publicKeyFromUser(u *model.User) (crypto.PublicKey, error) {
+	return crypt.DecodePublicKey(u.PublicKey)
+}
+
+func privateKeyFromUser(user *model.User, password string) (crypto.Signer, error) {
+	privateKey, err := crypt.DecodePrivateKey(user.PrivateKey, string(user.ID), password)
+	if err != nil {
+		if errors.Is(err, crypt.ErrorIncorrectPassword) {
+			return nil, model.ErrorInvalidUsernameOrPassword
+		}
+		return nil, err
+	}
+	return privateKey, nil
 }
@@ -1,37 +1,93 @@
 package user
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/nrednav/cuid2"
 	"github.com/stretchr/testify/assert"
 	"uk.co.dudmesh.propolis/internal/boot"
 	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store"
+	"uk.co.dudmesh.propolis/pkg/crypt"
+	"uk.co.dudmesh.propolis/pkg/user"
 )
 
+// testMailer keeps the verification tokens it is given so that tests can
+// verify users the way the owner of the mailbox would.
+type testMailer struct {
+	mu     sync.Mutex
+	tokens map[model.UserID]string
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{tokens: map[model.UserID]string{}}
+}
+
+func (m *testMailer) SendVerification(user *model.User, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[user.ID] = token
+	return nil
+}
+
+func (m *testMailer) token(userID model.UserID) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens[userID]
+}
+
+func newTestStores(t *testing.T, config store.ManagerConfig) *store.Manager {
+	stores := store.NewManager(config)
+	t.Cleanup(func() { stores.Close() })
+	return stores
+}
+
+// newCreateParams gives each user a unique handle, since the directory
+// outlives a single test when run with -count.
+func newCreateParams(handle string, password string) *model.CreateUserParams {
+	handle = handle + "_" + cuid2.Generate()[:8]
+	return &model.CreateUserParams{
+		Handle:   handle,
+		Email:    handle + "@testdomain.com",
+		Password: password,
+	}
+}
+
 func TestCreateUser(t *testing.T) {
 	assert := assert.New(t)
 
-	createParams := &model.CreateUserParams{
-		Handle:   "testuser",
-		Email:    "testuser@testdomain.com",
-		Password: "password",
-	}
+	createParams := newCreateParams("testuser", "password")
 
 	config, err := boot.Load()
 	if err != nil {
 		t.Fatalf("failed to load boot config")
 	}
 
-	service, err := New(config)
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
 	assert.Nil(err)
 	var userID model.UserID
+	var verificationToken string
 
 	t.Run("Create", func(t *testing.T) {
-		user, err := service.Create(createParams)
+		result, err := service.Create(createParams)
 		assert.Nil(err)
-		assert.NotNil(user)
-		if user != nil {
-			userID = user.ID
+		assert.NotNil(result)
+		if result != nil {
+			userID = result.User.ID
+			verificationToken = mailer.token(result.User.ID)
+			assert.Equal(model.UserStatusPending, result.User.Status)
 		}
 	})
 
@@ -41,6 +97,32 @@ func TestCreateUser(t *testing.T) {
 		assert.NotNil(user)
 	})
 
+	t.Run("Duplicate", func(t *testing.T) {
+		duplicate := newCreateParams("other", "password")
+		duplicate.Handle = strings.ToUpper(createParams.Handle)
+		_, err := service.Create(duplicate)
+		assert.ErrorIs(err, model.ErrorHandleTaken)
+
+		duplicate = newCreateParams("other", "password")
+		duplicate.Email = " " + strings.ToUpper(createParams.Email)
+		_, err = service.Create(duplicate)
+		assert.ErrorIs(err, model.ErrorEmailTaken)
+
+		_, err = service.Create(&model.CreateUserParams{Handle: "root", Email: "root@testdomain.com", Password: "password"})
+		assert.ErrorIs(err, model.ErrorInvalidField)
+	})
+
+	t.Run("Fetch By Handle", func(t *testing.T) {
+		user, err := service.FetchByHandle(createParams.Handle)
+		assert.Nil(err)
+		if user != nil {
+			assert.Equal(userID, user.ID)
+		}
+
+		_, err = service.FetchByHandle("nobody")
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
 	t.Run("Fetch Public Key", func(t *testing.T) {
 		key, err := service.PublicKeyFor(model.UserAddress(userID))
 		assert.Nil(err)
@@ -54,4 +136,397 @@ func TestCreateUser(t *testing.T) {
 		assert.Nil(err)
 		assert.NotNil(key)
 	})
+
+	t.Run("Authenticate Pending", func(t *testing.T) {
+		_, _, err := service.Authenticate(&model.LoginParams{Address: model.UserAddress(userID), Password: createParams.Password})
+		assert.ErrorIs(err, model.ErrorUserPending)
+	})
+
+	t.Run("Lookup Pending", func(t *testing.T) {
+		_, err := service.Lookup(model.UserAddress(createParams.Handle))
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		_, err := service.Verify(&model.VerifyUserParams{Address: model.UserAddress(userID), Token: "wrong"})
+		assert.ErrorIs(err, model.ErrorInvalidVerificationToken)
+
+		user, err := service.Verify(&model.VerifyUserParams{Address: model.UserAddress(userID), Token: verificationToken})
+		assert.Nil(err)
+		assert.Equal(model.UserStatusActive, user.Status)
+
+		_, err = service.Verify(&model.VerifyUserParams{Address: model.UserAddress(userID), Token: verificationToken})
+		assert.ErrorIs(err, model.ErrorInvalidStatusTransition)
+
+		entry, err := service.directory.FetchByHandle(createParams.Handle)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusActive, entry.Status)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		page, err := service.List("", 0)
+		assert.Nil(err)
+		found := false
+		for _, entry := range page.Users {
+			found = found || entry.UserID == userID
+		}
+		assert.True(found)
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		for _, address := range []string{
+			createParams.Handle + "@localhost:8080",
+			strings.ToUpper(createParams.Handle) + "@LOCALHOST:8080",
+			string(userID) + "@localhost:8080",
+			string(userID),
+		} {
+			entry, err := service.Lookup(model.UserAddress(address))
+			assert.Nil(err, address)
+			if entry != nil {
+				assert.Equal(userID, entry.UserID)
+			}
+		}
+
+		_, err := service.Lookup(model.UserAddress(createParams.Handle + "@elsewhere.com"))
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+		_, err = service.Lookup("nobody@localhost:8080")
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Authenticate", func(t *testing.T) {
+		_, _, err := service.Authenticate(&model.LoginParams{Address: model.UserAddress(userID), Password: "wrong"})
+		assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+		user, err := service.Fetch(userID)
+		assert.Nil(err)
+		assert.Equal(1, user.LoginAttempts)
+
+		user, key, err := service.Authenticate(&model.LoginParams{Address: model.UserAddress(userID), Password: createParams.Password})
+		assert.Nil(err)
+		assert.NotNil(key)
+		assert.NotNil(user.LastLoggedInAt)
+
+		user, err = service.Fetch(userID)
+		assert.Nil(err)
+		assert.Equal(0, user.LoginAttempts)
+		assert.NotNil(user.LastLoggedInAt)
+
+		_, _, err = service.Authenticate(&model.LoginParams{Address: "nobody", Password: createParams.Password})
+		assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+	})
+}
+
+func TestUserStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := boot.Load()
+	if err != nil {
+		t.Fatalf("failed to load boot config")
+	}
+
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
+	assert.Nil(err)
+
+	password := "password"
+	result, err := service.Create(newCreateParams("statususer", password))
+	assert.Nil(err)
+	address := model.UserAddress(result.User.ID)
+	_, err = service.Verify(&model.VerifyUserParams{Address: address, Token: mailer.token(result.User.ID)})
+	assert.Nil(err)
+
+	t.Run("Lockout", func(t *testing.T) {
+		for i := 1; i < config.LoginMaxAttempts(); i++ {
+			_, _, err := service.Authenticate(&model.LoginParams{Address: address, Password: "wrong"})
+			assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+		}
+		_, _, err := service.Authenticate(&model.LoginParams{Address: address, Password: "wrong"})
+		assert.ErrorIs(err, model.ErrorUserLocked)
+
+		_, _, err = service.Authenticate(&model.LoginParams{Address: address, Password: password})
+		assert.ErrorIs(err, model.ErrorUserLocked)
+		assert.ErrorIs(err, model.ErrorUserNotActive)
+	})
+
+	t.Run("Unlock", func(t *testing.T) {
+		user, err := service.Unlock(address)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusActive, user.Status)
+		assert.Equal(0, user.LoginAttempts)
+
+		_, _, err = service.Authenticate(&model.LoginParams{Address: address, Password: password})
+		assert.Nil(err)
+
+		_, err = service.Unlock(address)
+		assert.ErrorIs(err, model.ErrorInvalidStatusTransition)
+	})
+
+	t.Run("Lock Expiry", func(t *testing.T) {
+		for i := 0; i < config.LoginMaxAttempts(); i++ {
+			service.Authenticate(&model.LoginParams{Address: address, Password: "wrong"})
+		}
+		user, err := service.Fetch(result.User.ID)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusLocked, user.Status)
+		assert.ErrorIs(user.CheckActive(time.Now()), model.ErrorUserLocked)
+		assert.Nil(user.CheckActive(user.LockedUntil.Add(time.Second)))
+		assert.Equal(0, user.LoginAttempts)
+		_, err = service.Unlock(address)
+		assert.Nil(err)
+	})
+
+	t.Run("Attempts After Lock Runs Out", func(t *testing.T) {
+		lockout := config.Login.LockoutDuration
+		config.Login.LockoutDuration = time.Millisecond
+		defer func() { config.Login.LockoutDuration = lockout }()
+
+		for i := 0; i < config.LoginMaxAttempts(); i++ {
+			service.Authenticate(&model.LoginParams{Address: address, Password: "wrong"})
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		// the count started again when the lock was applied
+		_, _, err := service.Authenticate(&model.LoginParams{Address: address, Password: "wrong"})
+		assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+		_, _, err = service.Authenticate(&model.LoginParams{Address: address, Password: password})
+		assert.Nil(err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		user, err := service.Delete(address)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusDeleted, user.Status)
+
+		_, _, err = service.Authenticate(&model.LoginParams{Address: address, Password: password})
+		assert.ErrorIs(err, model.ErrorUserDeleted)
+
+		_, err = service.Unlock(address)
+		assert.ErrorIs(err, model.ErrorInvalidStatusTransition)
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := boot.Load()
+	if err != nil {
+		t.Fatalf("failed to load boot config")
+	}
+
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
+	assert.Nil(err)
+
+	result, err := service.Create(newCreateParams("passworduser", "password"))
+	assert.Nil(err)
+	address := model.UserAddress(result.User.ID)
+	_, err = service.Verify(&model.VerifyUserParams{Address: address, Token: mailer.token(result.User.ID)})
+	assert.Nil(err)
+
+	_, originalKey, err := service.Authenticate(&model.LoginParams{Address: address, Password: "password"})
+	assert.Nil(err)
+
+	t.Run("Change", func(t *testing.T) {
+		_, err := service.ChangePassword(&model.ChangePasswordParams{Address: address, OldPassword: "wrong", NewPassword: "changed"})
+		assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+
+		user, err := service.ChangePassword(&model.ChangePasswordParams{Address: address, OldPassword: "password", NewPassword: "changed"})
+		assert.Nil(err)
+		assert.NotNil(user.UpdatedAt)
+
+		_, _, err = service.Authenticate(&model.LoginParams{Address: address, Password: "password"})
+		assert.ErrorIs(err, model.ErrorInvalidUsernameOrPassword)
+		_, key, err := service.Authenticate(&model.LoginParams{Address: address, Password: "changed"})
+		assert.Nil(err)
+		assert.True(originalKey.(*ecdsa.PrivateKey).Equal(key))
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		_, err := service.ResetPassword(&model.ResetPasswordParams{Address: address, RecoveryKey: "wrong", NewPassword: "reset"})
+		assert.ErrorIs(err, model.ErrorInvalidRecoveryKey)
+
+		reset, err := service.ResetPassword(&model.ResetPasswordParams{Address: address, RecoveryKey: result.RecoveryKey, NewPassword: "reset"})
+		assert.Nil(err)
+		assert.NotEqual(result.RecoveryKey, reset.RecoveryKey)
+
+		_, key, err := service.Authenticate(&model.LoginParams{Address: address, Password: "reset"})
+		assert.Nil(err)
+		assert.True(originalKey.(*ecdsa.PrivateKey).Equal(key))
+
+		// the recovery key only works once
+		_, err = service.ResetPassword(&model.ResetPasswordParams{Address: address, RecoveryKey: result.RecoveryKey, NewPassword: "again"})
+		assert.ErrorIs(err, model.ErrorInvalidRecoveryKey)
+		_, err = service.ResetPassword(&model.ResetPasswordParams{Address: address, RecoveryKey: reset.RecoveryKey, NewPassword: "again"})
+		assert.Nil(err)
+	})
+}
+
+func TestKeyEncryptionUpgrade(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := boot.Load()
+	if err != nil {
+		t.Fatalf("failed to load boot config")
+	}
+
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
+	assert.Nil(err)
+
+	// create the user as if the KDF defaults had since been raised
+	defaults := crypt.DefaultKDFParams
+	crypt.DefaultKDFParams = crypt.KDFParams{Memory: 8 * 1024, Time: 1, Threads: 1}
+	result, err := service.Create(newCreateParams("upgradeuser", "password"))
+	crypt.DefaultKDFParams = defaults
+	assert.Nil(err)
+
+	address := model.UserAddress(result.User.ID)
+	_, err = service.Verify(&model.VerifyUserParams{Address: address, Token: mailer.token(result.User.ID)})
+	assert.Nil(err)
+
+	before, err := service.Fetch(result.User.ID)
+	assert.Nil(err)
+	assert.True(crypt.NeedsUpgrade(before.PrivateKey))
+
+	_, key, err := service.Authenticate(&model.LoginParams{Address: address, Password: "password"})
+	assert.Nil(err)
+
+	after, err := service.Fetch(result.User.ID)
+	assert.Nil(err)
+	assert.False(crypt.NeedsUpgrade(after.PrivateKey))
+	assert.Equal(before.Password, after.Password)
+
+	_, upgradedKey, err := service.Authenticate(&model.LoginParams{Address: address, Password: "password"})
+	assert.Nil(err)
+	assert.True(key.(*ecdsa.PrivateKey).Equal(upgradedKey))
+}
+
+func TestKeyAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := boot.Load()
+	if err != nil {
+		t.Fatalf("failed to load boot config")
+	}
+
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
+	assert.Nil(err)
+
+	t.Run("EdDSA", func(t *testing.T) {
+		params := newCreateParams("edwards", "password")
+		params.Algorithm = model.KeyAlgorithmEdDSA
+		result, err := service.Create(params)
+		assert.Nil(err)
+		cached, err := service.publicKeyCache.Get(result.User.ID)
+		assert.Nil(err)
+		assert.IsType(ed25519.PublicKey{}, cached)
+		address := model.UserAddress(result.User.ID)
+		_, err = service.Verify(&model.VerifyUserParams{Address: address, Token: mailer.token(result.User.ID)})
+		assert.Nil(err)
+
+		_, key, err := service.Authenticate(&model.LoginParams{Address: address, Password: "password"})
+		assert.Nil(err)
+		assert.IsType(ed25519.PrivateKey{}, key)
+		assert.Equal(string(result.User.ID), user.IDFromPublicKey(key.Public()))
+
+		publicKey, err := service.PublicKeyFor(address)
+		assert.Nil(err)
+		assert.Equal(key.Public(), publicKey)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		result, err := service.Create(newCreateParams("default", "password"))
+		assert.Nil(err)
+		cached, err := service.publicKeyCache.Get(result.User.ID)
+		assert.Nil(err)
+		assert.IsType(&ecdsa.PublicKey{}, cached)
+
+		publicKey, err := service.PublicKeyFor(model.UserAddress(result.User.ID))
+		assert.Nil(err)
+		assert.IsType(&ecdsa.PublicKey{}, publicKey)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		params := newCreateParams("rsa", "password")
+		params.Algorithm = "RS256"
+		_, err := service.Create(params)
+		assert.ErrorIs(err, model.ErrorInvalidField)
+	})
+}
+
+func TestRemotePublicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := boot.Load()
+	if err != nil {
+		t.Fatalf("failed to load boot config")
+	}
+
+	mailer := newTestMailer()
+	service, err := New(config, newTestStores(t, config), mailer)
+	assert.Nil(err)
+	service.remoteScheme = "http"
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	userID := user.IDFromPublicKey(&privateKey.PublicKey)
+
+	impostorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	impostorID := user.IDFromPublicKey(&impostorKey.PublicKey)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var key *ecdsa.PublicKey
+		switch r.URL.Path {
+		case "/user/" + userID + "/publickey":
+			key = &privateKey.PublicKey
+		case "/user/" + impostorID + "/publickey":
+			// serve someone else's key for this ID
+			key = &privateKey.PublicKey
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		encoded, _ := crypt.EncodePublicKey(key, userID)
+		json.NewEncoder(w).Encode(encoded)
+	}))
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	t.Run("Fetch", func(t *testing.T) {
+		key, err := service.PublicKeyFor(model.UserAddress(userID + "@" + remoteURL.Host))
+		assert.Nil(err)
+		assert.True(privateKey.PublicKey.Equal(key))
+
+		// served from the cache once the remote server has gone
+		remote.Close()
+		key, err = service.PublicKeyFor(model.UserAddress(userID + "@" + remoteURL.Host))
+		assert.Nil(err)
+		assert.NotNil(key)
+	})
+
+	remote = httptest.NewServer(remote.Config.Handler)
+	defer remote.Close()
+	remoteURL, _ = url.Parse(remote.URL)
+
+	t.Run("Mismatched Key", func(t *testing.T) {
+		_, err := service.PublicKeyFor(model.UserAddress(impostorID + "@" + remoteURL.Host))
+		assert.ErrorIs(err, model.ErrorPublicKeyMismatch)
+	})
+
+	t.Run("Unknown User", func(t *testing.T) {
+		_, err := service.PublicKeyFor(model.UserAddress("unknown@" + remoteURL.Host))
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Invalid Address", func(t *testing.T) {
+		_, err := service.PublicKeyFor(model.UserAddress("someone@"))
+		assert.ErrorIs(err, model.ErrorInvalidAddress)
+	})
+
+	t.Run("Not Served", func(t *testing.T) {
+		// cached from the fetch above, but still not local
+		_, err := service.LocalPublicKey(model.UserAddress(userID + "@" + remoteURL.Host))
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
 }
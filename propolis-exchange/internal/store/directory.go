@@ -0,0 +1,231 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type DirectoryConfig interface {
+	DatabaseURL() string
+}
+
+var directoryMigrations = mustLoadMigrations(migrationFiles, "migrations/directory")
+
+// directory is the global index of local users. It lives in Postgres so that
+// every instance shares it; the per-user stores remain the source of truth
+// for everything except finding a user in the first place.
+type directory struct {
+	db *sqlx.DB
+}
+
+// NewDirectory connects to the directory database and brings its schema up
+// to date. databaseURL is normally a postgres:// URL, but a sqlite3: prefixed
+// DSN is accepted as a stand-in for tests and single-node development.
+func NewDirectory(config DirectoryConfig) (*directory, error) {
+	db, err := openDirectoryDB(config.DatabaseURL())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateDirectory(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating directory: %w", err)
+	}
+
+	return &directory{db}, nil
+}
+
+func openDirectoryDB(databaseURL string) (*sqlx.DB, error) {
+	switch {
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		db, err := sqlx.Connect("postgres", databaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("opening directory database: %w", err)
+		}
+		return db, nil
+	case strings.HasPrefix(databaseURL, "sqlite3:"):
+		db, err := sqlx.Connect("sqlite3", strings.TrimPrefix(databaseURL, "sqlite3:"))
+		if err != nil {
+			return nil, fmt.Errorf("opening directory database: %w", err)
+		}
+		// a single connection keeps in-memory databases alive and avoids
+		// lock contention between writers
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unsupported directory database URL")
+	}
+}
+
+// migrateDirectory brings the shared database's schema up to date. Anything
+// else kept there, such as the messages ingest has seen, migrates with it.
+func migrateDirectory(db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if db.DriverName() == "postgres" {
+		// instances starting together wait here rather than racing each other
+		_, err = tx.Exec(`select pg_advisory_xact_lock(hashtext('propolis_directory_migrations'))`)
+		if err != nil {
+			return fmt.Errorf("locking directory schema: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`create table if not exists directory_schema_version(
+		version    integer not null primary key,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating directory_schema_version table: %w", err)
+	}
+
+	var version int
+	err = tx.Get(&version, `select coalesce(max(version), 0) from directory_schema_version`)
+	if err != nil {
+		return fmt.Errorf("fetching schema version: %w", err)
+	}
+	if version > len(directoryMigrations) {
+		return fmt.Errorf("directory schema version %d is newer than this binary supports (%d)", version, len(directoryMigrations))
+	}
+
+	for _, m := range directoryMigrations[version:] {
+		if _, err := tx.Exec(m.script); err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+		_, err = tx.Exec(tx.Rebind(`insert into directory_schema_version (version, applied_at) values (?, ?)`),
+			m.version, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("recording schema version: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *directory) Close() error {
+	return d.db.Close()
+}
+
+// Register adds a new user. Handles and emails are unique, so this is where
+// a taken one is caught, even if two registrations race.
+func (d *directory) Register(entry *model.DirectoryEntry) error {
+	_, err := d.db.NamedExec(`insert into directory
+		(user_id, handle, email, status, location, created_at)
+		values (:user_id, :handle, :email, :status, :location, :created_at)`, entry)
+	if err != nil {
+		switch uniqueViolation(err) {
+		case "handle":
+			return model.ErrorHandleTaken
+		case "email":
+			return model.ErrorEmailTaken
+		}
+		return fmt.Errorf("registering user: %w", err)
+	}
+	return nil
+}
+
+// uniqueViolation returns the directory column whose unique index err
+// violated, or "" if it wasn't a unique violation.
+func uniqueViolation(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return strings.TrimSuffix(strings.TrimPrefix(pqErr.Constraint, "directory_"), "_unique")
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		_, column, _ := strings.Cut(sqliteErr.Error(), "directory.")
+		return column
+	}
+	return ""
+}
+
+// Sync writes an entry rebuilt from the user's own store, replacing whatever
+// the directory had for them.
+func (d *directory) Sync(entry *model.DirectoryEntry) error {
+	_, err := d.db.NamedExec(`insert into directory
+		(user_id, handle, email, status, location, created_at, updated_at)
+		values (:user_id, :handle, :email, :status, :location, :created_at, :updated_at)
+		on conflict (user_id) do update set
+			handle = excluded.handle, email = excluded.email, status = excluded.status,
+			location = excluded.location, updated_at = excluded.updated_at`, entry)
+	if err != nil {
+		return fmt.Errorf("syncing user: %w", err)
+	}
+	return nil
+}
+
+func (d *directory) Unregister(userID model.UserID) error {
+	_, err := d.db.Exec(d.db.Rebind(`delete from directory where user_id = ?`), userID)
+	if err != nil {
+		return fmt.Errorf("unregistering user: %w", err)
+	}
+	return nil
+}
+
+func (d *directory) Fetch(userID model.UserID) (*model.DirectoryEntry, error) {
+	return d.fetch(`select * from directory where user_id = ?`, userID)
+}
+
+func (d *directory) FetchByHandle(handle string) (*model.DirectoryEntry, error) {
+	return d.fetch(`select * from directory where handle = ?`, model.NormaliseHandle(handle))
+}
+
+func (d *directory) FetchByEmail(email string) (*model.DirectoryEntry, error) {
+	return d.fetch(`select * from directory where email = ?`, model.NormaliseEmail(email))
+}
+
+func (d *directory) fetch(query string, arg any) (*model.DirectoryEntry, error) {
+	entry := &model.DirectoryEntry{}
+	err := d.db.Get(entry, d.db.Rebind(query), arg)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrorUserNotFound
+		}
+		return nil, fmt.Errorf("fetching directory entry: %w", err)
+	}
+	return entry, nil
+}
+
+func (d *directory) UpdateStatus(userID model.UserID, status model.UserStatus) error {
+	return d.update(`update directory set status = ?, updated_at = ? where user_id = ?`, status, userID)
+}
+
+func (d *directory) UpdateLocation(userID model.UserID, location string) error {
+	return d.update(`update directory set location = ?, updated_at = ? where user_id = ?`, location, userID)
+}
+
+func (d *directory) update(query string, value any, userID model.UserID) error {
+	res, err := d.db.Exec(d.db.Rebind(query), value, time.Now().UTC(), userID)
+	if err != nil {
+		return fmt.Errorf("updating directory entry: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	} else if rows != 1 {
+		return model.ErrorUserNotFound
+	}
+	return nil
+}
+
+// List returns up to limit entries ordered by user ID, starting after the
+// given ID, for paging through every user.
+func (d *directory) List(after model.UserID, limit int) ([]*model.DirectoryEntry, error) {
+	entries := []*model.DirectoryEntry{}
+	err := d.db.Select(&entries, d.db.Rebind(`select * from directory where user_id > ? order by user_id limit ?`), after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing directory: %w", err)
+	}
+	return entries, nil
+}
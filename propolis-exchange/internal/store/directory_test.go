@@ -0,0 +1,151 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store/storetest"
+)
+
+type testDirectoryConfig struct {
+	databaseURL string
+}
+
+func (c *testDirectoryConfig) DatabaseURL() string {
+	return c.databaseURL
+}
+
+func newTestDirectory(t *testing.T) (*directory, *testDirectoryConfig) {
+	databaseURL, cleanup, err := storetest.DatabaseURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+
+	config := &testDirectoryConfig{databaseURL}
+	directory, err := NewDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { directory.Close() })
+	return directory, config
+}
+
+func newTestEntry(t *testing.T, handle string) *model.DirectoryEntry {
+	userID, _ := newTestKey(t)
+	return &model.DirectoryEntry{
+		UserID:    userID,
+		Handle:    handle,
+		Email:     handle + "@testdomain.com",
+		Status:    model.UserStatusPending,
+		Location:  Location(userID),
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	t.Run("Register", func(t *testing.T) {
+		assert := assert.New(t)
+		directory, _ := newTestDirectory(t)
+		entry := newTestEntry(t, "alice")
+
+		assert.Nil(directory.Register(entry))
+
+		fetched, err := directory.Fetch(entry.UserID)
+		assert.Nil(err)
+		assert.Equal(entry.Handle, fetched.Handle)
+		assert.Equal(entry.Location, fetched.Location)
+		assert.True(entry.CreatedAt.Equal(fetched.CreatedAt))
+
+		fetched, err = directory.FetchByHandle("alice")
+		assert.Nil(err)
+		assert.Equal(entry.UserID, fetched.UserID)
+
+		fetched, err = directory.FetchByEmail("alice@testdomain.com")
+		assert.Nil(err)
+		assert.Equal(entry.UserID, fetched.UserID)
+
+		_, err = directory.FetchByHandle("bob")
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+
+		assert.Nil(directory.Unregister(entry.UserID))
+		_, err = directory.Fetch(entry.UserID)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Unique", func(t *testing.T) {
+		assert := assert.New(t)
+		directory, _ := newTestDirectory(t)
+		assert.Nil(directory.Register(newTestEntry(t, "frank")))
+
+		sameHandle := newTestEntry(t, "frank")
+		sameHandle.Email = "franklin@testdomain.com"
+		assert.ErrorIs(directory.Register(sameHandle), model.ErrorHandleTaken)
+
+		sameEmail := newTestEntry(t, "francis")
+		sameEmail.Email = "frank@testdomain.com"
+		assert.ErrorIs(directory.Register(sameEmail), model.ErrorEmailTaken)
+
+		_, err := directory.FetchByHandle("Frank")
+		assert.Nil(err)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		assert := assert.New(t)
+		directory, _ := newTestDirectory(t)
+		entry := newTestEntry(t, "carol")
+		assert.Nil(directory.Register(entry))
+
+		assert.Nil(directory.UpdateStatus(entry.UserID, model.UserStatusActive))
+		assert.Nil(directory.UpdateLocation(entry.UserID, "moved.db"))
+		fetched, err := directory.Fetch(entry.UserID)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusActive, fetched.Status)
+		assert.Equal("moved.db", fetched.Location)
+		assert.NotNil(fetched.UpdatedAt)
+
+		missing := newTestEntry(t, "dave")
+		assert.ErrorIs(directory.UpdateStatus(missing.UserID, model.UserStatusActive), model.ErrorUserNotFound)
+
+		entry.Status = model.UserStatusLocked
+		entry.Handle = "caroline"
+		assert.Nil(directory.Sync(entry))
+		assert.Nil(directory.Sync(missing))
+		fetched, err = directory.Fetch(entry.UserID)
+		assert.Nil(err)
+		assert.Equal(model.UserStatusLocked, fetched.Status)
+		assert.Equal("caroline", fetched.Handle)
+		_, err = directory.Fetch(missing.UserID)
+		assert.Nil(err)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		assert := assert.New(t)
+		directory, _ := newTestDirectory(t)
+		for _, handle := range []string{"a", "b", "c", "d", "e"} {
+			assert.Nil(directory.Register(newTestEntry(t, handle)))
+		}
+
+		first, err := directory.List("", 3)
+		assert.Nil(err)
+		assert.Len(first, 3)
+		rest, err := directory.List(first[2].UserID, 3)
+		assert.Nil(err)
+		assert.Len(rest, 2)
+		assert.Less(string(first[2].UserID), string(rest[0].UserID))
+	})
+
+	t.Run("Migrations Run Once", func(t *testing.T) {
+		assert := assert.New(t)
+		directory, config := newTestDirectory(t)
+		assert.Nil(directory.Register(newTestEntry(t, "erin")))
+
+		again, err := NewDirectory(config)
+		assert.Nil(err)
+		defer again.Close()
+		_, err = again.FetchByHandle("erin")
+		assert.Nil(err)
+	})
+}
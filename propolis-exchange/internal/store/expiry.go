@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type PurgeConfig interface {
+	Config
+	StorePurgeInterval() time.Duration
+}
+
+var userStorePurged = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "propolis",
+	Subsystem: "user_store",
+	Name:      "expired_total",
+	Help:      "Number of posts and inbox entries purged from user databases after their message expired.",
+})
+
+// PurgeExpired deletes the posts and inbox entries whose message expired at
+// or before now, returning how many were deleted.
+func (d *userstore) PurgeExpired(now time.Time) (int64, error) {
+	defer d.lockWrites()()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`delete from timeline where PostID in
+		(select ID from post where ExpiresAt is not null and ExpiresAt <= ?)`, now)
+	if err != nil {
+		return 0, fmt.Errorf("removing timeline entries: %w", err)
+	}
+
+	var purged int64
+	for _, table := range []string{"post", "inbox"} {
+		res, err := tx.Exec(`delete from `+table+` where ExpiresAt is not null and ExpiresAt <= ?`, now)
+		if err != nil {
+			return 0, fmt.Errorf("purging %s: %w", table, err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("getting rows affected: %w", err)
+		}
+		purged += rows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing purge: %w", err)
+	}
+	return purged, nil
+}
+
+// Purger periodically goes through every user store deleting expired
+// messages. Reads already leave them out, so this only reclaims the space.
+type Purger struct {
+	config PurgeConfig
+	stores *Manager
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+func NewPurger(config PurgeConfig, stores *Manager) *Purger {
+	purger := &Purger{
+		config: config,
+		stores: stores,
+		done:   make(chan struct{}),
+	}
+
+	purger.wg.Add(1)
+	go purger.sweep(config.StorePurgeInterval())
+
+	return purger
+}
+
+func (p *Purger) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	p.wg.Wait()
+	return nil
+}
+
+// Purge deletes expired messages from every user store. A store that can't
+// be purged is logged and skipped so that the others still are.
+func (p *Purger) Purge(now time.Time) error {
+	userIDs, err := UserIDs(p.config)
+	if err != nil {
+		return fmt.Errorf("listing users: %w", err)
+	}
+
+	for _, userID := range userIDs {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+
+		userStore, err := p.stores.ForUser(userID)
+		if err != nil {
+			log.Errorf("loading userstore for %s: %+v", userID, err)
+			continue
+		}
+		purged, err := userStore.PurgeExpired(now.UTC())
+		userStore.Close()
+		if err != nil {
+			log.Errorf("purging expired messages for %s: %+v", userID, err)
+			continue
+		}
+		userStorePurged.Add(float64(purged))
+	}
+	return nil
+}
+
+func (p *Purger) sweep(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			if err := p.Purge(time.Now()); err != nil {
+				log.Errorf("purging expired messages: %+v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type testPurgeConfig struct {
+	testManagerConfig
+}
+
+func (c *testPurgeConfig) StorePurgeInterval() time.Duration {
+	return time.Hour
+}
+
+func newTestPost(author model.UserAddress, expiresAt *time.Time) *model.PostRecord {
+	entry := newInboxEntry(author)
+	return &model.PostRecord{
+		ID:            model.PostID(entry.ID),
+		CreatedAt:     time.Now().UTC(),
+		Status:        model.PostStatusReceived,
+		AuthorAddress: author,
+		ExpiresAt:     expiresAt,
+		Message:       entry.Message,
+		Post:          model.Post{Content: "hello", Visibility: model.VisibilityPublic},
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &testPurgeConfig{testManagerConfig{testStoreConfig{t.TempDir()}, 4}}
+	manager := NewManager(config)
+	t.Cleanup(func() { manager.Close() })
+	purger := NewPurger(config, manager)
+	t.Cleanup(func() { purger.Close() })
+
+	userID := newManagedUser(t, manager)
+	userStore, err := manager.ForUser(userID)
+	assert.Nil(err)
+	defer userStore.Close()
+
+	const author model.UserAddress = "author@remote.example.com"
+	past := time.Now().Add(-time.Minute).UTC()
+	future := time.Now().Add(time.Hour).UTC()
+
+	expired := newTestPost(author, &past)
+	current := newTestPost(author, &future)
+	lasting := newTestPost(author, nil)
+	for _, post := range []*model.PostRecord{expired, current, lasting} {
+		assert.Nil(userStore.PutPost(post))
+	}
+
+	expiredEntry := newInboxEntry(author)
+	expiredEntry.ExpiresAt = &past
+	lastingEntry := newInboxEntry(author)
+	for _, entry := range []*model.InboxEntry{expiredEntry, lastingEntry} {
+		assert.Nil(userStore.PutInbox(entry))
+	}
+
+	t.Run("Hidden", func(t *testing.T) {
+		_, err := userStore.FetchPost(expired.ID)
+		assert.ErrorIs(err, model.ErrorPostNotFound)
+
+		post, err := userStore.FetchPost(current.ID)
+		assert.Nil(err)
+		if assert.NotNil(post.ExpiresAt) {
+			assert.Equal(future.UnixMilli(), post.ExpiresAt.UnixMilli())
+		}
+
+		posts, _, err := userStore.Timeline("owner@local.example.com", nil, 10)
+		assert.Nil(err)
+		ids := []model.PostID{}
+		for _, post := range posts {
+			ids = append(ids, post.ID)
+		}
+		assert.ElementsMatch([]model.PostID{current.ID, lasting.ID}, ids)
+
+		entries, _, err := userStore.Inbox(string(model.ContentTypePost), nil, 10)
+		assert.Nil(err)
+		if assert.Len(entries, 1) {
+			assert.Equal(lastingEntry.ID, entries[0].ID)
+		}
+	})
+
+	t.Run("Purged", func(t *testing.T) {
+		assert.Nil(purger.Purge(time.Now()))
+
+		var count int
+		assert.Nil(userStore.db.Get(&count, `select count(*) from post`))
+		assert.Equal(2, count)
+		assert.Nil(userStore.db.Get(&count, `select count(*) from timeline`))
+		assert.Equal(2, count)
+		assert.Nil(userStore.db.Get(&count, `select count(*) from inbox`))
+		assert.Equal(1, count)
+
+		purged, err := userStore.PurgeExpired(future)
+		assert.Nil(err)
+		assert.EqualValues(1, purged)
+	})
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+// SetApproveFollowers chooses whether new followers wait for the user to
+// approve them.
+func (d *userstore) SetApproveFollowers(approve bool) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.Exec(`update user set ApproveFollowers = ?, UpdatedAt = ? where ID = ?`,
+		approve, time.Now().UTC(), d.userID)
+	if err != nil {
+		return fmt.Errorf("updating follower approval: %w", err)
+	}
+	return nil
+}
+
+// PutFollower records a follower, replacing any earlier record for the same
+// address.
+func (d *userstore) PutFollower(follow *model.Follow) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.NamedExec(`insert into follower
+		(Address, Status, RequestID, Responded, CreatedAt, UpdatedAt)
+		values(:Address, :Status, :RequestID, :Responded, :CreatedAt, :UpdatedAt)
+		on conflict(Address) do update set
+		Status = excluded.Status, RequestID = excluded.RequestID, Responded = excluded.Responded, UpdatedAt = excluded.UpdatedAt`, follow)
+	if err != nil {
+		return fmt.Errorf("storing follower: %w", err)
+	}
+	return nil
+}
+
+func (d *userstore) FetchFollower(address model.UserAddress) (*model.Follow, error) {
+	return d.fetchFollow("follower", address)
+}
+
+func (d *userstore) DeleteFollower(address model.UserAddress) error {
+	return d.deleteFollow("follower", address)
+}
+
+// Followers returns up to limit followers with addresses after the given one,
+// in address order.
+func (d *userstore) Followers(after model.UserAddress, limit int) ([]*model.Follow, error) {
+	return d.listFollows("follower", after, limit)
+}
+
+// PutFollowing records someone the user follows, replacing any earlier record
+// for the same address.
+func (d *userstore) PutFollowing(follow *model.Follow) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.NamedExec(`insert into following
+		(Address, Status, RequestID, CreatedAt, UpdatedAt)
+		values(:Address, :Status, :RequestID, :CreatedAt, :UpdatedAt)
+		on conflict(Address) do update set
+		Status = excluded.Status, RequestID = excluded.RequestID, UpdatedAt = excluded.UpdatedAt`, follow)
+	if err != nil {
+		return fmt.Errorf("storing following: %w", err)
+	}
+	return nil
+}
+
+func (d *userstore) FetchFollowing(address model.UserAddress) (*model.Follow, error) {
+	return d.fetchFollow("following", address)
+}
+
+func (d *userstore) DeleteFollowing(address model.UserAddress) error {
+	return d.deleteFollow("following", address)
+}
+
+// Following returns up to limit of the people the user follows with addresses
+// after the given one, in address order.
+func (d *userstore) Following(after model.UserAddress, limit int) ([]*model.Follow, error) {
+	return d.listFollows("following", after, limit)
+}
+
+// table is always one of the literal names above, never a caller's input.
+
+func (d *userstore) fetchFollow(table string, address model.UserAddress) (*model.Follow, error) {
+	follow := &model.Follow{}
+	err := d.db.Get(follow, `select * from `+table+` where Address = ?`, address)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrorFollowNotFound
+		}
+		return nil, fmt.Errorf("fetching %s: %w", table, err)
+	}
+	return follow, nil
+}
+
+func (d *userstore) deleteFollow(table string, address model.UserAddress) error {
+	defer d.lockWrites()()
+
+	res, err := d.db.Exec(`delete from `+table+` where Address = ?`, address)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", table, err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	} else if rows == 0 {
+		return model.ErrorFollowNotFound
+	}
+	return nil
+}
+
+func (d *userstore) listFollows(table string, after model.UserAddress, limit int) ([]*model.Follow, error) {
+	follows := []*model.Follow{}
+	err := d.db.Select(&follows, `select * from `+table+` where Address > ? order by Address limit ?`, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", table, err)
+	}
+	return follows, nil
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type ManagerConfig interface {
+	Config
+	StoreMaxOpen() int
+	StoreIdleTimeout() time.Duration
+	StoreSweepInterval() time.Duration
+}
+
+var (
+	userStoresOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "propolis",
+		Subsystem: "user_store",
+		Name:      "open",
+		Help:      "Number of user databases held open by the store manager.",
+	})
+	userStoreEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "user_store",
+		Name:      "evictions_total",
+		Help:      "Number of user databases closed by the store manager, by reason.",
+	}, []string{"reason"})
+)
+
+// Manager shares open user databases between callers instead of opening one
+// per request. Databases that nobody is using are kept in least recently used
+// order and closed when there are more than StoreMaxOpen of them or they have
+// been idle for StoreIdleTimeout. Writes to each database are serialised.
+// Databases are opened outside the manager's lock, so a slow open only holds
+// up callers waiting for the same database.
+type Manager struct {
+	config      ManagerConfig
+	maxOpen     int
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	open        map[string]*managedDB
+	opening     map[string]chan struct{}
+	lru         *list.List
+	done        chan struct{}
+	once        sync.Once
+	wg          sync.WaitGroup
+}
+
+type managedDB struct {
+	dbName   string
+	db       *sqlx.DB
+	writeMu  sync.Mutex
+	refs     int
+	lastUsed time.Time
+	element  *list.Element
+}
+
+func NewManager(config ManagerConfig) *Manager {
+	manager := &Manager{
+		config:      config,
+		maxOpen:     config.StoreMaxOpen(),
+		idleTimeout: config.StoreIdleTimeout(),
+		open:        map[string]*managedDB{},
+		opening:     map[string]chan struct{}{},
+		lru:         list.New(),
+		done:        make(chan struct{}),
+	}
+
+	manager.wg.Add(1)
+	go manager.sweep(config.StoreSweepInterval())
+
+	return manager
+}
+
+// ForUser returns a store for an existing user. Closing it hands the database
+// back to the manager rather than closing it.
+func (m *Manager) ForUser(userID model.UserID) (*userstore, error) {
+	dbName, err := Path(m.config, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.acquire(userID, dbName, func() error {
+		_, err := os.Stat(dbName)
+		if errors.Is(err, os.ErrNotExist) {
+			return model.ErrorUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("checking if database exists: %w", err)
+		}
+		return nil
+	})
+}
+
+// Create makes the store for a new user. If the database already exists it
+// is opened as it is.
+func (m *Manager) Create(user *model.User) (*userstore, error) {
+	dbName, err := Path(m.config, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	isCreating := false
+	userStore, err := m.acquire(user.ID, dbName, func() error {
+		_, err := os.Stat(dbName)
+		isCreating = errors.Is(err, os.ErrNotExist)
+		if isCreating {
+			return createShard(dbName)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if isCreating {
+		if err := userStore.createUser(user); err != nil {
+			userStore.Close()
+			return nil, fmt.Errorf("creating user metadata: %w", err)
+		}
+	}
+
+	return userStore, nil
+}
+
+// acquire returns a store backed by the shared database for dbName, opening it
+// if needed. check runs before a database is opened. Only one caller opens a
+// database at a time; anyone else after it waits and then looks again.
+func (m *Manager) acquire(userID model.UserID, dbName string, check func() error) (*userstore, error) {
+	m.mu.Lock()
+	for {
+		if managed, ok := m.open[dbName]; ok {
+			managed.refs++
+			m.lru.MoveToBack(managed.element)
+			m.mu.Unlock()
+			return m.userStore(userID, managed), nil
+		}
+		opened, ok := m.opening[dbName]
+		if !ok {
+			break
+		}
+		// the open may fail for a reason that doesn't apply to this caller,
+		// such as a missing database that this caller would create
+		m.mu.Unlock()
+		<-opened
+		m.mu.Lock()
+	}
+	opened := make(chan struct{})
+	m.opening[dbName] = opened
+	m.mu.Unlock()
+
+	db, err := openChecked(dbName, check)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.opening, dbName)
+	close(opened)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := &managedDB{dbName: dbName, db: db, refs: 1}
+	managed.element = m.lru.PushBack(managed)
+	m.open[dbName] = managed
+	userStoresOpen.Inc()
+	m.trim()
+
+	return m.userStore(userID, managed), nil
+}
+
+func openChecked(dbName string, check func() error) (*sqlx.DB, error) {
+	if err := check(); err != nil {
+		return nil, err
+	}
+	return openDB(dbName)
+}
+
+func (m *Manager) userStore(userID model.UserID, managed *managedDB) *userstore {
+	return &userstore{
+		userID:  string(userID),
+		db:      managed.db,
+		writeMu: &managed.writeMu,
+		release: func() error {
+			m.release(managed)
+			return nil
+		},
+	}
+}
+
+func (m *Manager) release(managed *managedDB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	managed.refs--
+	managed.lastUsed = time.Now()
+	m.lru.MoveToBack(managed.element)
+	m.trim()
+}
+
+// trim closes the least recently used databases until the pool is back to
+// capacity. The caller must hold m.mu.
+func (m *Manager) trim() {
+	// databases still in use can't be closed, so the pool may stay over
+	// capacity until they are released
+	for e := m.lru.Front(); e != nil && len(m.open) > m.maxOpen; {
+		next := e.Next()
+		if candidate := e.Value.(*managedDB); candidate.refs == 0 {
+			m.evict(candidate, "capacity")
+		}
+		e = next
+	}
+}
+
+// evict closes a database. The caller must hold m.mu.
+func (m *Manager) evict(managed *managedDB, reason string) {
+	m.lru.Remove(managed.element)
+	delete(m.open, managed.dbName)
+	managed.db.Close()
+	userStoresOpen.Dec()
+	userStoreEvictions.WithLabelValues(reason).Inc()
+}
+
+func (m *Manager) sweep(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.closeIdle(time.Now().Add(-m.idleTimeout))
+		}
+	}
+}
+
+func (m *Manager) closeIdle(before time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for e := m.lru.Front(); e != nil; {
+		next := e.Next()
+		managed := e.Value.(*managedDB)
+		if managed.refs == 0 && managed.lastUsed.Before(before) {
+			m.evict(managed, "idle")
+		}
+		e = next
+	}
+}
+
+// Close stops the sweeper and closes every database, in use or not.
+func (m *Manager) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, managed := range m.open {
+		errs = append(errs, managed.db.Close())
+		userStoresOpen.Dec()
+	}
+	m.open = map[string]*managedDB{}
+	m.lru.Init()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nrednav/cuid2"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type testManagerConfig struct {
+	testStoreConfig
+	maxOpen int
+}
+
+func (c *testManagerConfig) StoreMaxOpen() int {
+	return c.maxOpen
+}
+
+func (c *testManagerConfig) StoreIdleTimeout() time.Duration {
+	return time.Minute
+}
+
+func (c *testManagerConfig) StoreSweepInterval() time.Duration {
+	return time.Minute
+}
+
+func newTestManager(t testing.TB, maxOpen int) *Manager {
+	manager := NewManager(&testManagerConfig{testStoreConfig{t.TempDir()}, maxOpen})
+	t.Cleanup(func() { manager.Close() })
+	return manager
+}
+
+func newManagedUser(t *testing.T, manager *Manager) model.UserID {
+	userID, _ := newTestKey(t)
+	userStore, err := manager.Create(&model.User{ID: userID, CreatedAt: time.Now().UTC(), Status: model.UserStatusActive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore.Close()
+	return userID
+}
+
+func newInboxEntry(sender model.UserAddress) *model.InboxEntry {
+	return &model.InboxEntry{
+		ID:            cuid2.Generate(),
+		ReceivedAt:    time.Now().UTC(),
+		Timestamp:     time.Now().UnixMilli(),
+		SenderAddress: sender,
+		ContentType:   string(model.ContentTypePost),
+		Message:       "header.payload.signature",
+	}
+}
+
+func (m *Manager) openCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.open)
+}
+
+func TestManager(t *testing.T) {
+	t.Run("Shared", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 4)
+		userID := newManagedUser(t, manager)
+
+		first, err := manager.ForUser(userID)
+		assert.Nil(err)
+		second, err := manager.ForUser(userID)
+		assert.Nil(err)
+		assert.Same(first.db, second.db)
+
+		first.Close()
+		second.Close()
+		assert.Equal(1, manager.openCount())
+
+		rows, err := first.db.Query(`select 1`)
+		assert.Nil(err, "database should stay open after release")
+		rows.Close()
+
+		_, err = manager.ForUser("missing")
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Capacity", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 2)
+		users := []model.UserID{newManagedUser(t, manager), newManagedUser(t, manager), newManagedUser(t, manager)}
+		assert.Equal(2, manager.openCount())
+
+		// stores in use are never closed underneath their users
+		held := []*userstore{}
+		for _, userID := range users {
+			userStore, err := manager.ForUser(userID)
+			assert.Nil(err)
+			held = append(held, userStore)
+		}
+		assert.Equal(3, manager.openCount())
+		for _, userStore := range held {
+			_, err := userStore.Fetch()
+			assert.Nil(err)
+			userStore.Close()
+		}
+		assert.Equal(2, manager.openCount())
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 4)
+		userID := newManagedUser(t, manager)
+
+		held, err := manager.ForUser(userID)
+		assert.Nil(err)
+		manager.closeIdle(time.Now().Add(time.Second))
+		assert.Equal(1, manager.openCount())
+
+		held.Close()
+		manager.closeIdle(time.Now().Add(time.Second))
+		assert.Equal(0, manager.openCount())
+	})
+
+	t.Run("Slow Open", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 4)
+		slow := newManagedUser(t, manager)
+		other := newManagedUser(t, manager)
+		manager.closeIdle(time.Now().Add(time.Second))
+
+		slowPath, err := Path(manager.config, slow)
+		assert.Nil(err)
+		unblock := make(chan struct{})
+		checking := make(chan struct{})
+		first := make(chan *userstore)
+		go func() {
+			userStore, err := manager.acquire(slow, slowPath, func() error {
+				close(checking)
+				<-unblock
+				return nil
+			})
+			assert.Nil(err)
+			first <- userStore
+		}()
+		<-checking
+
+		// other users' stores aren't held up by the open
+		userStore, err := manager.ForUser(other)
+		assert.Nil(err)
+		userStore.Close()
+
+		// while callers for the same store wait for it and share it
+		second := make(chan *userstore)
+		go func() {
+			userStore, err := manager.ForUser(slow)
+			assert.Nil(err)
+			second <- userStore
+		}()
+		select {
+		case <-second:
+			t.Fatal("store was handed out before it was opened")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(unblock)
+		firstStore, secondStore := <-first, <-second
+		assert.Same(firstStore.db, secondStore.db)
+		firstStore.Close()
+		secondStore.Close()
+		assert.Equal(2, manager.openCount())
+	})
+
+	t.Run("Failed Open", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 4)
+
+		// a caller that can't open the store doesn't stop one that creates it
+		userID, _ := newTestKey(t)
+		_, err := manager.ForUser(userID)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+		userStore, err := manager.Create(&model.User{ID: userID, CreatedAt: time.Now().UTC(), Status: model.UserStatusActive})
+		assert.Nil(err)
+		userStore.Close()
+		userStore, err = manager.ForUser(userID)
+		assert.Nil(err)
+		userStore.Close()
+	})
+
+	t.Run("Concurrent Writes", func(t *testing.T) {
+		assert := assert.New(t)
+		manager := newTestManager(t, 4)
+		userID := newManagedUser(t, manager)
+
+		var wg sync.WaitGroup
+		var failed atomic.Int32
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				userStore, err := manager.ForUser(userID)
+				if err != nil {
+					failed.Add(1)
+					return
+				}
+				defer userStore.Close()
+				if err := userStore.PutInbox(newInboxEntry("sender")); err != nil {
+					failed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(int32(0), failed.Load())
+
+		userStore, err := manager.ForUser(userID)
+		assert.Nil(err)
+		defer userStore.Close()
+		var count int
+		assert.Nil(userStore.db.Get(&count, `select count(*) from inbox`))
+		assert.Equal(32, count)
+	})
+}
+
+// BenchmarkIngest compares writing inbox entries through a fresh database per
+// message, as the services did before the manager, with the managed pool.
+func BenchmarkIngest(b *testing.B) {
+	const users = 8
+
+	setup := func(b *testing.B) (*Manager, *testManagerConfig, []model.UserID) {
+		config := &testManagerConfig{testStoreConfig{b.TempDir()}, users}
+		manager := NewManager(config)
+		b.Cleanup(func() { manager.Close() })
+		userIDs := []model.UserID{}
+		for i := 0; i < users; i++ {
+			userID := model.UserID(fmt.Sprintf("benchuser%d", i))
+			userStore, err := manager.Create(&model.User{ID: userID, CreatedAt: time.Now().UTC()})
+			if err != nil {
+				b.Fatal(err)
+			}
+			userStore.Close()
+			userIDs = append(userIDs, userID)
+		}
+		return manager, config, userIDs
+	}
+
+	b.Run("Unpooled", func(b *testing.B) {
+		manager, config, userIDs := setup(b)
+		manager.Close()
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				userID := userIDs[next.Add(1)%users]
+				userStore, err := ForUser(userID, config)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err := userStore.PutInbox(newInboxEntry("sender")); err != nil {
+					b.Error(err)
+				}
+				userStore.Close()
+			}
+		})
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		manager, _, userIDs := setup(b)
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				userID := userIDs[next.Add(1)%users]
+				userStore, err := manager.ForUser(userID)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err := userStore.PutInbox(newInboxEntry("sender")); err != nil {
+					b.Error(err)
+				}
+				userStore.Close()
+			}
+		})
+	})
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql migrations/directory/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	script  string
+}
+
+// migrations are the schema changes for user stores, ordered by version.
+// Each file is named <version>_<description>.sql and is applied once, in its
+// own transaction.
+var migrations = mustLoadMigrations(migrationFiles, "migrations")
+
+// migrated remembers the database files this process has already brought up
+// to date, so reopening a store doesn't have to check again.
+var migrated sync.Map
+
+func mustLoadMigrations(files fs.FS, dir string) []migration {
+	loaded, err := loadMigrations(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return loaded
+}
+
+func loadMigrations(files fs.FS, dir string) ([]migration, error) {
+	names, err := fs.Glob(files, dir+"/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("listing migrations: %w", err)
+	}
+
+	loaded := make([]migration, 0, len(names))
+	for _, name := range names {
+		base := strings.TrimPrefix(name, dir+"/")
+		prefix, _, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("parsing migration version from %s: %w", base, err)
+		}
+		script, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", base, err)
+		}
+		loaded = append(loaded, migration{version, base, string(script)})
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].version < loaded[j].version })
+	for i, m := range loaded {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", m.name, i+1)
+		}
+	}
+
+	return loaded, nil
+}
+
+// LatestSchemaVersion is the version a user store has once every migration
+// has been applied.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// migrate applies any outstanding migrations to the store at dbName. Every
+// step runs in a BEGIN IMMEDIATE transaction that re-reads the current
+// version first, so concurrent opens of the same file apply each migration
+// exactly once.
+func migrate(db *sqlx.DB, dbName string) error {
+	if _, ok := migrated.Load(dbName); ok {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+
+	var version int
+	err = immediate(ctx, conn, func() error {
+		version, err = schemaVersion(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("store schema version %d is newer than this binary supports (%d)", version, LatestSchemaVersion())
+	}
+
+	for _, m := range migrations[version:] {
+		err := immediate(ctx, conn, func() error {
+			// another connection may have got here first
+			version, err := schemaVersion(ctx, conn)
+			if err != nil || version >= m.version {
+				return err
+			}
+
+			if _, err := conn.ExecContext(ctx, m.script); err != nil {
+				return err
+			}
+			_, err = conn.ExecContext(ctx, `insert into schema_version (Version, AppliedAt) values (?, ?)`,
+				m.version, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("recording schema version: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+	}
+
+	migrated.Store(dbName, struct{}{})
+	return nil
+}
+
+// immediate runs fn in a transaction that takes the write lock up front, so
+// two connections can't both read the version and then try to upgrade.
+func immediate(ctx context.Context, conn *sqlx.Conn, fn func() error) error {
+	if _, err := conn.ExecContext(ctx, `begin immediate`); err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	if err := fn(); err != nil {
+		conn.ExecContext(ctx, `rollback`)
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `commit`); err != nil {
+		return fmt.Errorf("committing: %w", err)
+	}
+	return nil
+}
+
+// schemaVersion reads the store's version, creating the schema_version table
+// if needed. Stores created before versioning already have the initial
+// tables, so they start at version 1.
+func schemaVersion(ctx context.Context, conn *sqlx.Conn) (int, error) {
+	_, err := conn.ExecContext(ctx, `create table if not exists schema_version(
+		Version   integer not null primary key,
+		AppliedAt DATETIME not null
+	)`)
+	if err != nil {
+		return 0, fmt.Errorf("creating schema_version table: %w", err)
+	}
+
+	var version int
+	err = conn.GetContext(ctx, &version, `select coalesce(max(Version), 0) from schema_version`)
+	if err != nil {
+		return 0, fmt.Errorf("fetching schema version: %w", err)
+	}
+	if version > 0 {
+		return version, nil
+	}
+
+	var name string
+	err = conn.GetContext(ctx, &name, `select name from sqlite_master where type = 'table' and name = 'user'`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("checking for unversioned store: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `insert into schema_version (Version, AppliedAt) values (1, ?)`, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("recording schema version: %w", err)
+	}
+	return 1, nil
+}
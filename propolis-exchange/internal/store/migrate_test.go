@@ -0,0 +1,128 @@
+package store
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type testStoreConfig struct {
+	dataDir string
+}
+
+func (c *testStoreConfig) DataDirectory() string {
+	return c.dataDir
+}
+
+func appliedVersions(t *testing.T, s *userstore) []int {
+	versions := []int{}
+	if err := s.db.Select(&versions, `select Version from schema_version order by Version`); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func TestMigrations(t *testing.T) {
+	t.Run("Unversioned Store", func(t *testing.T) {
+		assert := assert.New(t)
+		config := &testStoreConfig{t.TempDir()}
+		userID, _ := newTestKey(t)
+
+		// a store as created before migrations existed, or stores were sharded
+		db, err := sqlx.Connect("sqlite3", "file:"+path.Join(config.dataDir, string(userID)+".db"))
+		assert.Nil(err)
+		_, err = db.Exec(migrations[0].script)
+		assert.Nil(err)
+		_, err = db.Exec(`insert into user (ID, CreatedAt, Handle, Email, Profile, Password, PrivateKey, PublicKey)
+			values (?, ?, 'legacy', 'legacy@testdomain.com', '{}', '', '', '')`, userID, time.Now().UTC())
+		assert.Nil(err)
+		_, err = db.Exec(`insert into outbox (ID, CreatedAt, SenderAddress, RecipientAddress, Hash, ContentType, Payload, Signature)
+			values ('entry', ?, '', '', '', '', '', '')`, time.Now().UTC())
+		assert.Nil(err)
+		db.Close()
+		assert.Nil(Relocate(config, userID))
+
+		s, err := ForUser(userID, config)
+		assert.Nil(err)
+		defer s.Close()
+
+		versions := appliedVersions(t, s)
+		assert.Len(versions, LatestSchemaVersion())
+		assert.Equal(LatestSchemaVersion(), versions[len(versions)-1])
+
+		user, err := s.Fetch()
+		assert.Nil(err)
+		assert.Equal(model.UserStatusActive, user.Status)
+		assert.Equal("", user.RecoveryKey)
+
+		entry, err := s.FetchOutbox("entry")
+		assert.Nil(err)
+		assert.Equal(entry.CreatedAt, entry.NextAttemptAt)
+
+		_, _, err = s.Timeline("", nil, 10)
+		assert.Nil(err)
+	})
+
+	t.Run("Concurrent Opens", func(t *testing.T) {
+		assert := assert.New(t)
+		config := &testStoreConfig{t.TempDir()}
+		userID, _ := newTestKey(t)
+
+		dbName, err := Path(config, userID)
+		assert.Nil(err)
+		assert.Nil(createShard(dbName))
+		file, err := os.Create(dbName)
+		assert.Nil(err)
+		file.Close()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s, err := ForUser(userID, config)
+				if err != nil {
+					errs <- err
+					return
+				}
+				s.Close()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.Nil(err)
+		}
+
+		s, err := ForUser(userID, config)
+		assert.Nil(err)
+		defer s.Close()
+		assert.Len(appliedVersions(t, s), LatestSchemaVersion())
+	})
+
+	t.Run("Sequence", func(t *testing.T) {
+		assert := assert.New(t)
+
+		loaded, err := loadMigrations(fstest.MapFS{
+			"migrations/0002_second.sql": {Data: []byte("select 2")},
+			"migrations/0001_first.sql":  {Data: []byte("select 1")},
+		}, "migrations")
+		assert.Nil(err)
+		assert.Equal("0001_first.sql", loaded[0].name)
+		assert.Equal(2, loaded[1].version)
+
+		_, err = loadMigrations(fstest.MapFS{
+			"migrations/0001_first.sql": {Data: []byte("select 1")},
+			"migrations/0003_third.sql": {Data: []byte("select 3")},
+		}, "migrations")
+		assert.NotNil(err)
+	})
+}
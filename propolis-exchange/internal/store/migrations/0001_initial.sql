@@ -0,0 +1,26 @@
+create table user(
+	ID text not null primary key,
+	CreatedAt      DATETIME not null,
+	UpdatedAt      DATETIME null,
+	LastLoggedInAt DATETIME null,
+	LoginAttempts  tinyint not null default 0,
+	Status         tinyint not null default 0,
+	Handle         text not null,
+	Email          text not null,
+	Profile        text not null,
+	Password       text not null,
+	PrivateKey     text not null,
+	PublicKey      text not null
+);
+
+create table outbox(
+	ID text not null primary key,
+	CreatedAt        DATETIME not null,
+	Status           tinyint not null default 0,
+	SenderAddress    text not null,
+	RecipientAddress text not null,
+	Hash             text not null,
+	ContentType      text not null,
+	Payload          text not null,
+	Signature        text not null
+);
@@ -0,0 +1,30 @@
+create table post(
+	ID text not null primary key,
+	CreatedAt     DATETIME not null,
+	Status        tinyint not null default 0,
+	AuthorAddress text not null,
+	Content       text not null,
+	Attachments   text not null,
+	InReplyTo     text not null default '',
+	Replaces      text not null default '',
+	ReplacedBy    text not null default '',
+	RepostOf      text not null default '',
+	Message       text not null
+);
+
+create table inbox(
+	ID text not null primary key,
+	ReceivedAt    DATETIME not null,
+	Timestamp     integer not null,
+	SenderAddress text not null,
+	ContentType   text not null,
+	Message       text not null
+);
+
+create table timeline(
+	PostID text not null primary key,
+	Timestamp     integer not null,
+	AuthorAddress text not null
+);
+
+create index timeline_order on timeline(Timestamp, PostID);
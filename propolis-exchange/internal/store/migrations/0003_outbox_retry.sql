@@ -0,0 +1,5 @@
+alter table outbox add column Attempts integer not null default 0;
+alter table outbox add column NextAttemptAt DATETIME not null default '';
+alter table outbox add column LastError text not null default '';
+
+update outbox set NextAttemptAt = CreatedAt;
@@ -0,0 +1,6 @@
+alter table user add column LockedUntil DATETIME null;
+alter table user add column VerificationToken text not null default '';
+alter table user add column RecoveryKey text not null default '';
+
+-- users created before verification existed have already been in use
+update user set Status = 1 where Status = 0;
@@ -0,0 +1,22 @@
+-- people following this user. Responded is set once an accept has been sent
+-- for an accepted follower, which for automatic approvals waits until the
+-- user has a session to sign it with.
+create table follower(
+	Address   text not null primary key,
+	Status    tinyint not null,
+	RequestID text not null,
+	Responded boolean not null default 0,
+	CreatedAt DATETIME not null,
+	UpdatedAt DATETIME null
+);
+
+-- people this user follows or has asked to follow
+create table following(
+	Address   text not null primary key,
+	Status    tinyint not null,
+	RequestID text not null,
+	CreatedAt DATETIME not null,
+	UpdatedAt DATETIME null
+);
+
+alter table user add column ApproveFollowers boolean not null default 0;
@@ -0,0 +1,3 @@
+-- an outbox entry now delivers to every recipient on one server, listed comma
+-- separated. Existing entries have a single recipient so are already valid.
+alter table outbox rename column RecipientAddress to Recipients;
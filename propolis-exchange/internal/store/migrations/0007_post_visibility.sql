@@ -0,0 +1,3 @@
+-- posts from before visibility existed were public
+alter table post add column Visibility text not null default 'public';
+alter table post add column Recipients text not null default '';
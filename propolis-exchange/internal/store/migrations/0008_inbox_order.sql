@@ -0,0 +1,2 @@
+-- direct messages are read from the inbox newest first, by content type
+create index inbox_order on inbox(ContentType, Timestamp, ID);
@@ -0,0 +1,7 @@
+-- messages may say when they stop being valid. Expired posts and inbox
+-- entries are left out of reads until they are purged.
+alter table post add column ExpiresAt DATETIME null;
+alter table inbox add column ExpiresAt DATETIME null;
+
+create index post_expiry on post(ExpiresAt) where ExpiresAt is not null;
+create index inbox_expiry on inbox(ExpiresAt) where ExpiresAt is not null;
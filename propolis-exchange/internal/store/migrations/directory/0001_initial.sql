@@ -0,0 +1,12 @@
+create table directory(
+	user_id    text not null primary key,
+	handle     text not null,
+	email      text not null,
+	status     smallint not null default 0,
+	location   text not null,
+	created_at timestamp not null,
+	updated_at timestamp null
+);
+
+create index directory_handle on directory(handle);
+create index directory_email on directory(email);
@@ -0,0 +1,9 @@
+-- handles and emails are stored normalised, so plain unique indexes give
+-- case-insensitive uniqueness
+update directory set handle = lower(trim(handle)), email = lower(trim(email));
+
+drop index directory_handle;
+drop index directory_email;
+
+create unique index directory_handle_unique on directory(handle);
+create unique index directory_email_unique on directory(email);
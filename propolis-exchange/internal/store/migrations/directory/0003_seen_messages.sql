@@ -0,0 +1,10 @@
+-- messages ingest has accepted, one row per recipient, kept until the
+-- message would be rejected as stale anyway
+create table seen_messages(
+	message_id text not null,
+	recipient  text not null,
+	expires_at timestamp not null,
+	primary key (message_id, recipient)
+);
+
+create index seen_messages_expires_at on seen_messages(expires_at);
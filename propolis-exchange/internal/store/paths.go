@@ -0,0 +1,188 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+// shardLength is how many leading characters of a user ID name the
+// subdirectory its store lives in. IDs are base58, so this spreads users over
+// a few thousand directories rather than keeping them all in one.
+const shardLength = 2
+
+// Location is where a user's store lives, relative to the data directory.
+func Location(userID model.UserID) string {
+	id := string(userID)
+	shard := id
+	if len(shard) > shardLength {
+		shard = shard[:shardLength]
+	}
+	return filepath.Join(shard, id+".db")
+}
+
+// Path resolves the file holding a user's store. Every store is found through
+// here so that they don't depend on the working directory.
+func Path(config Config, userID model.UserID) (string, error) {
+	dataDir, err := dataDirectory(config)
+	if err != nil {
+		return "", err
+	}
+	if !isValidUserID(userID) {
+		return "", model.ErrorUserNotFound
+	}
+	return filepath.Join(dataDir, Location(userID)), nil
+}
+
+// createShard makes the directory that a new store at dbName goes in.
+func createShard(dbName string) error {
+	if err := os.MkdirAll(filepath.Dir(dbName), 0o755); err != nil {
+		return fmt.Errorf("creating shard directory: %w", err)
+	}
+	return nil
+}
+
+func dataDirectory(config Config) (string, error) {
+	dataDir := config.DataDirectory()
+	if !filepath.IsAbs(dataDir) {
+		return "", fmt.Errorf("data directory %q is not an absolute path", dataDir)
+	}
+	return dataDir, nil
+}
+
+// isValidUserID stops IDs from reaching outside the data directory.
+func isValidUserID(userID model.UserID) bool {
+	if userID == "" {
+		return false
+	}
+	for _, r := range userID {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// UserIDs lists the users that have a store in the data directory.
+func UserIDs(config Config) ([]model.UserID, error) {
+	dataDir, err := dataDirectory(config)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading data directory: %w", err)
+	}
+
+	userIDs := []model.UserID{}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		ids, err := storesIn(filepath.Join(dataDir, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, userID := range ids {
+			if Location(userID) == filepath.Join(shard.Name(), string(userID)+".db") {
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+
+	return userIDs, nil
+}
+
+// UnshardedUserIDs lists the users whose stores are still at the top of the
+// data directory, where they were kept before stores were sharded.
+func UnshardedUserIDs(config Config) ([]model.UserID, error) {
+	dataDir, err := dataDirectory(config)
+	if err != nil {
+		return nil, err
+	}
+	return storesIn(dataDir)
+}
+
+func storesIn(dir string) ([]model.UserID, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading data directory: %w", err)
+	}
+
+	userIDs := []model.UserID{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".db") {
+			continue
+		}
+		userID := model.UserID(strings.TrimSuffix(file.Name(), ".db"))
+		if isValidUserID(userID) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	return userIDs, nil
+}
+
+// Relocate moves an unsharded store into its shard. The store is checkpointed
+// first so that its write-ahead log is empty, and any -wal and -shm files are
+// moved alongside it regardless. Nothing else may have the store open.
+func Relocate(config Config, userID model.UserID) error {
+	dataDir, err := dataDirectory(config)
+	if err != nil {
+		return err
+	}
+	if !isValidUserID(userID) {
+		return model.ErrorUserNotFound
+	}
+
+	from := filepath.Join(dataDir, string(userID)+".db")
+	to := filepath.Join(dataDir, Location(userID))
+
+	if _, err := os.Stat(from); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.ErrorUserNotFound
+		}
+		return fmt.Errorf("checking if database exists: %w", err)
+	}
+	if _, err := os.Stat(to); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s already exists", to)
+	}
+
+	if err := checkpoint(from); err != nil {
+		return err
+	}
+
+	if err := createShard(to); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return fmt.Errorf("moving database: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err := os.Rename(from+suffix, to+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("moving database %s file: %w", suffix, err)
+		}
+	}
+
+	return nil
+}
+
+func checkpoint(dbName string) error {
+	db, err := sqlx.Connect("sqlite3", "file:"+dbName+"?_busy_timeout=5000")
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("checkpointing database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+func TestPaths(t *testing.T) {
+	t.Run("Sharded", func(t *testing.T) {
+		assert := assert.New(t)
+		config := &testStoreConfig{t.TempDir()}
+		userID, _ := newTestKey(t)
+
+		s, err := NewUserStore(&model.User{ID: userID, CreatedAt: time.Now().UTC()}, config)
+		assert.Nil(err)
+		s.Close()
+
+		_, err = os.Stat(filepath.Join(config.dataDir, string(userID)[:2], string(userID)+".db"))
+		assert.Nil(err)
+
+		userIDs, err := UserIDs(config)
+		assert.Nil(err)
+		assert.Equal([]model.UserID{userID}, userIDs)
+	})
+
+	t.Run("Relative Data Directory", func(t *testing.T) {
+		assert := assert.New(t)
+		userID, _ := newTestKey(t)
+
+		_, err := ForUser(userID, &testStoreConfig{"data"})
+		assert.ErrorContains(err, "not an absolute path")
+		_, err = NewUserStore(&model.User{ID: userID}, &testStoreConfig{"data"})
+		assert.ErrorContains(err, "not an absolute path")
+	})
+
+	t.Run("Invalid ID", func(t *testing.T) {
+		assert := assert.New(t)
+		config := &testStoreConfig{t.TempDir()}
+
+		_, err := ForUser("../user", config)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+	})
+
+	t.Run("Relocate", func(t *testing.T) {
+		assert := assert.New(t)
+		config := &testStoreConfig{t.TempDir()}
+		userID, _ := newTestKey(t)
+
+		// a store as kept before sharding, with its log not yet checkpointed
+		db, err := openDB(filepath.Join(config.dataDir, string(userID)+".db"))
+		assert.Nil(err)
+		assert.Nil(newUserstore(string(userID), db).createUser(&model.User{ID: userID, Handle: "flat", CreatedAt: time.Now().UTC()}))
+		_, err = os.Stat(filepath.Join(config.dataDir, string(userID)+".db-wal"))
+		assert.Nil(err)
+		db.Close()
+
+		_, err = ForUser(userID, config)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+
+		unsharded, err := UnshardedUserIDs(config)
+		assert.Nil(err)
+		assert.Equal([]model.UserID{userID}, unsharded)
+
+		assert.Nil(Relocate(config, userID))
+
+		unsharded, err = UnshardedUserIDs(config)
+		assert.Nil(err)
+		assert.Empty(unsharded)
+
+		s, err := ForUser(userID, config)
+		assert.Nil(err)
+		defer s.Close()
+		user, err := s.Fetch()
+		assert.Nil(err)
+		assert.Equal("flat", user.Handle)
+
+		assert.ErrorIs(Relocate(config, userID), model.ErrorUserNotFound)
+	})
+}
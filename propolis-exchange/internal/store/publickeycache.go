@@ -1,66 +1,185 @@
 package store
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/nrednav/cuid2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"uk.co.dudmesh.propolis/internal/model"
 	"uk.co.dudmesh.propolis/pkg/crypt"
 )
 
+type PublicKeyCacheConfig interface {
+	PublicKeyCacheTTL() time.Duration
+	PublicKeyCacheMaxEntries() int
+	PublicKeyCacheSweepInterval() time.Duration
+}
+
+var (
+	publicKeyCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "public_key_cache",
+		Name:      "hits_total",
+		Help:      "Number of public key lookups served from the cache.",
+	})
+	publicKeyCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "public_key_cache",
+		Name:      "misses_total",
+		Help:      "Number of public key lookups not found in the cache or expired.",
+	})
+	publicKeyCacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "public_key_cache",
+		Name:      "evictions_total",
+		Help:      "Number of public keys removed from the cache, by reason.",
+	}, []string{"reason"})
+)
+
 type publicKeyCache struct {
-	db *sqlx.DB
+	db         *sqlx.DB
+	ttl        time.Duration
+	maxEntries int
+	done       chan struct{}
+	once       sync.Once
+	wg         sync.WaitGroup
 }
 
-func NewPublicKeyCache() (*publicKeyCache, error) {
-	db, err := sqlx.Connect("sqlite3", "file:publickeycache.db?mode=memory&cache=shared")
+func NewPublicKeyCache(config PublicKeyCacheConfig) (*publicKeyCache, error) {
+	// each cache gets its own in-memory database, held open by a single
+	// connection so that it isn't dropped when the pool goes idle
+	db, err := sqlx.Connect("sqlite3", "file:publickeycache-"+cuid2.Generate()+"?mode=memory&cache=shared")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
 
-	publicKeyCache := &publicKeyCache{db}
+	publicKeyCache := &publicKeyCache{
+		db:         db,
+		ttl:        config.PublicKeyCacheTTL(),
+		maxEntries: config.PublicKeyCacheMaxEntries(),
+		done:       make(chan struct{}),
+	}
 	publicKeyCache.init()
 
+	publicKeyCache.wg.Add(1)
+	go publicKeyCache.sweep(config.PublicKeyCacheSweepInterval())
+
 	return publicKeyCache, nil
 }
 
 func (s *publicKeyCache) init() {
-	// TODO run a gofunc to periodically clear the cache
 	s.db.MustExec(`create table if not exists public_key_cache (
 		user_id text primary key,
-		key text
+		key text not null,
+		expires_at integer not null,
+		last_used_at integer not null
 	)`)
+	s.db.MustExec(`create index if not exists public_key_cache_expires_at on public_key_cache(expires_at)`)
+	s.db.MustExec(`create index if not exists public_key_cache_last_used_at on public_key_cache(last_used_at)`)
 }
 
 func (s *publicKeyCache) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
 	return s.db.Close()
 }
 
-func (s *publicKeyCache) Get(userID model.UserID) (*ecdsa.PublicKey, error) {
+func (s *publicKeyCache) Get(userID model.UserID) (crypto.PublicKey, error) {
+	now := time.Now().UnixMilli()
+
 	var key string
-	err := s.db.Get(&key, "SELECT key FROM public_key_cache WHERE user_id = ?", userID)
+	err := s.db.Get(&key, "SELECT key FROM public_key_cache WHERE user_id = ? AND expires_at > ?", userID, now)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			publicKeyCacheMisses.Inc()
 			return nil, model.ErrorUserNotFound
 		}
 		return nil, fmt.Errorf("getting public key from cache: %w", err)
 	}
+	publicKeyCacheHits.Inc()
+
+	_, err = s.db.Exec("UPDATE public_key_cache SET last_used_at = ? WHERE user_id = ?", now, userID)
+	if err != nil {
+		return nil, fmt.Errorf("touching public key in cache: %w", err)
+	}
 
 	return crypt.DecodePublicKey(key)
 }
 
-func (s *publicKeyCache) Set(userID model.UserID, key *ecdsa.PublicKey) error {
+func (s *publicKeyCache) Set(userID model.UserID, key crypto.PublicKey) error {
 	encodedKey, err := crypt.EncodePublicKey(key, string(userID))
 	if err != nil {
 		return fmt.Errorf("encoding public key: %w", err)
 	}
-	_, err = s.db.Exec("INSERT INTO public_key_cache (user_id, key) VALUES (?, ?)", userID, encodedKey)
+
+	now := time.Now()
+	_, err = s.db.Exec(`INSERT INTO public_key_cache (user_id, key, expires_at, last_used_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET key = excluded.key, expires_at = excluded.expires_at, last_used_at = excluded.last_used_at`,
+		userID, encodedKey, now.Add(s.ttl).UnixMilli(), now.UnixMilli())
 	if err != nil {
 		return fmt.Errorf("setting public key in cache: %w", err)
 	}
+
+	return s.evictLeastRecentlyUsed()
+}
+
+func (s *publicKeyCache) evictLeastRecentlyUsed() error {
+	if s.maxEntries <= 0 {
+		return nil
+	}
+
+	res, err := s.db.Exec(`DELETE FROM public_key_cache WHERE user_id IN (
+		SELECT user_id FROM public_key_cache ORDER BY last_used_at ASC
+		LIMIT max((SELECT count(*) FROM public_key_cache) - ?, 0)
+	)`, s.maxEntries)
+	if err != nil {
+		return fmt.Errorf("evicting public keys from cache: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		publicKeyCacheEvictions.WithLabelValues("capacity").Add(float64(rows))
+	}
+
+	return nil
+}
+
+func (s *publicKeyCache) evictExpired() error {
+	res, err := s.db.Exec("DELETE FROM public_key_cache WHERE expires_at <= ?", time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("evicting expired public keys from cache: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		publicKeyCacheEvictions.WithLabelValues("expired").Add(float64(rows))
+	}
 	return nil
 }
+
+func (s *publicKeyCache) sweep(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.evictExpired(); err != nil {
+				log.Errorf("sweeping public key cache: %+v", err)
+			}
+		}
+	}
+}
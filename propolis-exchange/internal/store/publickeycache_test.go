@@ -0,0 +1,137 @@
+package store
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+type testCacheConfig struct {
+	ttl        time.Duration
+	maxEntries int
+}
+
+func (c *testCacheConfig) PublicKeyCacheTTL() time.Duration {
+	return c.ttl
+}
+
+func (c *testCacheConfig) PublicKeyCacheMaxEntries() int {
+	return c.maxEntries
+}
+
+func (c *testCacheConfig) PublicKeyCacheSweepInterval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func newTestKey(t *testing.T) (model.UserID, *ecdsa.PublicKey) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.UserID(user.IDFromPublicKey(&privateKey.PublicKey)), &privateKey.PublicKey
+}
+
+func (s *publicKeyCache) count() int {
+	var count int
+	s.db.Get(&count, "SELECT count(*) FROM public_key_cache")
+	return count
+}
+
+func TestPublicKeyCache(t *testing.T) {
+	t.Run("Upsert", func(t *testing.T) {
+		assert := assert.New(t)
+		cache, err := NewPublicKeyCache(&testCacheConfig{time.Minute, 10})
+		assert.Nil(err)
+		defer cache.Close()
+
+		userID, key := newTestKey(t)
+		_, otherKey := newTestKey(t)
+
+		misses := testutil.ToFloat64(publicKeyCacheMisses)
+		_, err = cache.Get(userID)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+		assert.Equal(misses+1, testutil.ToFloat64(publicKeyCacheMisses))
+
+		assert.Nil(cache.Set(userID, key))
+		assert.Nil(cache.Set(userID, otherKey))
+
+		hits := testutil.ToFloat64(publicKeyCacheHits)
+		cached, err := cache.Get(userID)
+		assert.Nil(err)
+		assert.True(otherKey.Equal(cached))
+		assert.Equal(hits+1, testutil.ToFloat64(publicKeyCacheHits))
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		assert := assert.New(t)
+		cache, err := NewPublicKeyCache(&testCacheConfig{time.Minute, 10})
+		assert.Nil(err)
+		defer cache.Close()
+
+		key, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(err)
+		userID := model.UserID(user.IDFromPublicKey(key))
+
+		assert.Nil(cache.Set(userID, key))
+		cached, err := cache.Get(userID)
+		assert.Nil(err)
+		assert.Equal(key, cached)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		assert := assert.New(t)
+		cache, err := NewPublicKeyCache(&testCacheConfig{20 * time.Millisecond, 10})
+		assert.Nil(err)
+		defer cache.Close()
+
+		userID, key := newTestKey(t)
+		assert.Nil(cache.Set(userID, key))
+		_, err = cache.Get(userID)
+		assert.Nil(err)
+
+		expired := testutil.ToFloat64(publicKeyCacheEvictions.WithLabelValues("expired"))
+		assert.Eventually(func() bool { return cache.count() == 0 }, time.Second, 5*time.Millisecond)
+		_, err = cache.Get(userID)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+		assert.Equal(expired+1, testutil.ToFloat64(publicKeyCacheEvictions.WithLabelValues("expired")))
+	})
+
+	t.Run("Least Recently Used", func(t *testing.T) {
+		assert := assert.New(t)
+		cache, err := NewPublicKeyCache(&testCacheConfig{time.Minute, 2})
+		assert.Nil(err)
+		defer cache.Close()
+
+		first, firstKey := newTestKey(t)
+		second, secondKey := newTestKey(t)
+		third, thirdKey := newTestKey(t)
+
+		assert.Nil(cache.Set(first, firstKey))
+		time.Sleep(2 * time.Millisecond)
+		assert.Nil(cache.Set(second, secondKey))
+		time.Sleep(2 * time.Millisecond)
+		_, err = cache.Get(first)
+		assert.Nil(err)
+		time.Sleep(2 * time.Millisecond)
+
+		capacity := testutil.ToFloat64(publicKeyCacheEvictions.WithLabelValues("capacity"))
+		assert.Nil(cache.Set(third, thirdKey))
+		assert.Equal(2, cache.count())
+		assert.Equal(capacity+1, testutil.ToFloat64(publicKeyCacheEvictions.WithLabelValues("capacity")))
+
+		_, err = cache.Get(second)
+		assert.ErrorIs(err, model.ErrorUserNotFound)
+		_, err = cache.Get(first)
+		assert.Nil(err)
+		_, err = cache.Get(third)
+		assert.Nil(err)
+	})
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+type SeenMessagesConfig interface {
+	DirectoryConfig
+	SeenMessagesSweepInterval() time.Duration
+}
+
+var (
+	seenMessagesReplays = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "seen_messages",
+		Name:      "replays_total",
+		Help:      "Number of message deliveries to a recipient that had already been accepted.",
+	})
+	seenMessagesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "propolis",
+		Subsystem: "seen_messages",
+		Name:      "expired_total",
+		Help:      "Number of seen message records removed once outside the acceptance window.",
+	})
+)
+
+// seenMessages records which recipients each ingested message has been
+// accepted for, so a message delivered again can be turned away. It lives in
+// the directory database so every instance sees the same record, and only
+// keeps a message for as long as it would pass the timestamp check.
+type seenMessages struct {
+	db   *sqlx.DB
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func NewSeenMessages(config SeenMessagesConfig) (*seenMessages, error) {
+	db, err := openDirectoryDB(config.DatabaseURL())
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateDirectory(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating directory: %w", err)
+	}
+
+	seen := &seenMessages{
+		db:   db,
+		done: make(chan struct{}),
+	}
+
+	seen.wg.Add(1)
+	go seen.sweep(config.SeenMessagesSweepInterval())
+
+	return seen, nil
+}
+
+func (s *seenMessages) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+// Claim marks a message as seen by each of the recipients, to be remembered
+// until expiresAt. It returns the recipients that hadn't seen it before, so
+// a delivery that repeats only some of them still reaches the rest.
+func (s *seenMessages) Claim(messageID string, recipients []model.UserAddress, expiresAt time.Time) ([]model.UserAddress, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	claimed := make([]model.UserAddress, 0, len(recipients))
+	for _, recipient := range recipients {
+		res, err := tx.Exec(tx.Rebind(`insert into seen_messages (message_id, recipient, expires_at) values (?, ?, ?)
+			on conflict (message_id, recipient) do nothing`), messageID, recipient, expiresAt.UTC())
+		if err != nil {
+			return nil, fmt.Errorf("claiming message: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("getting rows affected: %w", err)
+		}
+		if rows == 0 {
+			seenMessagesReplays.Inc()
+			continue
+		}
+		claimed = append(claimed, recipient)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing claims: %w", err)
+	}
+	return claimed, nil
+}
+
+// Release forgets claims made for a delivery that then failed, so that the
+// sender's retry isn't taken for a replay.
+func (s *seenMessages) Release(messageID string, recipients []model.UserAddress) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(`delete from seen_messages where message_id = ? and recipient in (?)`, messageID, recipients)
+	if err != nil {
+		return fmt.Errorf("building release query: %w", err)
+	}
+	if _, err := s.db.Exec(s.db.Rebind(query), args...); err != nil {
+		return fmt.Errorf("releasing message: %w", err)
+	}
+	return nil
+}
+
+func (s *seenMessages) evictExpired() error {
+	res, err := s.db.Exec(s.db.Rebind(`delete from seen_messages where expires_at <= ?`), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("evicting expired seen messages: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		seenMessagesExpired.Add(float64(rows))
+	}
+	return nil
+}
+
+func (s *seenMessages) sweep(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.evictExpired(); err != nil {
+				log.Errorf("sweeping seen messages: %+v", err)
+			}
+		}
+	}
+}
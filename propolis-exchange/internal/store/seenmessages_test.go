@@ -0,0 +1,94 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+	"uk.co.dudmesh.propolis/internal/store/storetest"
+)
+
+type testSeenMessagesConfig struct {
+	testDirectoryConfig
+}
+
+func (c *testSeenMessagesConfig) SeenMessagesSweepInterval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func newTestSeenMessages(t *testing.T) *seenMessages {
+	databaseURL, cleanup, err := storetest.DatabaseURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+
+	seen, err := NewSeenMessages(&testSeenMessagesConfig{testDirectoryConfig{databaseURL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seen.Close() })
+	return seen
+}
+
+func (s *seenMessages) count() int {
+	var count int
+	s.db.Get(&count, "select count(*) from seen_messages")
+	return count
+}
+
+func TestSeenMessages(t *testing.T) {
+	t.Run("Claim", func(t *testing.T) {
+		assert := assert.New(t)
+		seen := newTestSeenMessages(t)
+		expiresAt := time.Now().Add(time.Hour)
+
+		claimed, err := seen.Claim("message1", []model.UserAddress{"alice", "bob"}, expiresAt)
+		assert.Nil(err)
+		assert.Equal([]model.UserAddress{"alice", "bob"}, claimed)
+
+		replays := testutil.ToFloat64(seenMessagesReplays)
+		claimed, err = seen.Claim("message1", []model.UserAddress{"alice", "bob"}, expiresAt)
+		assert.Nil(err)
+		assert.Empty(claimed)
+		assert.Equal(replays+2, testutil.ToFloat64(seenMessagesReplays))
+
+		claimed, err = seen.Claim("message1", []model.UserAddress{"bob", "carol"}, expiresAt)
+		assert.Nil(err)
+		assert.Equal([]model.UserAddress{"carol"}, claimed)
+
+		claimed, err = seen.Claim("message2", []model.UserAddress{"alice"}, expiresAt)
+		assert.Nil(err)
+		assert.Equal([]model.UserAddress{"alice"}, claimed)
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		assert := assert.New(t)
+		seen := newTestSeenMessages(t)
+		expiresAt := time.Now().Add(time.Hour)
+
+		_, err := seen.Claim("message1", []model.UserAddress{"alice", "bob"}, expiresAt)
+		assert.Nil(err)
+		assert.Nil(seen.Release("message1", []model.UserAddress{"alice"}))
+
+		claimed, err := seen.Claim("message1", []model.UserAddress{"alice", "bob"}, expiresAt)
+		assert.Nil(err)
+		assert.Equal([]model.UserAddress{"alice"}, claimed)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		assert := assert.New(t)
+		seen := newTestSeenMessages(t)
+
+		_, err := seen.Claim("message1", []model.UserAddress{"alice"}, time.Now().Add(20*time.Millisecond))
+		assert.Nil(err)
+		_, err = seen.Claim("message2", []model.UserAddress{"alice"}, time.Now().Add(time.Hour))
+		assert.Nil(err)
+
+		expired := testutil.ToFloat64(seenMessagesExpired)
+		assert.Eventually(func() bool { return seen.count() == 1 }, time.Second, 5*time.Millisecond)
+		assert.Equal(expired+1, testutil.ToFloat64(seenMessagesExpired))
+	})
+}
@@ -0,0 +1,48 @@
+// Package storetest provides databases for tests that need the directory.
+package storetest
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/nrednav/cuid2"
+)
+
+// DatabaseURL returns a directory database URL for a test run, along with a
+// function that disposes of it. When TEST_DATABASE_URL points at a Postgres
+// server a fresh database is created there, so concurrently running packages
+// don't see each other's users. Otherwise an in-memory SQLite database stands
+// in for Postgres.
+func DatabaseURL() (string, func(), error) {
+	serverURL := os.Getenv("TEST_DATABASE_URL")
+	if serverURL == "" {
+		return "sqlite3:file:directory-" + cuid2.Generate() + "?mode=memory&cache=shared", func() {}, nil
+	}
+
+	db, err := sqlx.Connect("postgres", serverURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("connecting to test database server: %w", err)
+	}
+
+	name := "propolis_test_" + strings.ToLower(cuid2.Generate())
+	if _, err := db.Exec(`create database ` + name); err != nil {
+		db.Close()
+		return "", nil, fmt.Errorf("creating test database: %w", err)
+	}
+
+	databaseURL, err := url.Parse(serverURL)
+	if err != nil {
+		db.Close()
+		return "", nil, fmt.Errorf("parsing test database url: %w", err)
+	}
+	databaseURL.Path = "/" + name
+
+	return databaseURL.String(), func() {
+		db.Exec(`drop database if exists ` + name + ` with (force)`)
+		db.Close()
+	}, nil
+}
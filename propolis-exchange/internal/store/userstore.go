@@ -1,10 +1,12 @@
 package store
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"os"
-	"path"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
@@ -16,17 +18,24 @@ type Config interface {
 }
 
 type userstore struct {
-	userID string
-	db     *sqlx.DB
+	userID  string
+	db      *sqlx.DB
+	writeMu *sync.Mutex
+	release func() error
+}
+
+// newUserstore wraps a database that the store owns outright, so closing the
+// store closes it.
+func newUserstore(userID string, db *sqlx.DB) *userstore {
+	return &userstore{userID, db, &sync.Mutex{}, db.Close}
 }
 
 func NewUserStore(user *model.User, config Config) (*userstore, error) {
 	userID := string(user.ID)
-	curDir, err := os.Getwd()
+	dbName, err := Path(config, user.ID)
 	if err != nil {
-		return nil, fmt.Errorf("getting current directory: %w", err)
+		return nil, err
 	}
-	dbName := path.Join(curDir, config.DataDirectory(), userID+".db")
 
 	isCreating := false
 	_, err = os.Stat(dbName)
@@ -35,21 +44,22 @@ func NewUserStore(user *model.User, config Config) (*userstore, error) {
 			isCreating = true
 		}
 	}
+	if isCreating {
+		if err := createShard(dbName); err != nil {
+			return nil, err
+		}
+	}
 
-	db, err := sqlx.Connect("sqlite3", "file:"+dbName)
+	db, err := openDB(dbName)
 	if err != nil {
-		return nil, fmt.Errorf("opening database: %w", err)
+		return nil, err
 	}
 
-	datastore := &userstore{userID, db}
+	datastore := newUserstore(userID, db)
 	if isCreating {
-		err = datastore.createTables()
-		if err != nil {
-			db.Close()
-			return nil, fmt.Errorf("creating tables: %w", err)
-		}
 		err = datastore.createUser(user)
 		if err != nil {
+			db.Close()
 			return nil, fmt.Errorf("creating user metadata: %w", err)
 		}
 	}
@@ -58,9 +68,12 @@ func NewUserStore(user *model.User, config Config) (*userstore, error) {
 }
 
 func ForUser(userID model.UserID, config Config) (*userstore, error) {
-	dbName := path.Join(config.DataDirectory(), string(userID)+".db")
+	dbName, err := Path(config, userID)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := os.Stat(dbName)
+	_, err = os.Stat(dbName)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, model.ErrorUserNotFound
@@ -68,16 +81,58 @@ func ForUser(userID model.UserID, config Config) (*userstore, error) {
 		return nil, fmt.Errorf("checking if database exists: %w", err)
 	}
 
-	db, err := sqlx.Connect("sqlite3", "file:"+dbName)
+	db, err := openDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUserstore(string(userID), db), nil
+}
+
+// openDB connects to a user database and brings its schema up to date. WAL
+// lets reads carry on alongside a write, and busy_timeout makes a writer wait
+// for the lock, whether held by a migration or another process, rather than
+// failing. secure_delete zeroes deleted content rather than leaving it in
+// free pages of the file.
+func openDB(dbName string) (*sqlx.DB, error) {
+	unlock := lockOpen(dbName)
+	defer unlock()
+
+	db, err := sqlx.Connect("sqlite3", "file:"+dbName+"?_busy_timeout=5000&_journal_mode=WAL&_synchronous=NORMAL&_secure_delete=on")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
 
-	return &userstore{string(userID), db}, nil
+	if err := migrate(db, dbName); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+
+	return db, nil
+}
+
+// opens holds a mutex for each database file this process has opened.
+var opens sync.Map
+
+// lockOpen serialises opening a database file within the process. Switching a
+// new file to WAL fails straight away, rather than waiting on busy_timeout,
+// when another connection is switching it at the same time.
+func lockOpen(dbName string) func() {
+	mu, _ := opens.LoadOrStore(dbName, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
 }
 
 func (d *userstore) Close() error {
-	return d.db.Close()
+	return d.release()
+}
+
+// lockWrites serialises writes to the user's database so that concurrent
+// writers queue here instead of contending for SQLite's lock. Call the
+// returned function to unlock.
+func (d *userstore) lockWrites() func() {
+	d.writeMu.Lock()
+	return d.writeMu.Unlock
 }
 
 func (d *userstore) Fetch() (*model.User, error) {
@@ -89,47 +144,94 @@ func (d *userstore) Fetch() (*model.User, error) {
 	return user, nil
 }
 
-func (d *userstore) createTables() error {
-	_, err := d.db.Exec(`create table user(
-		ID text not null primary key,
-		CreatedAt      DATETIME not null,
-		UpdatedAt      DATETIME null,
-		LastLoggedInAt DATETIME null,
-		LoginAttempts  tinyint not null default 0,
-		Status         tinyint not null default 0,
-		Handle         text not null,
-		Email          text not null,
-		Profile        text not null,
-		Password       text not null,
-		PrivateKey     text not null,
-		PublicKey      text not null
-	)`)
-	if err != nil {
-		return fmt.Errorf("creating user table: %w", err)
-	}
-
-	_, err = d.db.Exec(`create table outbox(
-		ID text not null primary key,
-		CreatedAt        DATETIME not null,
-		Status           tinyint not null default 0,
-		SenderAddress    text not null,
-		RecipientAddress text not null,
-		Hash             text not null,
-		ContentType      text not null,
-		Payload          text not null,
-		Signature        text not null
-	)`)
-	if err != nil {
-		return fmt.Errorf("creating outbox table: %w", err)
+// UpdateStatus moves the user to a new status if the state machine allows it.
+// lockedUntil is only kept for locked users.
+func (d *userstore) UpdateStatus(status model.UserStatus, lockedUntil *time.Time) error {
+	defer d.lockWrites()()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current model.UserStatus
+	err = tx.Get(&current, `select Status from user where ID = ?`, d.userID)
+	if err != nil {
+		return fmt.Errorf("fetching user status: %w", err)
+	}
+	if !current.CanTransitionTo(status) {
+		return fmt.Errorf("%w: %d to %d", model.ErrorInvalidStatusTransition, current, status)
+	}
+	if status != model.UserStatusLocked {
+		lockedUntil = nil
+	}
+
+	_, err = tx.Exec(`update user set Status = ?, LockedUntil = ?, UpdatedAt = ?, VerificationToken = '' where ID = ?`,
+		status, lockedUntil, time.Now().UTC(), d.userID)
+	if err != nil {
+		return fmt.Errorf("updating user status: %w", err)
+	}
+	if status == model.UserStatusActive || status == model.UserStatusLocked {
+		// a lock starts the count afresh, so that once it runs out the user
+		// gets the full number of attempts again
+		_, err = tx.Exec(`update user set LoginAttempts = 0 where ID = ?`, d.userID)
+		if err != nil {
+			return fmt.Errorf("resetting login attempts: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateCredentials replaces the password hash and both encrypted copies of
+// the private key in one statement. previous is the user as it was read, so a
+// concurrent change to the same credentials is detected rather than lost.
+func (d *userstore) UpdateCredentials(previous *model.User, password, privateKey, recoveryKey string) error {
+	defer d.lockWrites()()
+
+	res, err := d.db.Exec(`update user set Password = ?, PrivateKey = ?, RecoveryKey = ?, UpdatedAt = ?
+		where ID = ? and Password = ? and PrivateKey = ? and RecoveryKey = ?`,
+		password, privateKey, recoveryKey, time.Now().UTC(),
+		d.userID, previous.Password, previous.PrivateKey, previous.RecoveryKey)
+	if err != nil {
+		return fmt.Errorf("updating credentials: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	} else if rows != 1 {
+		return model.ErrorCredentialsChanged
 	}
+	return nil
+}
 
+func (d *userstore) RecordLogin(at time.Time) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.Exec(`update user set LastLoggedInAt = ?, LoginAttempts = 0 where ID = ?`, at, d.userID)
+	if err != nil {
+		return fmt.Errorf("recording login: %w", err)
+	}
 	return nil
 }
 
+func (d *userstore) RecordFailedLogin() (int, error) {
+	defer d.lockWrites()()
+
+	var attempts int
+	err := d.db.Get(&attempts, `update user set LoginAttempts = LoginAttempts + 1 where ID = ? returning LoginAttempts`, d.userID)
+	if err != nil {
+		return 0, fmt.Errorf("recording failed login: %w", err)
+	}
+	return attempts, nil
+}
+
 func (d *userstore) createUser(user *model.User) error {
+	defer d.lockWrites()()
+
 	res, err := d.db.NamedExec(`insert into user
-		(ID, CreatedAt, Handle, Email, Profile, Password, PrivateKey, PublicKey)
-		values(:ID, :CreatedAt, :Handle, :Email, :Profile, :Password, :PrivateKey, :PublicKey)`, user)
+		(ID, CreatedAt, Status, Handle, Email, Profile, Password, PrivateKey, PublicKey, VerificationToken, RecoveryKey)
+		values(:ID, :CreatedAt, :Status, :Handle, :Email, :Profile, :Password, :PrivateKey, :PublicKey, :VerificationToken, :RecoveryKey)`, user)
 
 	if err != nil {
 		return fmt.Errorf("inserting user: %w", err)
@@ -143,20 +245,306 @@ func (d *userstore) createUser(user *model.User) error {
 	return nil
 }
 
-func (d *userstore) PutOutbox(message *model.Post) error {
-	panic("TODO")
-	// res, err := d.db.NamedExec(`insert into outbox
-	// 	(ID, CreatedAt, Status, SenderAddress, RecipientAddress, Hash, ContentType, Payload, Signature)
-	// 	values(:ID, :CreatedAt, :Status, :SenderAddress, :RecipientAddress, :Hash, :ContentType, :Payload, :Signature)`, message)
+func (d *userstore) PutPost(post *model.PostRecord) error {
+	defer d.lockWrites()()
 
-	// if err != nil {
-	// 	return fmt.Errorf("inserting outbox entry: %w", err)
-	// }
-	// if rows, err := res.RowsAffected(); rows != 1 {
-	// 	return fmt.Errorf("expected 1 row to be affected, got %d", rows)
-	// } else if err != nil {
-	// 	return fmt.Errorf("getting rows affected: %w", err)
-	// }
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
 
+	res, err := tx.NamedExec(`insert into post
+		(ID, CreatedAt, Status, AuthorAddress, Content, Attachments, InReplyTo, Replaces, ReplacedBy, RepostOf, Visibility, Recipients, ExpiresAt, Message)
+		values(:ID, :CreatedAt, :Status, :AuthorAddress, :Content, :Attachments, :InReplyTo, :Replaces, :ReplacedBy, :RepostOf, :Visibility, :Recipients, :ExpiresAt, :Message)`, post)
+
+	if err != nil {
+		return fmt.Errorf("inserting post: %w", err)
+	}
+	if rows, err := res.RowsAffected(); rows != 1 {
+		return fmt.Errorf("expected 1 row to be affected, got %d", rows)
+	} else if err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	}
+
+	_, err = tx.Exec(`insert into timeline (PostID, Timestamp, AuthorAddress) values(?, ?, ?)`,
+		post.ID, post.CreatedAt.UnixMilli(), post.AuthorAddress)
+	if err != nil {
+		return fmt.Errorf("inserting timeline entry: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// unexpired leaves out posts and inbox entries whose message has expired by
+// the time given as its parameter, until PurgeExpired deletes them.
+const unexpired = `(ExpiresAt is null or ExpiresAt > ?)`
+
+func (d *userstore) FetchPost(id model.PostID) (*model.PostRecord, error) {
+	post := &model.PostRecord{}
+	err := d.db.Get(post, `select * from post where ID = ? and `+unexpired, id, time.Now().UTC())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrorPostNotFound
+		}
+		return nil, fmt.Errorf("fetching post: %w", err)
+	}
+	return post, nil
+}
+
+// ReplacePost stores replacement as the next revision of the post it replaces
+// and links the previous revision to it.
+func (d *userstore) ReplacePost(replacement *model.PostRecord) error {
+	defer d.lockWrites()()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedExec(`insert into post
+		(ID, CreatedAt, Status, AuthorAddress, Content, Attachments, InReplyTo, Replaces, ReplacedBy, RepostOf, Visibility, Recipients, ExpiresAt, Message)
+		values(:ID, :CreatedAt, :Status, :AuthorAddress, :Content, :Attachments, :InReplyTo, :Replaces, :ReplacedBy, :RepostOf, :Visibility, :Recipients, :ExpiresAt, :Message)`, replacement)
+	if err != nil {
+		return fmt.Errorf("inserting post: %w", err)
+	}
+
+	res, err := tx.Exec(`update post set ReplacedBy = ? where ID = ? and ReplacedBy = ''`, replacement.ID, replacement.Replaces)
+	if err != nil {
+		return fmt.Errorf("updating replaced post: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	} else if rows != 1 {
+		return model.ErrorPostSuperseded
+	}
+
+	// the latest revision takes the place of the original in the timeline
+	res, err = tx.Exec(`update timeline set PostID = ? where PostID = ?`, replacement.ID, replacement.Replaces)
+	if err != nil {
+		return fmt.Errorf("updating timeline entry: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	} else if rows == 0 {
+		_, err = tx.Exec(`insert into timeline (PostID, Timestamp, AuthorAddress) values(?, ?, ?)`,
+			replacement.ID, replacement.CreatedAt.UnixMilli(), replacement.AuthorAddress)
+		if err != nil {
+			return fmt.Errorf("inserting timeline entry: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeletePost tombstones every revision of a post, clearing its content but
+// keeping the rows so that replies and revision links still resolve. Each
+// revision's signed message is replaced by the signed delete, and the inbox
+// and outbox copies of the originals are purged, so that nothing the author
+// deleted can still be served or re-verified.
+func (d *userstore) DeletePost(ids []model.PostID, tombstone string) error {
+	defer d.lockWrites()()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err = tx.Exec(`update post set Status = ?, Content = '', Attachments = '[]', Message = ? where ID = ?`,
+			model.PostStatusDeleted, tombstone, id)
+		if err != nil {
+			return fmt.Errorf("tombstoning post: %w", err)
+		}
+		_, err = tx.Exec(`delete from timeline where PostID = ?`, id)
+		if err != nil {
+			return fmt.Errorf("removing timeline entry: %w", err)
+		}
+		_, err = tx.Exec(`delete from inbox where ID = ?`, id)
+		if err != nil {
+			return fmt.Errorf("removing inbox entry: %w", err)
+		}
+		// deliveries of the original that haven't gone yet never will
+		_, err = tx.Exec(`update outbox set Payload = '', Signature = '',
+			Status = case when Status in (?, ?) then ? else Status end,
+			LastError = case when Status in (?, ?) then 'post deleted' else LastError end
+			where Hash = ?`,
+			model.PostStatusPending, model.PostStatusFailed, model.PostStatusFailedPermanent,
+			model.PostStatusPending, model.PostStatusFailed, id)
+		if err != nil {
+			return fmt.Errorf("purging outbox entries: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *userstore) PutInbox(entry *model.InboxEntry) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.NamedExec(`insert into inbox
+		(ID, ReceivedAt, Timestamp, SenderAddress, ContentType, ExpiresAt, Message)
+		values(:ID, :ReceivedAt, :Timestamp, :SenderAddress, :ContentType, :ExpiresAt, :Message)`, entry)
+	if err != nil {
+		return fmt.Errorf("inserting inbox entry: %w", err)
+	}
+	return nil
+}
+
+// Inbox returns up to limit inbox entries of a content type older than the
+// cursor, newest first, along with the cursor for the following page if there
+// is one. Cursors are as for timelines, with the entry ID in place of the post.
+func (d *userstore) Inbox(contentType string, cursor *model.TimelineCursor, limit int) ([]*model.InboxEntry, *model.TimelineCursor, error) {
+	entries := []*model.InboxEntry{}
+	now := time.Now().UTC()
+	var err error
+	if cursor == nil {
+		err = d.db.Select(&entries, `select * from inbox where ContentType = ? and `+unexpired+`
+			order by Timestamp desc, ID desc limit ?`, contentType, now, limit+1)
+	} else {
+		err = d.db.Select(&entries, `select * from inbox where ContentType = ? and `+unexpired+`
+			and (Timestamp < ? or (Timestamp = ? and ID < ?))
+			order by Timestamp desc, ID desc limit ?`,
+			contentType, now, cursor.Timestamp, cursor.Timestamp, cursor.PostID, limit+1)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching inbox: %w", err)
+	}
+
+	var next *model.TimelineCursor
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = &model.TimelineCursor{Timestamp: last.Timestamp, PostID: model.PostID(last.ID)}
+	}
+	return entries, next, nil
+}
+
+type timelineRow struct {
+	TimelineTimestamp int64 `db:"TimelineTimestamp"`
+	model.PostRecord
+}
+
+// visibleToOwner limits posts to those the owner, whose address is the
+// parameter, can still read. Direct posts were checked on arrival, but
+// followers posts are hidden again once the owner stops following the author.
+const visibleToOwner = `(p.Visibility != 'followers' or p.AuthorAddress = ?
+	or exists (select 1 from following f where f.Address = p.AuthorAddress and f.Status = ?))`
+
+// Timeline returns up to limit posts older than the cursor, newest first,
+// along with the cursor for the following page if there is one. self is the
+// owner's address.
+func (d *userstore) Timeline(self model.UserAddress, cursor *model.TimelineCursor, limit int) ([]*model.PostRecord, *model.TimelineCursor, error) {
+	rows := []*timelineRow{}
+	now := time.Now().UTC()
+	var err error
+	if cursor == nil {
+		err = d.db.Select(&rows, `select t.Timestamp as TimelineTimestamp, p.*
+			from timeline t join post p on p.ID = t.PostID
+			where `+visibleToOwner+` and `+unexpired+`
+			order by t.Timestamp desc, t.PostID desc limit ?`,
+			self, model.FollowStatusAccepted, now, limit+1)
+	} else {
+		err = d.db.Select(&rows, `select t.Timestamp as TimelineTimestamp, p.*
+			from timeline t join post p on p.ID = t.PostID
+			where (t.Timestamp < ? or (t.Timestamp = ? and t.PostID < ?)) and `+visibleToOwner+` and `+unexpired+`
+			order by t.Timestamp desc, t.PostID desc limit ?`,
+			cursor.Timestamp, cursor.Timestamp, cursor.PostID, self, model.FollowStatusAccepted, now, limit+1)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching timeline: %w", err)
+	}
+
+	var next *model.TimelineCursor
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[limit-1]
+		next = &model.TimelineCursor{Timestamp: last.TimelineTimestamp, PostID: last.ID}
+	}
+
+	posts := make([]*model.PostRecord, 0, len(rows))
+	for _, row := range rows {
+		post := row.PostRecord
+		posts = append(posts, &post)
+	}
+
+	return posts, next, nil
+}
+
+func (d *userstore) PutOutbox(entries []*model.OutboxEntry) error {
+	defer d.lockWrites()()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		res, err := tx.NamedExec(`insert into outbox
+			(ID, CreatedAt, Status, SenderAddress, Recipients, Hash, ContentType, Payload, Signature, Attempts, NextAttemptAt, LastError)
+			values(:ID, :CreatedAt, :Status, :SenderAddress, :Recipients, :Hash, :ContentType, :Payload, :Signature, :Attempts, :NextAttemptAt, :LastError)`, entry)
+
+		if err != nil {
+			return fmt.Errorf("inserting outbox entry: %w", err)
+		}
+		if rows, err := res.RowsAffected(); rows != 1 {
+			return fmt.Errorf("expected 1 row to be affected, got %d", rows)
+		} else if err != nil {
+			return fmt.Errorf("getting rows affected: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DueOutbox returns entries awaiting a delivery attempt at or before the given
+// time, oldest first.
+func (d *userstore) DueOutbox(before time.Time, limit int) ([]*model.OutboxEntry, error) {
+	entries := []*model.OutboxEntry{}
+	err := d.db.Select(&entries, `select * from outbox
+		where Status in (?, ?) and NextAttemptAt <= ?
+		order by NextAttemptAt limit ?`,
+		model.PostStatusPending, model.PostStatusFailed, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("fetching outbox entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (d *userstore) FetchOutbox(id string) (*model.OutboxEntry, error) {
+	entry := &model.OutboxEntry{}
+	err := d.db.Get(entry, `select * from outbox where ID = ?`, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrorOutboxEntryNotFound
+		}
+		return nil, fmt.Errorf("fetching outbox entry: %w", err)
+	}
+	return entry, nil
+}
+
+func (d *userstore) CountPendingOutbox() (int, error) {
+	var count int
+	err := d.db.Get(&count, `select count(*) from outbox where Status in (?, ?)`, model.PostStatusPending, model.PostStatusFailed)
+	if err != nil {
+		return 0, fmt.Errorf("counting outbox entries: %w", err)
+	}
+	return count, nil
+}
+
+// UpdateOutbox records the outcome of a delivery attempt. An entry purged
+// while it was being delivered is left as it is, so that the purge stands.
+func (d *userstore) UpdateOutbox(entry *model.OutboxEntry) error {
+	defer d.lockWrites()()
+
+	_, err := d.db.NamedExec(`update outbox set
+		Status = :Status, Attempts = :Attempts, NextAttemptAt = :NextAttemptAt, LastError = :LastError
+		where ID = :ID and Payload != ''`, entry)
+	if err != nil {
+		return fmt.Errorf("updating outbox entry: %w", err)
+	}
 	return nil
 }
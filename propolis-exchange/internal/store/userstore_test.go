@@ -0,0 +1,109 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/internal/model"
+)
+
+// find returns the tables holding a value that contains text.
+func (d *userstore) find(t *testing.T, text string) []string {
+	tables := []string{}
+	if err := d.db.Select(&tables, `select name from sqlite_master where type = 'table'`); err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	for _, table := range tables {
+		rows, err := d.db.Queryx(`select * from ` + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			values, err := rows.SliceScan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range values {
+				if v, ok := value.([]byte); ok {
+					value = string(v)
+				}
+				if strings.Contains(fmt.Sprint(value), text) {
+					found = append(found, table)
+				}
+			}
+		}
+		rows.Close()
+	}
+	return found
+}
+
+func TestDeletePost(t *testing.T) {
+	assert := assert.New(t)
+
+	manager := newTestManager(t, 4)
+	userID := newManagedUser(t, manager)
+	userStore, err := manager.ForUser(userID)
+	assert.Nil(err)
+	defer userStore.Close()
+
+	const author model.UserAddress = "author@remote.example.com"
+	const original = "originalheader.originalpayload"
+	const content = "something to take back"
+
+	post := newTestPost(author, nil)
+	post.Content = content
+	post.Message = original + ".originalsignature"
+	assert.Nil(userStore.PutPost(post))
+
+	entry := newInboxEntry(author)
+	entry.ID = string(post.ID)
+	entry.Message = post.Message
+	assert.Nil(userStore.PutInbox(entry))
+
+	inFlight := &model.OutboxEntry{
+		ID:            "outbox",
+		CreatedAt:     time.Now().UTC(),
+		Status:        model.PostStatusPending,
+		SenderAddress: author,
+		Recipients:    model.Recipients{"someone@elsewhere.example.com"},
+		Hash:          string(post.ID),
+		ContentType:   string(model.ContentTypePost),
+		Payload:       original,
+		Signature:     "originalsignature",
+		NextAttemptAt: time.Now().UTC(),
+	}
+	assert.Nil(userStore.PutOutbox([]*model.OutboxEntry{inFlight}))
+
+	assert.NotEmpty(userStore.find(t, content))
+	assert.NotEmpty(userStore.find(t, original))
+
+	assert.Nil(userStore.DeletePost([]model.PostID{post.ID}, "deleteheader.deletepayload.deletesignature"))
+
+	assert.Empty(userStore.find(t, content))
+	assert.Empty(userStore.find(t, original))
+
+	tombstone, err := userStore.FetchPost(post.ID)
+	assert.Nil(err)
+	assert.Equal(model.PostStatusDeleted, tombstone.Status)
+	assert.Equal("deleteheader.deletepayload.deletesignature", tombstone.Message)
+
+	outbox, err := userStore.FetchOutbox("outbox")
+	assert.Nil(err)
+	assert.Equal(model.PostStatusFailedPermanent, outbox.Status)
+
+	// a delivery that was already under way doesn't undo the purge
+	inFlight.Status = model.PostStatusFailed
+	inFlight.Attempts = 1
+	inFlight.LastError = "recipient server responded 500"
+	assert.Nil(userStore.UpdateOutbox(inFlight))
+	outbox, err = userStore.FetchOutbox("outbox")
+	assert.Nil(err)
+	assert.Equal(model.PostStatusFailedPermanent, outbox.Status)
+	assert.Equal("post deleted", outbox.LastError)
+	assert.Empty(outbox.Payload)
+}
@@ -1,75 +1,240 @@
 package crypt
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/rakutentech/jwk-go/jwk"
+	"github.com/rakutentech/jwk-go/okp"
+	"golang.org/x/crypto/argon2"
 )
 
-func EncodePrivatekey(privateKey *ecdsa.PrivateKey, userID string, password string) (string, error) {
-	ks := jwk.NewSpec(privateKey)
-	rawJWK, err := ks.ToJWK()
+var ErrorIncorrectPassword = errors.New("incorrect password")
+
+// Private keys are stored as JWKs encrypted with AES-256-GCM under a key
+// derived from the password. The current format is
+//
+//	$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<nonce>$<ciphertext>
+//
+// with the user ID as additional data, so a blob can't be moved to another
+// user. The legacy format is <nonce>.<ciphertext> with the key taken from
+// SHA-256(userID || password); it is still accepted for decoding.
+const (
+	kdfArgon2id    = "argon2id"
+	kdfSaltSize    = 16
+	kdfKeySize     = 32
+	aesGCMNonceLen = 12
+)
+
+type KDFParams struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultKDFParams follows the second recommended option in RFC 9106.
+var DefaultKDFParams = KDFParams{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+}
+
+// EncodePrivatekey encrypts a P-256 ECDSA or an Ed25519 private key.
+func EncodePrivatekey(privateKey crypto.Signer, userID string, password string) (string, error) {
+	rawJWK, err := toJWK(privateKey, string(userID))
 	if err != nil {
-		return "", fmt.Errorf("creating JWK: %w", err)
+		return "", err
 	}
 
-	rawJWK.Use = "sig"
-	rawJWK.Alg = "ES256"
-	rawJWK.Kid = string(userID)
-
 	keyData, err := rawJWK.MarshalJSON()
 	if err != nil {
 		return "", fmt.Errorf("marshalling JWK: %w", err)
 	}
 
+	params := DefaultKDFParams
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("creating KDF salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, kdfKeySize)
+
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesGCMNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("creating AES nonce: %w", err)
+	}
+
+	ciphertext := aesgcm.Seal(nil, nonce, keyData, []byte(userID))
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s$%s",
+		kdfArgon2id, argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(nonce),
+		base64.RawStdEncoding.EncodeToString(ciphertext)), nil
+}
+
+func DecodePrivateKey(privateKey string, userID string, password string) (crypto.Signer, error) {
+	var keyData []byte
+	var err error
+	if strings.HasPrefix(privateKey, "$") {
+		keyData, err = decryptArgon2id(privateKey, userID, password)
+	} else {
+		keyData, err = decryptLegacy(privateKey, userID, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keySpec, err := jwk.Parse(string(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	switch key := keySpec.Key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case okp.Ed25519:
+		if len(key.PrivateKey()) == ed25519.SeedSize {
+			return ed25519.NewKeyFromSeed(key.PrivateKey()), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported private key type: %T", keySpec.Key)
+}
+
+// NeedsUpgrade reports whether an encrypted private key uses the legacy
+// format or weaker KDF parameters than the current defaults, and so should be
+// re-encrypted the next time the password is available.
+func NeedsUpgrade(privateKey string) bool {
+	if !strings.HasPrefix(privateKey, "$") {
+		return true
+	}
+	params, _, _, _, err := parseArgon2id(privateKey)
+	if err != nil {
+		return true
+	}
+	return params.Memory < DefaultKDFParams.Memory || params.Time < DefaultKDFParams.Time
+}
+
+func parseArgon2id(privateKey string) (*KDFParams, []byte, []byte, []byte, error) {
+	parts := strings.Split(privateKey, "$")
+	if len(parts) != 7 || parts[1] != kdfArgon2id {
+		return nil, nil, nil, nil, fmt.Errorf("invalid private key")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, nil, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+
+	params := &KDFParams{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid KDF parameters: %w", err)
+	}
+
+	var segments [3][]byte
+	for i, part := range parts[4:] {
+		segment, err := base64.RawStdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("decoding private key: %w", err)
+		}
+		segments[i] = segment
+	}
+
+	return params, segments[0], segments[1], segments[2], nil
+}
+
+func decryptArgon2id(privateKey string, userID string, password string) ([]byte, error) {
+	params, salt, nonce, ciphertext, err := parseArgon2id(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, kdfKeySize)
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aesgcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	keyData, err := aesgcm.Open(nil, nonce, ciphertext, []byte(userID))
+	if err != nil {
+		return nil, ErrorIncorrectPassword
+	}
+	return keyData, nil
+}
+
+func decryptLegacy(privateKey string, userID string, password string) ([]byte, error) {
 	shaHash := sha256.New()
 	shaHash.Write(base58.Decode(string(userID)))
 	shaHash.Write([]byte(password))
 	key := shaHash.Sum(nil)
 
-	block, err := aes.NewCipher(key)
+	parts := strings.Split(privateKey, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(parts[0])
 	if err != nil {
-		return "", fmt.Errorf("creating AES cipher: %w", err)
+		return nil, fmt.Errorf("failed to decode nonce: %w", err)
 	}
 
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("creating AES nonce: %w", err)
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, err := newGCM(key)
 	if err != nil {
-		return "", fmt.Errorf("creating GCM cipher: %w", err)
+		return nil, err
+	}
+	if len(nonce) != aesgcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, keyData, nil)
-	sb := strings.Builder{}
-	sb.WriteString(base64.StdEncoding.EncodeToString(nonce))
-	sb.WriteRune('.')
-	sb.WriteString(base64.StdEncoding.EncodeToString(ciphertext))
-
-	return sb.String(), nil
+	keyData, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrorIncorrectPassword
+	}
+	return keyData, nil
 }
 
-func EncodePublicKey(publicKey *ecdsa.PublicKey, keyID string) (string, error) {
-	ks := jwk.NewSpec(publicKey)
-	rawJWK, err := ks.ToJWK()
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("creating JWK: %w", err)
+		return nil, fmt.Errorf("creating AES cipher: %w", err)
 	}
 
-	rawJWK.Use = "sig"
-	rawJWK.Alg = "ES256"
-	rawJWK.Kid = keyID
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCM cipher: %w", err)
+	}
+	return aesgcm, nil
+}
+
+// EncodePublicKey encodes an ECDSA or an Ed25519 public key as a JWK, with
+// the algorithm it signs with.
+func EncodePublicKey(publicKey crypto.PublicKey, keyID string) (string, error) {
+	rawJWK, err := toJWK(publicKey, keyID)
+	if err != nil {
+		return "", err
+	}
 
 	keyData, err := rawJWK.MarshalJSON()
 	if err != nil {
@@ -78,7 +243,7 @@ func EncodePublicKey(publicKey *ecdsa.PublicKey, keyID string) (string, error) {
 	return base64.StdEncoding.EncodeToString(keyData), nil
 }
 
-func DecodePublicKey(publicKey string) (*ecdsa.PublicKey, error) {
+func DecodePublicKey(publicKey string) (crypto.PublicKey, error) {
 	keyData, err := base64.StdEncoding.DecodeString(publicKey)
 	if err != nil {
 		return nil, fmt.Errorf("decoding public key: %w", err)
@@ -89,5 +254,40 @@ func DecodePublicKey(publicKey string) (*ecdsa.PublicKey, error) {
 		return nil, fmt.Errorf("parsing public key: %w", err)
 	}
 
-	return keySpec.Key.(*ecdsa.PublicKey), nil
+	switch key := keySpec.Key.(type) {
+	case *ecdsa.PublicKey:
+		return key, nil
+	case okp.Ed25519:
+		if len(key.PublicKey()) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(key.PublicKey()), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported public key type: %T", keySpec.Key)
+}
+
+// toJWK wraps a signing key, public or private, in a JWK. jwk-go only knows
+// Ed25519 keys as octet key pairs, so those are converted first, with the
+// seed as the private part as in RFC 8037.
+func toJWK(key interface{}, keyID string) (*jwk.JWK, error) {
+	alg := "ES256"
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+		key = okp.NewEd25519(k.Public().(ed25519.PublicKey), k.Seed())
+	case ed25519.PublicKey:
+		alg = "EdDSA"
+		key = okp.NewEd25519(k, nil)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %T", key)
+	}
+
+	rawJWK, err := jwk.NewSpec(key).ToJWK()
+	if err != nil {
+		return nil, fmt.Errorf("creating JWK: %w", err)
+	}
+	rawJWK.Use = "sig"
+	rawJWK.Alg = alg
+	rawJWK.Kid = keyID
+	return rawJWK, nil
 }
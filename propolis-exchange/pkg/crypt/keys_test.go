@@ -0,0 +1,136 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/rakutentech/jwk-go/jwk"
+	"github.com/stretchr/testify/assert"
+	"uk.co.dudmesh.propolis/pkg/user"
+)
+
+// encodeLegacy reproduces the original SHA-256(userID || password) encoding
+// so decoding of keys stored before the KDF change stays covered.
+func encodeLegacy(t *testing.T, privateKey *ecdsa.PrivateKey, userID string, password string) string {
+	rawJWK, err := jwk.NewSpec(privateKey).ToJWK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData, err := rawJWK.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shaHash := sha256.New()
+	shaHash.Write(base58.Decode(userID))
+	shaHash.Write([]byte(password))
+	block, err := aes.NewCipher(shaHash.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	rand.Read(nonce)
+
+	return base64.StdEncoding.EncodeToString(nonce) + "." +
+		base64.StdEncoding.EncodeToString(aesgcm.Seal(nil, nonce, keyData, nil))
+}
+
+func TestPrivateKeyEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	userID := user.IDFromPublicKey(&privateKey.PublicKey)
+
+	t.Run("Round Trip", func(t *testing.T) {
+		encoded, err := EncodePrivatekey(privateKey, userID, "password")
+		assert.Nil(err)
+		assert.True(strings.HasPrefix(encoded, "$argon2id$v=19$m=65536,t=3,p=4$"))
+		assert.False(NeedsUpgrade(encoded))
+
+		decoded, err := DecodePrivateKey(encoded, userID, "password")
+		assert.Nil(err)
+		assert.True(privateKey.Equal(decoded))
+
+		_, err = DecodePrivateKey(encoded, userID, "wrong")
+		assert.ErrorIs(err, ErrorIncorrectPassword)
+	})
+
+	t.Run("Bound To User", func(t *testing.T) {
+		encoded, err := EncodePrivatekey(privateKey, userID, "password")
+		assert.Nil(err)
+
+		_, err = DecodePrivateKey(encoded, userID+"x", "password")
+		assert.ErrorIs(err, ErrorIncorrectPassword)
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		encoded := encodeLegacy(t, privateKey, userID, "password")
+		assert.True(NeedsUpgrade(encoded))
+
+		decoded, err := DecodePrivateKey(encoded, userID, "password")
+		assert.Nil(err)
+		assert.True(privateKey.Equal(decoded))
+
+		_, err = DecodePrivateKey(encoded, userID, "wrong")
+		assert.ErrorIs(err, ErrorIncorrectPassword)
+	})
+
+	t.Run("Weak Parameters", func(t *testing.T) {
+		encoded, err := EncodePrivatekey(privateKey, userID, "password")
+		assert.Nil(err)
+		weak := strings.Replace(encoded, "m=65536,t=3", "m=65536,t=1", 1)
+		assert.True(NeedsUpgrade(weak))
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, encoded := range []string{"", "$argon2id$v=19$m=1$a$b$c", "$argon2id$v=18$m=8,t=1,p=1$a$b$c", "abc"} {
+			_, err := DecodePrivateKey(encoded, userID, "password")
+			assert.NotNil(err, encoded)
+			assert.NotErrorIs(err, ErrorIncorrectPassword, encoded)
+		}
+	})
+}
+
+func TestEd25519KeyEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	userID := user.IDFromPublicKey(publicKey)
+
+	t.Run("Private Key", func(t *testing.T) {
+		encoded, err := EncodePrivatekey(privateKey, userID, "password")
+		assert.Nil(err)
+
+		decoded, err := DecodePrivateKey(encoded, userID, "password")
+		assert.Nil(err)
+		assert.True(privateKey.Equal(decoded))
+	})
+
+	t.Run("Public Key", func(t *testing.T) {
+		encoded, err := EncodePublicKey(publicKey, userID)
+		assert.Nil(err)
+		keyData, err := base64.StdEncoding.DecodeString(encoded)
+		assert.Nil(err)
+		assert.Contains(string(keyData), `"alg":"EdDSA"`)
+		assert.Contains(string(keyData), `"crv":"Ed25519"`)
+
+		decoded, err := DecodePublicKey(encoded)
+		assert.Nil(err)
+		assert.True(publicKey.Equal(decoded))
+	})
+}
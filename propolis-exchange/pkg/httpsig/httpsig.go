@@ -0,0 +1,229 @@
+// Package httpsig signs and verifies requests between servers with HTTP
+// Message Signatures (RFC 9421). Only ecdsa-p256-sha256 is supported, and the
+// body is covered through a Content-Digest header (RFC 9530).
+package httpsig
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgorithmECDSAP256SHA256 = "ecdsa-p256-sha256"
+
+	HeaderSignature      = "Signature"
+	HeaderSignatureInput = "Signature-Input"
+	HeaderContentDigest  = "Content-Digest"
+
+	label = "sig1"
+)
+
+var (
+	ErrorMissingSignature = errors.New("missing request signature")
+	ErrorInvalidSignature = errors.New("invalid request signature")
+	ErrorExpiredSignature = errors.New("request signature is too old or too far in the future")
+	ErrorDigestMismatch   = errors.New("content digest does not match body")
+	ErrorUnknownKey       = errors.New("unknown request signing key")
+)
+
+// components are covered by every signature, whatever headers are asked for.
+var components = []string{"@method", "@authority", "@path", "content-digest"}
+
+// KeyFn finds the public key for the keyid a request was signed with.
+type KeyFn func(keyID string) (*ecdsa.PublicKey, error)
+
+// Sign adds a Content-Digest for body and a signature over it, the request's
+// method, authority and path, and the given headers, which must be set.
+func Sign(req *http.Request, body []byte, keyID string, key *ecdsa.PrivateKey, headers ...string) error {
+	if strings.ContainsAny(keyID, "\"\\") {
+		return fmt.Errorf("keyid %q can't be used in a signature", keyID)
+	}
+
+	req.Header.Set(HeaderContentDigest, contentDigest(body))
+
+	covered := append(append([]string{}, components...), lower(headers)...)
+	params := signatureParams(covered, time.Now().Unix(), keyID)
+
+	base, err := signatureBase(req, covered, params)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(base))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return fmt.Errorf("signing request: %w", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	req.Header.Set(HeaderSignatureInput, label+"="+params)
+	req.Header.Set(HeaderSignature, label+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+	return nil
+}
+
+// Verify checks the first signature on a request and returns the keyid it was
+// made with. The signature must cover the method, authority, path, body digest
+// and the given headers, and must have been created within maxAge of now.
+func Verify(req *http.Request, body []byte, keyFn KeyFn, maxAge time.Duration, headers ...string) (string, error) {
+	inputs, err := parseDictionary(strings.Join(req.Header.Values(HeaderSignatureInput), ", "))
+	if err != nil {
+		return "", err
+	}
+	signatures, err := parseDictionary(strings.Join(req.Header.Values(HeaderSignature), ", "))
+	if err != nil {
+		return "", err
+	}
+	if len(inputs) == 0 {
+		return "", ErrorMissingSignature
+	}
+
+	input := inputs[0]
+	signature, ok := signatures.get(input.key)
+	if !ok {
+		return "", ErrorMissingSignature
+	}
+	covered, params, err := parseInnerList(input.value)
+	if err != nil {
+		return "", err
+	}
+
+	if alg, ok := params["alg"]; ok && alg != AlgorithmECDSAP256SHA256 {
+		return "", fmt.Errorf("%w: unsupported algorithm %s", ErrorInvalidSignature, alg)
+	}
+	keyID, ok := params["keyid"]
+	if !ok {
+		return "", fmt.Errorf("%w: missing keyid", ErrorInvalidSignature)
+	}
+	created, err := strconv.ParseInt(params["created"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: missing or invalid created", ErrorInvalidSignature)
+	}
+	age := time.Since(time.Unix(created, 0))
+	if age > maxAge || age < -maxAge {
+		return "", ErrorExpiredSignature
+	}
+
+	for _, required := range append(append([]string{}, components...), lower(headers)...) {
+		if !contains(covered, required) {
+			return "", fmt.Errorf("%w: %s is not covered", ErrorInvalidSignature, required)
+		}
+	}
+
+	digests, err := parseDictionary(req.Header.Get(HeaderContentDigest))
+	if err != nil {
+		return "", err
+	}
+	digest, ok := digests.get("sha-256")
+	if !ok || subtle.ConstantTimeCompare([]byte("sha-256="+digest), []byte(contentDigest(body))) != 1 {
+		return "", ErrorDigestMismatch
+	}
+
+	base, err := signatureBase(req, covered, input.value)
+	if err != nil {
+		return "", err
+	}
+
+	rawSignature, err := parseByteSequence(signature)
+	if err != nil || len(rawSignature) != 64 {
+		return "", ErrorInvalidSignature
+	}
+
+	key, err := keyFn(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(base))
+	r := new(big.Int).SetBytes(rawSignature[:32])
+	s := new(big.Int).SetBytes(rawSignature[32:])
+	if !ecdsa.Verify(key, hash[:], r, s) {
+		return "", ErrorInvalidSignature
+	}
+
+	return keyID, nil
+}
+
+func contentDigest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(hash[:]) + ":"
+}
+
+func signatureParams(covered []string, created int64, keyID string) string {
+	quoted := make([]string, len(covered))
+	for i, component := range covered {
+		quoted[i] = `"` + component + `"`
+	}
+	return fmt.Sprintf(`(%s);created=%d;keyid="%s";alg="%s"`,
+		strings.Join(quoted, " "), created, keyID, AlgorithmECDSAP256SHA256)
+}
+
+// signatureBase builds the string that is signed, as described in section
+// 2.5 of RFC 9421.
+func signatureBase(req *http.Request, covered []string, params string) (string, error) {
+	var base strings.Builder
+	for _, component := range covered {
+		value, err := componentValue(req, component)
+		if err != nil {
+			return "", err
+		}
+		base.WriteString(`"` + component + `": ` + value + "\n")
+	}
+	base.WriteString(`"@signature-params": ` + params)
+	return base.String(), nil
+}
+
+func componentValue(req *http.Request, component string) (string, error) {
+	switch component {
+	case "@method":
+		return req.Method, nil
+	case "@authority":
+		return strings.ToLower(req.Host), nil
+	case "@path":
+		if path := req.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	}
+	if strings.HasPrefix(component, "@") {
+		return "", fmt.Errorf("%w: unsupported component %s", ErrorInvalidSignature, component)
+	}
+
+	values := req.Header.Values(component)
+	if len(values) == 0 {
+		return "", fmt.Errorf("%w: covered header %s is missing", ErrorInvalidSignature, component)
+	}
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.TrimSpace(value)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+func lower(headers []string) []string {
+	lowered := make([]string, len(headers))
+	for i, header := range headers {
+		lowered[i] = strings.ToLower(header)
+	}
+	return lowered
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
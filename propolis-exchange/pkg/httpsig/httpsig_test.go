@@ -0,0 +1,141 @@
+package httpsig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const recipientHeader = "X-Propolis-Recipient"
+
+// received turns a signed client request into the request a server sees.
+func received(sent *http.Request, body string) *http.Request {
+	req := httptest.NewRequest(sent.Method, sent.URL.String(), strings.NewReader(body))
+	req.Header = sent.Header.Clone()
+	return req
+}
+
+func signedRequest(t *testing.T, key *ecdsa.PrivateKey, body string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, "https://Remote.Example.com/ingest", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(recipientHeader, "recipient@remote.example.com")
+	if err := Sign(req, []byte(body), "local.example.com", key, recipientHeader); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	keyFn := func(keyID string) (*ecdsa.PublicKey, error) {
+		if keyID != "local.example.com" {
+			return nil, ErrorUnknownKey
+		}
+		return &privateKey.PublicKey, nil
+	}
+	body := "header.payload.signature"
+
+	t.Run("Verify", func(t *testing.T) {
+		req := received(signedRequest(t, privateKey, body), body)
+		keyID, err := Verify(req, []byte(body), keyFn, time.Minute, recipientHeader)
+		assert.Nil(err)
+		assert.Equal("local.example.com", keyID)
+	})
+
+	t.Run("Signature Base", func(t *testing.T) {
+		req := signedRequest(t, privateKey, body)
+		params := strings.TrimPrefix(req.Header.Get(HeaderSignatureInput), label+"=")
+		assert.Regexp(`^\("@method" "@authority" "@path" "content-digest" "x-propolis-recipient"\);created=\d+;keyid="local.example.com";alg="ecdsa-p256-sha256"$`, params)
+
+		base, err := signatureBase(req, []string{"@method", "@authority", "@path", "content-digest", "x-propolis-recipient"}, params)
+		assert.Nil(err)
+		assert.Equal(`"@method": POST
+"@authority": remote.example.com
+"@path": /ingest
+"content-digest": sha-256=:JW0E205eSsMIdR7QiFtyK3WGMFZ8U6cSXtn70Gjlw/Y=:
+"x-propolis-recipient": recipient@remote.example.com
+"@signature-params": `+params, base)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+		_, err := Verify(req, []byte(body), keyFn, time.Minute)
+		assert.ErrorIs(err, ErrorMissingSignature)
+	})
+
+	t.Run("Tampered Body", func(t *testing.T) {
+		req := received(signedRequest(t, privateKey, body), "tampered")
+		_, err := Verify(req, []byte("tampered"), keyFn, time.Minute, recipientHeader)
+		assert.ErrorIs(err, ErrorDigestMismatch)
+	})
+
+	t.Run("Tampered Header", func(t *testing.T) {
+		req := received(signedRequest(t, privateKey, body), body)
+		req.Header.Set(recipientHeader, "someone-else@remote.example.com")
+		_, err := Verify(req, []byte(body), keyFn, time.Minute, recipientHeader)
+		assert.ErrorIs(err, ErrorInvalidSignature)
+	})
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		req := received(signedRequest(t, otherKey, body), body)
+		_, err := Verify(req, []byte(body), keyFn, time.Minute, recipientHeader)
+		assert.ErrorIs(err, ErrorInvalidSignature)
+	})
+
+	t.Run("Unknown Key", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "https://remote.example.com/ingest", strings.NewReader(body))
+		assert.Nil(Sign(req, []byte(body), "unknown.example.com", privateKey))
+		_, err := Verify(received(req, body), []byte(body), keyFn, time.Minute)
+		assert.ErrorIs(err, ErrorUnknownKey)
+	})
+
+	t.Run("Uncovered Header", func(t *testing.T) {
+		req := received(signedRequest(t, privateKey, body), body)
+		_, err := Verify(req, []byte(body), keyFn, time.Minute, recipientHeader, "X-Other")
+		assert.ErrorIs(err, ErrorInvalidSignature)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		for _, created := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(2 * time.Minute)} {
+			req := received(signedRequest(t, privateKey, body), body)
+			input := req.Header.Get(HeaderSignatureInput)
+			start := strings.Index(input, "created=") + len("created=")
+			end := start + strings.Index(input[start:], ";")
+			req.Header.Set(HeaderSignatureInput, input[:start]+strconv.FormatInt(created.Unix(), 10)+input[end:])
+
+			_, err := Verify(req, []byte(body), keyFn, time.Minute, recipientHeader)
+			assert.ErrorIs(err, ErrorExpiredSignature)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, input := range []string{
+			`sig1`,
+			`sig1=("@method"`,
+			`sig1=("@method" @path);keyid="a"`,
+			`sig1=("@method");keyid=a`,
+			`Sig1=("@method");keyid="a"`,
+		} {
+			req := received(signedRequest(t, privateKey, body), body)
+			req.Header.Set(HeaderSignatureInput, input)
+			_, err := Verify(req, []byte(body), keyFn, time.Minute)
+			assert.ErrorIs(err, ErrorInvalidSignature, input)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package httpsig
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// The signature headers are Structured Fields (RFC 8941). This parses just
+// enough of the syntax for them: dictionaries whose members are inner lists of
+// strings with string or integer parameters, or byte sequences.
+
+type member struct {
+	key   string
+	value string
+}
+
+type dictionary []member
+
+func (d dictionary) get(key string) (string, bool) {
+	for _, m := range d {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+	return "", false
+}
+
+// parseDictionary splits a dictionary into its members, leaving each value as
+// it appeared in the header.
+func parseDictionary(field string) (dictionary, error) {
+	d := dictionary{}
+	if strings.TrimSpace(field) == "" {
+		return d, nil
+	}
+
+	for _, raw := range split(field, ',') {
+		key, value, found := strings.Cut(strings.TrimSpace(raw), "=")
+		if !found || !isKey(key) || value == "" {
+			return nil, fmt.Errorf("%w: malformed dictionary member %q", ErrorInvalidSignature, raw)
+		}
+		d = append(d, member{key, value})
+	}
+	return d, nil
+}
+
+// parseInnerList parses an inner list of strings and its parameters.
+func parseInnerList(raw string) ([]string, map[string]string, error) {
+	parts := split(strings.TrimPrefix(raw, "("), ')')
+	if !strings.HasPrefix(raw, "(") || len(parts) != 2 {
+		return nil, nil, fmt.Errorf("%w: malformed inner list", ErrorInvalidSignature)
+	}
+
+	items := []string{}
+	for _, rawItem := range split(parts[0], ' ') {
+		if rawItem == "" {
+			continue
+		}
+		item, err := parseString(rawItem)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+	}
+
+	params := map[string]string{}
+	rawParams := split(parts[1], ';')
+	if rawParams[0] != "" {
+		return nil, nil, fmt.Errorf("%w: malformed parameters", ErrorInvalidSignature)
+	}
+	for _, rawParam := range rawParams[1:] {
+		key, value, found := strings.Cut(rawParam, "=")
+		if !found || !isKey(key) {
+			return nil, nil, fmt.Errorf("%w: malformed parameter %q", ErrorInvalidSignature, rawParam)
+		}
+		if strings.HasPrefix(value, `"`) {
+			var err error
+			if value, err = parseString(value); err != nil {
+				return nil, nil, err
+			}
+		} else if !isInteger(value) {
+			return nil, nil, fmt.Errorf("%w: unsupported parameter value %q", ErrorInvalidSignature, value)
+		}
+		params[key] = value
+	}
+
+	return items, params, nil
+}
+
+func parseString(raw string) (string, error) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return "", fmt.Errorf("%w: malformed string %q", ErrorInvalidSignature, raw)
+	}
+	var s strings.Builder
+	for i := 1; i < len(raw)-1; i++ {
+		c := raw[i]
+		if c == '\\' {
+			i++
+			if i == len(raw)-1 || raw[i] != '"' && raw[i] != '\\' {
+				return "", fmt.Errorf("%w: malformed string %q", ErrorInvalidSignature, raw)
+			}
+			c = raw[i]
+		} else if c == '"' || c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("%w: malformed string %q", ErrorInvalidSignature, raw)
+		}
+		s.WriteByte(c)
+	}
+	return s.String(), nil
+}
+
+func parseByteSequence(raw string) ([]byte, error) {
+	if len(raw) < 2 || raw[0] != ':' || raw[len(raw)-1] != ':' {
+		return nil, fmt.Errorf("%w: malformed byte sequence", ErrorInvalidSignature)
+	}
+	return base64.StdEncoding.DecodeString(raw[1 : len(raw)-1])
+}
+
+// split cuts s at every sep that isn't inside a string or an inner list.
+func split(s string, sep byte) []string {
+	parts := []string{}
+	start, depth, quoted := 0, 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func isKey(key string) bool {
+	if key == "" || !(key[0] >= 'a' && key[0] <= 'z' || key[0] == '*') {
+		return false
+	}
+	for i := 1; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			return false
+		}
+	}
+	return true
+}
+
+func isInteger(value string) bool {
+	digits := strings.TrimPrefix(value, "-")
+	if digits == "" || len(digits) > 15 {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,435 @@
+package message
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted messages carry their payload sealed to the recipient's P-256 key,
+// ECIES style. An ephemeral key is agreed with the recipient's key by ECDH,
+// an AES-256-GCM key is derived from the shared secret with HKDF-SHA256, and
+// the envelope holding the ciphertext is signed by the sender as usual. Relays
+// can check who sent a message but not read it, and the content type of the
+// payload is sealed along with it.
+//
+// Messages for a group are sealed once under a random content key, which is
+// then wrapped for each recipient the same way, JWE style, so one signed
+// message can be delivered to all of them.
+const (
+	TypeEncrypted      = "x-propolis-encrypted"
+	EncryptionECDHES   = "ECDH-ES+A256GCM"
+	EncryptionECDHESKW = "ECDH-ES+A256GCMKW"
+
+	contentKeyLen  = 32
+	aesGCMNonceLen = 12
+)
+
+var (
+	ErrorNotEncrypted     = errors.New("message is not encrypted")
+	ErrorNotRecipient     = errors.New("message is not for this recipient")
+	ErrorDecryptionFailed = errors.New("decryption failed")
+)
+
+// Envelope is the payload of an encrypted message. EphemeralKey is the
+// uncompressed point of the sender's one-off key. Envelopes for a group have
+// Recipients in place of Recipient and EphemeralKey.
+type Envelope struct {
+	Encryption   string         `json:"enc"`
+	Recipient    Address        `json:"rcpt,omitempty"`
+	EphemeralKey string         `json:"epk,omitempty"`
+	Recipients   []RecipientKey `json:"recipients,omitempty"`
+	Nonce        string         `json:"iv"`
+	Ciphertext   string         `json:"ct"`
+}
+
+// RecipientKey is the content key of a group envelope wrapped for one
+// recipient.
+type RecipientKey struct {
+	Recipient    Address `json:"rcpt"`
+	EphemeralKey string  `json:"epk"`
+	Nonce        string  `json:"iv"`
+	WrappedKey   string  `json:"ek"`
+}
+
+// sealed is what an envelope's ciphertext decrypts to.
+type sealed struct {
+	ContentType string          `json:"typ"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// NewEncrypted is New for a payload only the recipient can read. The sender
+// may sign with any key New accepts, but encryption needs the recipient to
+// have a P-256 key.
+func NewEncrypted(payload interface{}, senderAddress Address, messageSubType string, privateKey crypto.Signer, recipient Address, recipientKey *ecdsa.PublicKey, opts ...Option) (string, string, error) {
+	if payload == nil {
+		return "", "", ErrorMissingPayload
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", fmt.Errorf("marshalling payload: %w", err)
+	}
+	plaintext, err := json.Marshal(&sealed{messageSubType, payloadBytes})
+	if err != nil {
+		return "", "", fmt.Errorf("marshalling sealed payload: %w", err)
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("creating ephemeral key: %w", err)
+	}
+	nonce := make([]byte, aesGCMNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", fmt.Errorf("creating nonce: %w", err)
+	}
+
+	envelope, err := seal(plaintext, senderAddress, recipient, recipientKey, ephemeral, nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("encrypting payload: %w", err)
+	}
+
+	return New(envelope, senderAddress, TypeEncrypted, privateKey, opts...)
+}
+
+// NewGroupEncrypted is NewEncrypted for several recipients at once, with the
+// payload sealed once and its key wrapped for each of them.
+func NewGroupEncrypted(payload interface{}, senderAddress Address, messageSubType string, privateKey crypto.Signer, recipientKeys map[Address]*ecdsa.PublicKey, opts ...Option) (string, string, error) {
+	if payload == nil {
+		return "", "", ErrorMissingPayload
+	}
+	if len(recipientKeys) == 0 {
+		return "", "", ErrorNotRecipient
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", fmt.Errorf("marshalling payload: %w", err)
+	}
+	plaintext, err := json.Marshal(&sealed{messageSubType, payloadBytes})
+	if err != nil {
+		return "", "", fmt.Errorf("marshalling sealed payload: %w", err)
+	}
+
+	contentKey := make([]byte, contentKeyLen)
+	if _, err := io.ReadFull(rand.Reader, contentKey); err != nil {
+		return "", "", fmt.Errorf("creating content key: %w", err)
+	}
+	nonce := make([]byte, aesGCMNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", fmt.Errorf("creating nonce: %w", err)
+	}
+
+	recipients := make([]Address, 0, len(recipientKeys))
+	for recipient := range recipientKeys {
+		recipients = append(recipients, recipient)
+	}
+	sort.Slice(recipients, func(i, j int) bool { return recipients[i] < recipients[j] })
+
+	envelope, err := sealContent(plaintext, senderAddress, contentKey, nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("encrypting payload: %w", err)
+	}
+	for _, recipient := range recipients {
+		ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", fmt.Errorf("creating ephemeral key: %w", err)
+		}
+		wrapNonce := make([]byte, aesGCMNonceLen)
+		if _, err := io.ReadFull(rand.Reader, wrapNonce); err != nil {
+			return "", "", fmt.Errorf("creating nonce: %w", err)
+		}
+		wrapped, err := wrapKey(contentKey, senderAddress, recipient, recipientKeys[recipient], ephemeral, wrapNonce)
+		if err != nil {
+			return "", "", fmt.Errorf("wrapping key for %s: %w", recipient, err)
+		}
+		envelope.Recipients = append(envelope.Recipients, *wrapped)
+	}
+
+	return New(envelope, senderAddress, TypeEncrypted, privateKey, opts...)
+}
+
+// ParseFor is Parse followed by Decrypt, for the recipient an encrypted
+// message is being read by.
+func ParseFor(data []byte, publicKeyFn PublicKeyFn, recipient Address, privateKey *ecdsa.PrivateKey) (*Message, error) {
+	m, err := Parse(data, publicKeyFn)
+	if err != nil {
+		return nil, err
+	}
+	return m.Decrypt(recipient, privateKey)
+}
+
+// Decrypt opens an encrypted message with the recipient's private key. It
+// returns a copy of the message with the content type and payload that were
+// sealed in it, leaving Raw as the signed envelope.
+func (m *Message) Decrypt(recipient Address, privateKey *ecdsa.PrivateKey) (*Message, error) {
+	if m.ContentType != TypeEncrypted {
+		return nil, ErrorNotEncrypted
+	}
+
+	envelope := &Envelope{}
+	if err := json.Unmarshal(m.Payload, envelope); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling envelope: %s", ErrorInvalidMessage, err)
+	}
+
+	var plaintext []byte
+	var err error
+	switch envelope.Encryption {
+	case EncryptionECDHES:
+		if envelope.Recipient != recipient {
+			return nil, ErrorNotRecipient
+		}
+		plaintext, err = envelope.open(Address(m.Header.KeyID), privateKey)
+	case EncryptionECDHESKW:
+		plaintext, err = envelope.openFor(Address(m.Header.KeyID), recipient, privateKey)
+	default:
+		return nil, fmt.Errorf("%w: unsupported encryption: %s", ErrorInvalidMessage, envelope.Encryption)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sealed{}
+	if err := json.Unmarshal(plaintext, s); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling sealed payload: %s", ErrorInvalidMessage, err)
+	}
+
+	decrypted := *m
+	decrypted.ContentType = s.ContentType
+	decrypted.Payload = s.Payload
+	return &decrypted, nil
+}
+
+// Addressed reports whether the envelope can be opened by the recipient.
+func (e *Envelope) Addressed(recipient Address) bool {
+	if e.Encryption != EncryptionECDHESKW {
+		return e.Recipient == recipient
+	}
+	for _, key := range e.Recipients {
+		if key.Recipient == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// To lists everyone the envelope is addressed to.
+func (e *Envelope) To() []Address {
+	if e.Encryption != EncryptionECDHESKW {
+		return []Address{e.Recipient}
+	}
+	to := make([]Address, 0, len(e.Recipients))
+	for _, key := range e.Recipients {
+		to = append(to, key.Recipient)
+	}
+	return to
+}
+
+// seal encrypts to the recipient's key. The sender's address is the
+// additional data, so an envelope re-signed by someone else won't open.
+func seal(plaintext []byte, sender, recipient Address, recipientKey *ecdsa.PublicKey, ephemeral *ecdh.PrivateKey, nonce []byte) (*Envelope, error) {
+	peer, err := recipientKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("converting recipient key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("agreeing key: %w", err)
+	}
+
+	aesgcm, err := derivedCipher(TypeEncrypted, shared, ephemeral.PublicKey(), peer, recipient)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aesgcm.Seal(nil, nonce, plaintext, []byte(sender))
+
+	return &Envelope{
+		Encryption:   EncryptionECDHES,
+		Recipient:    recipient,
+		EphemeralKey: encodeSegment(ephemeral.PublicKey().Bytes()),
+		Nonce:        encodeSegment(nonce),
+		Ciphertext:   encodeSegment(ciphertext),
+	}, nil
+}
+
+func (e *Envelope) open(sender Address, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	nonce, ciphertext, err := e.content()
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := agreedCipher(TypeEncrypted, e.EphemeralKey, e.Recipient, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, []byte(sender))
+	if err != nil {
+		return nil, ErrorDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// openFor finds the recipient's wrapped key in a group envelope, unwraps it
+// and opens the payload with it.
+func (e *Envelope) openFor(sender, recipient Address, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	var key *RecipientKey
+	for i := range e.Recipients {
+		if e.Recipients[i].Recipient == recipient {
+			key = &e.Recipients[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrorNotRecipient
+	}
+
+	wrapNonce, err := decodeNonce(key.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := decodeSegment(key.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding wrapped key: %s", ErrorInvalidMessage, err)
+	}
+	kek, err := agreedCipher(EncryptionECDHESKW, key.EphemeralKey, recipient, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := kek.Open(nil, wrapNonce, wrapped, []byte(sender))
+	if err != nil || len(contentKey) != contentKeyLen {
+		return nil, ErrorDecryptionFailed
+	}
+
+	nonce, ciphertext, err := e.content()
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, []byte(sender))
+	if err != nil {
+		return nil, ErrorDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (e *Envelope) content() ([]byte, []byte, error) {
+	nonce, err := decodeNonce(e.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := decodeSegment(e.Ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: decoding ciphertext: %s", ErrorInvalidMessage, err)
+	}
+	return nonce, ciphertext, nil
+}
+
+// sealContent starts a group envelope with the payload sealed under the
+// content key.
+func sealContent(plaintext []byte, sender Address, contentKey, nonce []byte) (*Envelope, error) {
+	aesgcm, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Encryption: EncryptionECDHESKW,
+		Nonce:      encodeSegment(nonce),
+		Ciphertext: encodeSegment(aesgcm.Seal(nil, nonce, plaintext, []byte(sender))),
+	}, nil
+}
+
+// wrapKey wraps a group envelope's content key for one recipient, as seal
+// would encrypt a payload to them.
+func wrapKey(contentKey []byte, sender, recipient Address, recipientKey *ecdsa.PublicKey, ephemeral *ecdh.PrivateKey, nonce []byte) (*RecipientKey, error) {
+	peer, err := recipientKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("converting recipient key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("agreeing key: %w", err)
+	}
+
+	kek, err := derivedCipher(EncryptionECDHESKW, shared, ephemeral.PublicKey(), peer, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecipientKey{
+		Recipient:    recipient,
+		EphemeralKey: encodeSegment(ephemeral.PublicKey().Bytes()),
+		Nonce:        encodeSegment(nonce),
+		WrappedKey:   encodeSegment(kek.Seal(nil, nonce, contentKey, []byte(sender))),
+	}, nil
+}
+
+// agreedCipher is the recipient's side of derivedCipher, from the encoded
+// ephemeral key the sender used.
+func agreedCipher(label string, ephemeralKey string, recipient Address, privateKey *ecdsa.PrivateKey) (cipher.AEAD, error) {
+	own, err := privateKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("converting private key: %w", err)
+	}
+	point, err := decodeSegment(ephemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding ephemeral key: %s", ErrorInvalidMessage, err)
+	}
+	ephemeral, err := ecdh.P256().NewPublicKey(point)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ephemeral key", ErrorInvalidMessage)
+	}
+	shared, err := own.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrorDecryptionFailed
+	}
+	return derivedCipher(label, shared, ephemeral, own.PublicKey(), recipient)
+}
+
+func decodeNonce(segment string) ([]byte, error) {
+	nonce, err := decodeSegment(segment)
+	if err != nil || len(nonce) != aesGCMNonceLen {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrorInvalidMessage)
+	}
+	return nonce, nil
+}
+
+// derivedCipher derives an AES-GCM key from the shared secret. Both public
+// keys and the recipient's address are bound into the derivation, and the
+// label keeps keys derived for payloads apart from those for wrapping keys.
+func derivedCipher(label string, shared []byte, ephemeral, recipientKey *ecdh.PublicKey, recipient Address) (cipher.AEAD, error) {
+	info := []byte(label)
+	info = append(info, ephemeral.Bytes()...)
+	info = append(info, recipientKey.Bytes()...)
+	info = append(info, recipient...)
+
+	key := make([]byte, contentKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating AES cipher: %w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCM cipher: %w", err)
+	}
+	return aesgcm, nil
+}
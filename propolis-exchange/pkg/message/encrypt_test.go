@@ -0,0 +1,288 @@
+package message
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encryptionVector was produced by seal with a fixed ephemeral key and nonce,
+// so any change to the derivation or framing will show up here.
+var encryptionVector = struct {
+	recipientKey string
+	ephemeralKey string
+	nonce        string
+	sender       Address
+	recipient    Address
+	plaintext    string
+	envelope     Envelope
+}{
+	recipientKey: "c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721",
+	ephemeralKey: "519b423d715f8b581f4fa8ee59f4771a5b44c8130b4e3eacca54a56dda72b464",
+	nonce:        "000102030405060708090a0b",
+	sender:       "sender@a.example.com",
+	recipient:    "recipient@b.example.com",
+	plaintext:    `{"typ":"x-propolis-direct","payload":{"content":"hello"}}`,
+	envelope: Envelope{
+		Encryption:   EncryptionECDHES,
+		Recipient:    "recipient@b.example.com",
+		EphemeralKey: "BBzL6RwHX8f08DO_okjbj8zTVl3pS7-xLzxZ_0bCcb-DzkAUxogR-aIaH9ssDmET4G23ypO3QE543HzNXKiaTKk",
+		Nonce:        "AAECAwQFBgcICQoL",
+		Ciphertext:   "SfSq2xqlU78lDwXN4mDxQgcE7vZuHr1Q_XcPgZT19n540-yNFqSv-w2HSqaxf03fg1nBTBh38IhlLwDutAJn9QotHT2VulgCfA",
+	},
+}
+
+// groupVector is the plaintext of encryptionVector sealed for a group of one,
+// reusing its keys with a fixed content key.
+var groupVector = struct {
+	contentKey string
+	nonce      string
+	envelope   Envelope
+}{
+	contentKey: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	nonce:      "0c0d0e0f1011121314151617",
+	envelope: Envelope{
+		Encryption: EncryptionECDHESKW,
+		Recipients: []RecipientKey{{
+			Recipient:    "recipient@b.example.com",
+			EphemeralKey: "BBzL6RwHX8f08DO_okjbj8zTVl3pS7-xLzxZ_0bCcb-DzkAUxogR-aIaH9ssDmET4G23ypO3QE543HzNXKiaTKk",
+			Nonce:        "AAECAwQFBgcICQoL",
+			WrappedKey:   "7wg05D08Rq78FFeqbv9hlmcBw_yysu__pJfbmct-A07L7Ds9Jkaz6Q40z7GXWQO4",
+		}},
+		Nonce:      "DA0ODxAREhMUFRYX",
+		Ciphertext: "49wdoQ9UxnFPBzin_vtJizxwwIqfD17J74DWwpTBuZZDlg4H274EAnCdejeA2Djgrj7evcWbNs4zoRUvxGP13UsXxsvQNKZYlQ",
+	},
+}
+
+func privateKeyFromHex(t *testing.T, scalar string) *ecdsa.PrivateKey {
+	d, err := hex.DecodeString(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.P256().ScalarBaseMult(d)
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		D:         new(big.Int).SetBytes(d),
+	}
+}
+
+func TestEncryptionVector(t *testing.T) {
+	assert := assert.New(t)
+	v := encryptionVector
+	recipientKey := privateKeyFromHex(t, v.recipientKey)
+
+	t.Run("Seal", func(t *testing.T) {
+		scalar, _ := hex.DecodeString(v.ephemeralKey)
+		ephemeral, err := ecdh.P256().NewPrivateKey(scalar)
+		assert.Nil(err)
+		nonce, _ := hex.DecodeString(v.nonce)
+
+		envelope, err := seal([]byte(v.plaintext), v.sender, v.recipient, &recipientKey.PublicKey, ephemeral, nonce)
+		assert.Nil(err)
+		assert.Equal(v.envelope, *envelope)
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		plaintext, err := v.envelope.open(v.sender, recipientKey)
+		assert.Nil(err)
+		assert.Equal(v.plaintext, string(plaintext))
+	})
+
+	t.Run("Open As Someone Else", func(t *testing.T) {
+		_, err := v.envelope.open("mallory@a.example.com", recipientKey)
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+
+		envelope := v.envelope
+		envelope.Recipient = "mallory@b.example.com"
+		_, err = envelope.open(v.sender, recipientKey)
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+	})
+}
+
+func TestGroupVector(t *testing.T) {
+	assert := assert.New(t)
+	v, g := encryptionVector, groupVector
+	recipientKey := privateKeyFromHex(t, v.recipientKey)
+
+	t.Run("Seal", func(t *testing.T) {
+		scalar, _ := hex.DecodeString(v.ephemeralKey)
+		ephemeral, err := ecdh.P256().NewPrivateKey(scalar)
+		assert.Nil(err)
+		contentKey, _ := hex.DecodeString(g.contentKey)
+		nonce, _ := hex.DecodeString(g.nonce)
+		wrapNonce, _ := hex.DecodeString(v.nonce)
+
+		envelope, err := sealContent([]byte(v.plaintext), v.sender, contentKey, nonce)
+		assert.Nil(err)
+		wrapped, err := wrapKey(contentKey, v.sender, v.recipient, &recipientKey.PublicKey, ephemeral, wrapNonce)
+		assert.Nil(err)
+		envelope.Recipients = append(envelope.Recipients, *wrapped)
+		assert.Equal(g.envelope, *envelope)
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		plaintext, err := g.envelope.openFor(v.sender, v.recipient, recipientKey)
+		assert.Nil(err)
+		assert.Equal(v.plaintext, string(plaintext))
+
+		_, err = g.envelope.openFor("mallory@a.example.com", v.recipient, recipientKey)
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+	})
+}
+
+func TestEncryptedMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	senderKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	recipientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	const sender, recipient Address = "sender@a.example.com", "recipient@b.example.com"
+	keys := map[string]*ecdsa.PublicKey{
+		string(sender):          &senderKey.PublicKey,
+		"mallory@a.example.com": &otherKey.PublicKey,
+	}
+	parse := func(signed string) *Message {
+		msg, err := Parse([]byte(signed), func(header *Header) (crypto.PublicKey, error) {
+			return keys[header.KeyID], nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	payload := map[string]interface{}{"content": "hello"}
+	signed, id, err := NewEncrypted(payload, sender, "x-propolis-direct", senderKey, recipient, &recipientKey.PublicKey)
+	assert.Nil(err)
+	assert.NotEmpty(id)
+	assert.NotContains(signed, "hello")
+
+	msg := parse(signed)
+	assert.Equal(id, msg.ID)
+	assert.Equal(TypeEncrypted, msg.ContentType)
+
+	t.Run("Round Trip", func(t *testing.T) {
+		decrypted, err := msg.Decrypt(recipient, recipientKey)
+		assert.Nil(err)
+		assert.Equal("x-propolis-direct", decrypted.ContentType)
+		assert.Equal(msg.ID, decrypted.ID)
+		assert.Equal(signed, decrypted.String())
+
+		data := map[string]interface{}{}
+		assert.Nil(json.Unmarshal(decrypted.Payload, &data))
+		assert.Equal(payload, data)
+	})
+
+	t.Run("Wrong Recipient", func(t *testing.T) {
+		_, err := msg.Decrypt("someone@b.example.com", recipientKey)
+		assert.ErrorIs(err, ErrorNotRecipient)
+	})
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		_, err := msg.Decrypt(recipient, otherKey)
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+	})
+
+	t.Run("Re-signed", func(t *testing.T) {
+		envelope := &Envelope{}
+		assert.Nil(json.Unmarshal(msg.Payload, envelope))
+		resigned, _, err := New(envelope, "mallory@a.example.com", TypeEncrypted, otherKey)
+		assert.Nil(err)
+
+		_, err = parse(resigned).Decrypt(recipient, recipientKey)
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+	})
+
+	t.Run("Not Encrypted", func(t *testing.T) {
+		plain, _, err := New(payload, sender, "x-propolis-direct", senderKey)
+		assert.Nil(err)
+
+		_, err = parse(plain).Decrypt(recipient, recipientKey)
+		assert.ErrorIs(err, ErrorNotEncrypted)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour)
+		signed, _, err := NewEncrypted(payload, sender, "x-propolis-direct", senderKey, recipient, &recipientKey.PublicKey, WithExpiry(expiresAt))
+		assert.Nil(err)
+
+		decrypted, err := parse(signed).Decrypt(recipient, recipientKey)
+		assert.Nil(err)
+		assert.Equal(expiresAt.UnixMilli(), decrypted.Header.ExpiresAt)
+	})
+}
+
+func TestGroupEncryptedMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	senderKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	const sender Address = "sender@a.example.com"
+	publicKeyFn := func(header *Header) (crypto.PublicKey, error) {
+		return &senderKey.PublicKey, nil
+	}
+
+	privateKeys := map[Address]*ecdsa.PrivateKey{}
+	recipientKeys := map[Address]*ecdsa.PublicKey{}
+	for _, recipient := range []Address{"carol@c.example.com", "alice@b.example.com", "bob@b.example.com"} {
+		privateKeys[recipient], err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(err)
+		recipientKeys[recipient] = &privateKeys[recipient].PublicKey
+	}
+
+	payload := map[string]interface{}{"content": "hello all"}
+	signed, _, err := NewGroupEncrypted(payload, sender, "x-propolis-direct", senderKey, recipientKeys)
+	assert.Nil(err)
+	assert.NotContains(signed, "hello all")
+
+	t.Run("Every Recipient", func(t *testing.T) {
+		for recipient, privateKey := range privateKeys {
+			decrypted, err := ParseFor([]byte(signed), publicKeyFn, recipient, privateKey)
+			assert.Nil(err)
+			assert.Equal("x-propolis-direct", decrypted.ContentType)
+
+			data := map[string]interface{}{}
+			assert.Nil(json.Unmarshal(decrypted.Payload, &data))
+			assert.Equal(payload, data)
+		}
+	})
+
+	t.Run("Envelope", func(t *testing.T) {
+		msg, err := Parse([]byte(signed), publicKeyFn)
+		assert.Nil(err)
+		envelope := &Envelope{}
+		assert.Nil(json.Unmarshal(msg.Payload, envelope))
+
+		assert.Equal([]Address{"alice@b.example.com", "bob@b.example.com", "carol@c.example.com"}, envelope.To())
+		assert.True(envelope.Addressed("bob@b.example.com"))
+		assert.False(envelope.Addressed("mallory@b.example.com"))
+	})
+
+	t.Run("Not A Recipient", func(t *testing.T) {
+		_, err := ParseFor([]byte(signed), publicKeyFn, "mallory@b.example.com", privateKeys["alice@b.example.com"])
+		assert.ErrorIs(err, ErrorNotRecipient)
+	})
+
+	t.Run("Another Recipient's Entry", func(t *testing.T) {
+		_, err := ParseFor([]byte(signed), publicKeyFn, "bob@b.example.com", privateKeys["alice@b.example.com"])
+		assert.ErrorIs(err, ErrorDecryptionFailed)
+	})
+
+	t.Run("No Recipients", func(t *testing.T) {
+		_, _, err := NewGroupEncrypted(payload, sender, "x-propolis-direct", senderKey, nil)
+		assert.ErrorIs(err, ErrorNotRecipient)
+	})
+}
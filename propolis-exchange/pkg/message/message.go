@@ -1,14 +1,12 @@
 package message
 
 import (
-	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/big"
 	"strings"
 	"time"
 
@@ -17,17 +15,29 @@ import (
 
 const (
 	AlgorithmES256      = "ES256"
+	AlgorithmEdDSA      = "EdDSA"
 	TypePropolisMessage = "x-propolis-message"
+	// Version is the message format version this package signs and accepts.
+	Version = "1"
+	// MaxNotBefore is the furthest after it is signed that a message may
+	// become valid. A message is delivered once it's valid, so delivery and
+	// ingest must go on accepting it for longer than this after it's signed.
+	MaxNotBefore = 24 * time.Hour
 )
 
 type Address string
 
+// Header is the first segment of a message. Timestamps are Unix milliseconds.
+// ExpiresAt and NotBefore are optional and left out when zero, so messages
+// without them read the same as they always have.
 type Header struct {
 	KeyID     string `json:"kid"`
 	Algorithm string `json:"alg"`
 	Type      string `json:"typ"`
 	Version   string `json:"v"`
 	Timestamp int64  `json:"ts"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
 }
 
 type Message struct {
@@ -39,18 +49,45 @@ type Message struct {
 	SenderID    Address
 }
 
-type PublicKeyFn func(header *Header) (*ecdsa.PublicKey, error)
+// PublicKeyFn finds the sender's public key. The algorithm in the header
+// decides how it is used to check the signature.
+type PublicKeyFn func(header *Header) (crypto.PublicKey, error)
 
 var (
 	ErrorInvalidSignature = errors.New("invalid signature")
 	ErrorMissingPayload   = errors.New("missing payload")
 	ErrorInvalidMessage   = errors.New("invalid message")
+	ErrorExpiredMessage   = errors.New("message has expired")
+	ErrorNotYetValid      = errors.New("message is not valid yet")
 )
 
-func New(payload interface{}, senderAddress Address, messageSubType string, privateKey *ecdsa.PrivateKey) (string, string, error) {
+// Option sets one of the optional fields of the header of a new message.
+type Option func(header *Header)
+
+// WithExpiry makes a message invalid from expiresAt onwards.
+func WithExpiry(expiresAt time.Time) Option {
+	return func(header *Header) {
+		header.ExpiresAt = expiresAt.UnixMilli()
+	}
+}
+
+// WithNotBefore makes a message invalid until notBefore.
+func WithNotBefore(notBefore time.Time) Option {
+	return func(header *Header) {
+		header.NotBefore = notBefore.UnixMilli()
+	}
+}
+
+// New signs a payload with the sender's private key, which may be a P-256
+// ECDSA or an Ed25519 key.
+func New(payload interface{}, senderAddress Address, messageSubType string, privateKey crypto.Signer, opts ...Option) (string, string, error) {
 	if payload == nil {
 		return "", "", ErrorMissingPayload
 	}
+	signer, err := NewSigner(privateKey)
+	if err != nil {
+		return "", "", err
+	}
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
@@ -59,13 +96,22 @@ func New(payload interface{}, senderAddress Address, messageSubType string, priv
 
 	header := &Header{
 		KeyID:     string(senderAddress),
-		Algorithm: AlgorithmES256,
+		Algorithm: signer.Algorithm(),
 		Type:      fmt.Sprintf("%s;%s", TypePropolisMessage, messageSubType),
-		Version:   "1",
+		Version:   Version,
 		Timestamp: time.Now().UTC().UnixMilli(),
 	}
+	for _, opt := range opts {
+		opt(header)
+	}
+	if header.ExpiresAt != 0 && header.NotBefore >= header.ExpiresAt {
+		return "", "", fmt.Errorf("%w: expires before it becomes valid", ErrorInvalidMessage)
+	}
+	if header.NotBefore-header.Timestamp > MaxNotBefore.Milliseconds() {
+		return "", "", fmt.Errorf("%w: becomes valid more than %s after it is signed", ErrorInvalidMessage, MaxNotBefore)
+	}
 
-	message, id, err := sign(header, payloadBytes, string(senderAddress), privateKey)
+	message, id, err := sign(header, payloadBytes, string(senderAddress), signer)
 	if err != nil {
 		return "", "", fmt.Errorf("signing message: %w", err)
 	}
@@ -73,7 +119,54 @@ func New(payload interface{}, senderAddress Address, messageSubType string, priv
 	return message, id, nil
 }
 
+// Parse checks a message's signature and that it's valid now, going by the
+// optional expiry and not before times in its header.
 func Parse(data []byte, publicKeyFn PublicKeyFn) (*Message, error) {
+	m, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.verify(publicKeyFn)
+	if err != nil {
+		return nil, fmt.Errorf("verifying message: %w", err)
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ParseStored reads a message that was checked by Parse before it was stored,
+// so that reading it back doesn't need the sender's key again. The signature
+// is not checked, so the data must only ever come from such a store.
+func ParseStored(data []byte) (*Message, error) {
+	m, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m.setID()
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadHeader reads a message's header without checking the message, for
+// deciding how to handle one that has already been signed or checked.
+func ReadHeader(data []byte) (*Header, error) {
+	m, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return &m.Header, nil
+}
+
+// decode splits a message into its segments and reads the header.
+func decode(data []byte) (*Message, error) {
 	m := &Message{
 		Header:  Header{},
 		Payload: []byte{},
@@ -86,41 +179,78 @@ func Parse(data []byte, publicKeyFn PublicKeyFn) (*Message, error) {
 
 	header, err := decodeSegment(m.Raw[0])
 	if err != nil {
-		return nil, fmt.Errorf("decoding header: %w", err)
+		return nil, fmt.Errorf("%w: decoding header: %s", ErrorInvalidMessage, err)
 	}
 	err = json.Unmarshal(header, &m.Header)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshalling header: %w", err)
+		return nil, fmt.Errorf("%w: unmarshalling header: %s", ErrorInvalidMessage, err)
 	}
 
-	if m.Header.Algorithm != AlgorithmES256 {
-		return nil, fmt.Errorf("unsupported algorithm: %s", m.Header.Algorithm)
+	if m.Header.Algorithm != AlgorithmES256 && m.Header.Algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("%w: unsupported algorithm: %s", ErrorInvalidMessage, m.Header.Algorithm)
 	}
 
 	contentTypeParts := strings.SplitN(m.Header.Type, ";", 2)
-	if contentTypeParts[0] != TypePropolisMessage {
-		return nil, fmt.Errorf("unsupported type: %s", m.Header.Type)
+	if len(contentTypeParts) != 2 || contentTypeParts[0] != TypePropolisMessage {
+		return nil, fmt.Errorf("%w: unsupported type: %s", ErrorInvalidMessage, m.Header.Type)
 	}
 	m.ContentType = contentTypeParts[1]
 
-	if m.Header.Version != "1" {
-		return nil, fmt.Errorf("unsupported version: %s", m.Header.Version)
+	if m.Header.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version: %s", ErrorInvalidMessage, m.Header.Version)
 	}
 
-	err = m.verify(publicKeyFn)
+	return m, nil
+}
+
+// load checks that the message is valid now and decodes its payload.
+func (m *Message) load() error {
+	err := m.Header.Valid(time.Now())
 	if err != nil {
-		return nil, fmt.Errorf("verifying message: %w", err)
+		return err
 	}
 
 	m.Payload, err = decodeSegment(m.Raw[1])
 	if err != nil {
-		return nil, fmt.Errorf("decoding payload: %w", err)
+		return fmt.Errorf("%w: decoding payload: %s", ErrorInvalidMessage, err)
 	}
+	return nil
+}
 
-	return m, nil
+// Valid reports whether a message with this header can be used at now.
+func (h *Header) Valid(now time.Time) error {
+	if h.ExpiresAt != 0 && now.UnixMilli() >= h.ExpiresAt {
+		return fmt.Errorf("%w: at %s", ErrorExpiredMessage, time.UnixMilli(h.ExpiresAt).UTC().Format(time.RFC3339))
+	}
+	if h.NotBefore != 0 && now.UnixMilli() < h.NotBefore {
+		return fmt.Errorf("%w: until %s", ErrorNotYetValid, time.UnixMilli(h.NotBefore).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ValidFrom is when a message becomes valid, or nil if it always has been.
+func (h *Header) ValidFrom() *time.Time {
+	if h.NotBefore == 0 {
+		return nil
+	}
+	validFrom := time.UnixMilli(h.NotBefore).UTC()
+	return &validFrom
+}
+
+// Expires is when a message stops being valid, or nil if it doesn't.
+func (h *Header) Expires() *time.Time {
+	if h.ExpiresAt == 0 {
+		return nil
+	}
+	expires := time.UnixMilli(h.ExpiresAt).UTC()
+	return &expires
+}
+
+func (m *Message) String() string {
+	return strings.Join(m.Raw, ".")
 }
 
-func sign(header *Header, payloadBytes []byte, senderID string, privateKey *ecdsa.PrivateKey) (string, string, error) {
+func sign(header *Header, payloadBytes []byte, senderID string, signer Signer) (string, string, error) {
 	sbMsg := strings.Builder{}
 
 	headerBytes, err := json.Marshal(header)
@@ -131,35 +261,17 @@ func sign(header *Header, payloadBytes []byte, senderID string, privateKey *ecds
 	sbMsg.WriteString(encodeSegment(headerBytes))
 	sbMsg.WriteString(".")
 	sbMsg.WriteString(encodeSegment(payloadBytes))
+	id := messageID(sbMsg.String(), senderID)
 
-	shaHash := sha256.New()
-	shaHash.Write([]byte(sbMsg.String()))
-	hashBytes := shaHash.Sum(nil)
-
-	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashBytes)
+	signature, err := signer.Sign([]byte(sbMsg.String()))
 	if err != nil {
 		return "", "", fmt.Errorf("signing message: %w", err)
 	}
-	signature := make([]byte, 0, 64)
-	signature = append(signature, r.Bytes()...)
-	signature = append(signature, s.Bytes()...)
 
 	sbMsg.WriteString(".")
 	sbMsg.WriteString(encodeSegment(signature))
 
-	message := sbMsg.String()
-
-	sigHash := sha256.New()
-	sigHash.Write(signature)
-	sigHashBytes := sigHash.Sum(nil)
-
-	sbID := strings.Builder{}
-	sbID.WriteString(base58.Encode(sigHashBytes))
-	sbID.WriteString(".")
-	sbID.WriteString(senderID)
-	id := sbID.String()
-
-	return message, id, nil
+	return sbMsg.String(), id, nil
 }
 
 func (m *Message) verify(publicKeyFn PublicKeyFn) error {
@@ -170,37 +282,37 @@ func (m *Message) verify(publicKeyFn PublicKeyFn) error {
 		return fmt.Errorf("decoding signature: %w", err)
 	}
 
-	if len(signature) != 64 {
-		return ErrorInvalidSignature
-	}
-
-	r := new(big.Int).SetBytes(signature[0:32])
-	s := new(big.Int).SetBytes(signature[32:64])
-
-	dataHash := sha256.New()
-	dataHash.Write([]byte(signingString))
-	dataHashBytes := dataHash.Sum(nil)
-
-	pubicKey, err := publicKeyFn(&m.Header)
+	publicKey, err := publicKeyFn(&m.Header)
 	if err != nil {
 		return fmt.Errorf("getting public key: %w", err)
 	}
-	ok := ecdsa.Verify(pubicKey, dataHashBytes, r, s)
-	if !ok {
-		return ErrorInvalidSignature
+	verifier, err := NewVerifier(m.Header.Algorithm, publicKey)
+	if err != nil {
+		return err
+	}
+	if err := verifier.Verify([]byte(signingString), signature); err != nil {
+		return err
 	}
 
-	sigHash := sha256.New()
-	sigHash.Write(signature)
-	sigHashBytes := sigHash.Sum(nil)
+	m.setID()
+	return nil
+}
+
+func (m *Message) setID() {
+	m.ID = messageID(strings.Join(m.Raw[:2], "."), m.Header.KeyID)
+}
+
+// messageID derives a message's ID from what was signed and the sender's
+// address. The signature is left out, so that every valid signature of the
+// same message gives the same ID.
+func messageID(signingString string, senderID string) string {
+	hash := sha256.Sum256([]byte(signingString))
 
 	sb := strings.Builder{}
-	sb.WriteString(base58.Encode(sigHashBytes))
+	sb.WriteString(base58.Encode(hash[:]))
 	sb.WriteString(".")
-	sb.WriteString(m.Header.KeyID)
-	m.ID = sb.String()
-
-	return nil
+	sb.WriteString(senderID)
+	return sb.String()
 }
 
 func encodeSegment(seg []byte) string {
@@ -1,11 +1,16 @@
 package message
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/json"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/rakutentech/jwk-go/jwk"
@@ -34,7 +39,7 @@ func TestMessage(t *testing.T) {
 	t.Logf("Message: %s", m)
 	t.Logf("ID: %s", id)
 
-	m2, err := Parse([]byte(m), func(header *Header) (*ecdsa.PublicKey, error) {
+	m2, err := Parse([]byte(m), func(header *Header) (crypto.PublicKey, error) {
 		return &publicKey, nil
 	})
 	assert.Nil(err)
@@ -64,3 +69,243 @@ func TestMessage(t *testing.T) {
 	assert.Nil(err)
 	t.Logf("JWK: %s", string(jsonJWK))
 }
+
+func TestParseStored(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	signed, id, err := New(map[string]string{"data": "hello"}, "sender@example.com", "application/json", privateKey)
+	assert.Nil(err)
+
+	m, err := ParseStored([]byte(signed))
+	assert.Nil(err)
+	assert.Equal(id, m.ID)
+	assert.Equal("application/json", m.ContentType)
+	assert.JSONEq(`{"data": "hello"}`, string(m.Payload))
+
+	_, err = ParseStored([]byte("not a message"))
+	assert.ErrorIs(err, ErrorInvalidMessage)
+	_, err = ParseStored([]byte("e30.e30.e30"))
+	assert.ErrorIs(err, ErrorInvalidMessage)
+}
+
+func TestChangedSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	publicKeyFn := func(header *Header) (crypto.PublicKey, error) {
+		return &privateKey.PublicKey, nil
+	}
+	m, id, err := New(map[string]string{"data": "hello"}, "sender@example.com", "application/json", privateKey)
+	assert.Nil(err)
+	parts := strings.Split(m, ".")
+	signature, err := decodeSegment(parts[2])
+	assert.Nil(err)
+
+	t.Run("Low S", func(t *testing.T) {
+		for i := 0; i < 32; i++ {
+			m, _, err := New(map[string]string{"data": "hello"}, "sender@example.com", "application/json", privateKey)
+			assert.Nil(err)
+			signature, err := decodeSegment(strings.Split(m, ".")[2])
+			assert.Nil(err)
+			assert.LessOrEqual(new(big.Int).SetBytes(signature[32:]).Cmp(halfOrder), 0)
+		}
+	})
+
+	t.Run("High S", func(t *testing.T) {
+		// (r, n-s) is also a valid ECDSA signature of the same message
+		highS := new(big.Int).Sub(elliptic.P256().Params().N, new(big.Int).SetBytes(signature[32:]))
+		changed := append([]byte{}, signature...)
+		highS.FillBytes(changed[32:])
+
+		_, err := Parse([]byte(parts[0]+"."+parts[1]+"."+encodeSegment(changed)), publicKeyFn)
+		assert.ErrorIs(err, ErrorInvalidSignature)
+	})
+
+	t.Run("Same ID", func(t *testing.T) {
+		padded := parts[0] + "." + parts[1] + "." + parts[2] + "=="
+		parsed, err := Parse([]byte(padded), publicKeyFn)
+		if assert.Nil(err) {
+			assert.Equal(id, parsed.ID)
+		}
+
+		resigned, resignedID, err := sign(&parsed.Header, parsed.Payload, "sender@example.com", es256{privateKey})
+		assert.Nil(err)
+		assert.NotEqual(m, resigned)
+		assert.Equal(id, resignedID)
+	})
+}
+
+func TestEd25519Message(t *testing.T) {
+	assert := assert.New(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	userID := user.IDFromPublicKey(publicKey)
+	publicKeyFn := func(header *Header) (crypto.PublicKey, error) {
+		return publicKey, nil
+	}
+
+	payload := map[string]interface{}{
+		"data": "hello world",
+	}
+	m, id, err := New(payload, Address(userID), "application/json", privateKey)
+	assert.Nil(err)
+
+	t.Run("Round Trip", func(t *testing.T) {
+		m2, err := Parse([]byte(m), publicKeyFn)
+		assert.Nil(err)
+		assert.Equal(AlgorithmEdDSA, m2.Header.Algorithm)
+		assert.Equal(id, m2.ID)
+
+		jwt2, err := jwt.Parse(m, func(token *jwt.Token) (interface{}, error) {
+			return publicKey, nil
+		})
+		assert.Nil(err)
+		assert.NotNil(jwt2)
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		signer, err := NewSigner(privateKey)
+		assert.Nil(err)
+		header := &Header{KeyID: userID, Algorithm: AlgorithmEdDSA, Type: TypePropolisMessage + ";application/json", Version: Version, Timestamp: 1}
+		first, _, err := sign(header, []byte(`{}`), userID, signer)
+		assert.Nil(err)
+		second, _, err := sign(header, []byte(`{}`), userID, signer)
+		assert.Nil(err)
+		assert.Equal(first, second)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		parts := strings.Split(m, ".")
+		parts[1] = encodeSegment([]byte(`{"data":"goodbye world"}`))
+		_, err := Parse([]byte(strings.Join(parts, ".")), publicKeyFn)
+		assert.ErrorIs(err, ErrorInvalidSignature)
+	})
+
+	t.Run("Key Does Not Match Algorithm", func(t *testing.T) {
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(err)
+		_, err = Parse([]byte(m), func(header *Header) (crypto.PublicKey, error) {
+			return &ecdsaKey.PublicKey, nil
+		})
+		assert.ErrorIs(err, ErrorUnsupportedKey)
+
+		es256, _, err := New(payload, Address(userID), "application/json", ecdsaKey)
+		assert.Nil(err)
+		_, err = Parse([]byte(es256), publicKeyFn)
+		assert.ErrorIs(err, ErrorUnsupportedKey)
+	})
+
+	t.Run("Unsupported Key", func(t *testing.T) {
+		p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		assert.Nil(err)
+		_, _, err = New(payload, Address(userID), "application/json", p384Key)
+		assert.ErrorIs(err, ErrorUnsupportedKey)
+	})
+}
+
+func TestWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	window := Window{MaxAge: time.Hour, MaxSkew: 5 * time.Minute}
+	now := time.Now()
+	at := func(offset time.Duration) *Header {
+		return &Header{Timestamp: now.Add(offset).UnixMilli()}
+	}
+
+	assert.Nil(window.Check(at(0), now))
+	assert.Nil(window.Check(at(-59*time.Minute), now))
+	assert.Nil(window.Check(at(4*time.Minute), now))
+	assert.ErrorIs(window.Check(at(-61*time.Minute), now), ErrorStaleMessage)
+	assert.ErrorIs(window.Check(at(6*time.Minute), now), ErrorStaleMessage)
+	assert.ErrorIs(window.Check(&Header{}, now), ErrorStaleMessage)
+
+	assert.Equal(now.Add(time.Hour).UnixMilli(), window.Until(at(0)).UnixMilli())
+}
+
+func TestValidity(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	userID := user.IDFromPublicKey(&privateKey.PublicKey)
+	publicKeyFn := func(header *Header) (crypto.PublicKey, error) {
+		return &privateKey.PublicKey, nil
+	}
+	payload := map[string]interface{}{
+		"data": "hello world",
+	}
+	now := time.Now()
+
+	t.Run("Without Expiry", func(t *testing.T) {
+		m, _, err := New(payload, Address(userID), "application/json", privateKey)
+		assert.Nil(err)
+
+		header, err := decodeSegment(strings.Split(m, ".")[0])
+		assert.Nil(err)
+		assert.NotContains(string(header), `"exp"`)
+		assert.NotContains(string(header), `"nbf"`)
+
+		parsed, err := Parse([]byte(m), publicKeyFn)
+		assert.Nil(err)
+		assert.Nil(parsed.Header.Expires())
+	})
+
+	t.Run("Not Expired", func(t *testing.T) {
+		expiresAt := now.Add(time.Hour)
+		m, _, err := New(payload, Address(userID), "application/json", privateKey, WithExpiry(expiresAt), WithNotBefore(now.Add(-time.Minute)))
+		assert.Nil(err)
+
+		parsed, err := Parse([]byte(m), publicKeyFn)
+		assert.Nil(err)
+		if assert.NotNil(parsed.Header.Expires()) {
+			assert.Equal(expiresAt.UnixMilli(), parsed.Header.Expires().UnixMilli())
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		m, _, err := New(payload, Address(userID), "application/json", privateKey, WithExpiry(now.Add(-time.Second)))
+		assert.Nil(err)
+
+		_, err = Parse([]byte(m), publicKeyFn)
+		assert.ErrorIs(err, ErrorExpiredMessage)
+	})
+
+	t.Run("Not Yet Valid", func(t *testing.T) {
+		m, _, err := New(payload, Address(userID), "application/json", privateKey, WithNotBefore(now.Add(time.Hour)))
+		assert.Nil(err)
+
+		_, err = Parse([]byte(m), publicKeyFn)
+		assert.ErrorIs(err, ErrorNotYetValid)
+	})
+
+	t.Run("Expires Before Valid", func(t *testing.T) {
+		_, _, err := New(payload, Address(userID), "application/json", privateKey, WithNotBefore(now.Add(time.Hour)), WithExpiry(now.Add(time.Minute)))
+		assert.ErrorIs(err, ErrorInvalidMessage)
+	})
+
+	t.Run("Not Before Too Far Off", func(t *testing.T) {
+		_, _, err := New(payload, Address(userID), "application/json", privateKey, WithNotBefore(now.Add(MaxNotBefore+time.Minute)))
+		assert.ErrorIs(err, ErrorInvalidMessage)
+
+		m, _, err := New(payload, Address(userID), "application/json", privateKey, WithNotBefore(now.Add(MaxNotBefore-time.Minute)))
+		assert.Nil(err)
+		header, err := ReadHeader([]byte(m))
+		assert.Nil(err)
+		if assert.NotNil(header.ValidFrom()) {
+			assert.Equal(now.Add(MaxNotBefore-time.Minute).UnixMilli(), header.ValidFrom().UnixMilli())
+		}
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		header := &Header{NotBefore: now.UnixMilli(), ExpiresAt: now.Add(time.Hour).UnixMilli()}
+		assert.ErrorIs(header.Valid(now.Add(-time.Millisecond)), ErrorNotYetValid)
+		assert.Nil(header.Valid(now))
+		assert.Nil(header.Valid(now.Add(59 * time.Minute)))
+		assert.ErrorIs(header.Valid(now.Add(time.Hour)), ErrorExpiredMessage)
+		assert.Nil((&Header{}).Valid(now))
+	})
+}
@@ -0,0 +1,137 @@
+package message
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrorUnsupportedKey is returned for keys that no algorithm here can use.
+var ErrorUnsupportedKey = errors.New("unsupported key")
+
+// Signer signs messages under one algorithm, which is named in the header of
+// every message it signs.
+type Signer interface {
+	Algorithm() string
+	Sign(signingString []byte) ([]byte, error)
+}
+
+// Verifier checks signatures under one algorithm.
+type Verifier interface {
+	Verify(signingString []byte, signature []byte) error
+}
+
+// NewSigner picks the algorithm for a private key: ES256 for P-256 ECDSA keys
+// and EdDSA for Ed25519 keys.
+func NewSigner(privateKey crypto.Signer) (Signer, error) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: ECDSA curve %s", ErrorUnsupportedKey, key.Curve.Params().Name)
+		}
+		return es256{key}, nil
+	case ed25519.PrivateKey:
+		return eddsa{key}, nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrorUnsupportedKey, privateKey)
+}
+
+// NewVerifier returns the verifier for the algorithm named in a message
+// header, which must suit the sender's key.
+func NewVerifier(algorithm string, publicKey crypto.PublicKey) (Verifier, error) {
+	switch algorithm {
+	case AlgorithmES256:
+		if key, ok := publicKey.(*ecdsa.PublicKey); ok && key != nil && key.Curve == elliptic.P256() {
+			return es256Verifier{key}, nil
+		}
+	case AlgorithmEdDSA:
+		if key, ok := publicKey.(ed25519.PublicKey); ok && len(key) == ed25519.PublicKeySize {
+			return eddsaVerifier{key}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+	return nil, fmt.Errorf("%w: %T for %s", ErrorUnsupportedKey, publicKey, algorithm)
+}
+
+// halfOrder is half the order of P-256, above which the s of a signature is
+// high.
+var halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+type es256 struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s es256) Algorithm() string {
+	return AlgorithmES256
+}
+
+func (s es256) Sign(signingString []byte) ([]byte, error) {
+	hash := sha256.Sum256(signingString)
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// (r, n-s) verifies as well as (r, s), so only the low one is used and
+	// accepted, leaving each signature with a single form
+	if sig.Cmp(halfOrder) > 0 {
+		sig.Sub(s.key.Curve.Params().N, sig)
+	}
+	// r and s are padded to 32 bytes each, as they are read back
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+	return signature, nil
+}
+
+type es256Verifier struct {
+	key *ecdsa.PublicKey
+}
+
+func (v es256Verifier) Verify(signingString []byte, signature []byte) error {
+	if len(signature) != 64 {
+		return ErrorInvalidSignature
+	}
+	r := new(big.Int).SetBytes(signature[0:32])
+	s := new(big.Int).SetBytes(signature[32:64])
+	if s.Cmp(halfOrder) > 0 {
+		return ErrorInvalidSignature
+	}
+
+	hash := sha256.Sum256(signingString)
+	if !ecdsa.Verify(v.key, hash[:], r, s) {
+		return ErrorInvalidSignature
+	}
+	return nil
+}
+
+// eddsa signs with Ed25519, which hashes the message itself and needs no
+// randomness, so the same message always has the same signature.
+type eddsa struct {
+	key ed25519.PrivateKey
+}
+
+func (s eddsa) Algorithm() string {
+	return AlgorithmEdDSA
+}
+
+func (s eddsa) Sign(signingString []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, signingString), nil
+}
+
+type eddsaVerifier struct {
+	key ed25519.PublicKey
+}
+
+func (v eddsaVerifier) Verify(signingString []byte, signature []byte) error {
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(v.key, signingString, signature) {
+		return ErrorInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorStaleMessage is returned for messages whose timestamp falls outside
+// the window they're accepted in, whether too old or too far in the future.
+var ErrorStaleMessage = errors.New("message timestamp is outside the acceptance window")
+
+// Window is how far a message's timestamp may be from the time it arrives.
+// Parse doesn't apply it, since stored messages are parsed again long after
+// they were received; it's for checking messages as they come in.
+type Window struct {
+	// MaxAge is how long after it was signed a message is still accepted.
+	MaxAge time.Duration
+	// MaxSkew is how far ahead of now a timestamp may be, allowing for the
+	// sender's clock running fast.
+	MaxSkew time.Duration
+}
+
+// Check reports whether a message signed at the header's timestamp can be
+// accepted at now.
+func (w Window) Check(header *Header, now time.Time) error {
+	signedAt := time.UnixMilli(header.Timestamp)
+	if age := now.Sub(signedAt); age > w.MaxAge {
+		return fmt.Errorf("%w: signed %s ago", ErrorStaleMessage, age.Round(time.Second))
+	}
+	if ahead := signedAt.Sub(now); ahead > w.MaxSkew {
+		return fmt.Errorf("%w: signed %s in the future", ErrorStaleMessage, ahead.Round(time.Second))
+	}
+	return nil
+}
+
+// Until is when a message stops being accepted, which is as long as anything
+// needs to remember having seen it.
+func (w Window) Until(header *Header) time.Time {
+	return time.UnixMilli(header.Timestamp).Add(w.MaxAge).UTC()
+}
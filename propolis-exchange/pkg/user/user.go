@@ -1,16 +1,30 @@
 package user
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/cespare/xxhash"
 )
 
-func IDFromPublicKey(publicKey *ecdsa.PublicKey) string {
+// IDFromPublicKey derives a user's ID from their public key, which may be an
+// ECDSA or an Ed25519 key. It returns "" for any other kind of key.
+func IDFromPublicKey(publicKey crypto.PublicKey) string {
 	xxxHash := xxhash.New()
-	xxxHash.Write([]byte(publicKey.X.Bytes()))
-	xxxHash.Write([]byte(publicKey.Y.Bytes()))
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		xxxHash.Write([]byte(key.X.Bytes()))
+		xxxHash.Write([]byte(key.Y.Bytes()))
+	case ed25519.PublicKey:
+		// The key is prefixed with its algorithm so its ID can never match an
+		// ECDSA key whose coordinates happen to have the same bytes.
+		xxxHash.Write([]byte("Ed25519"))
+		xxxHash.Write(key)
+	default:
+		return ""
+	}
 	rawID := xxxHash.Sum(nil)
 	return base58.Encode(rawID[:])
 }